@@ -0,0 +1,317 @@
+package httptunnel
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultAuditQueueSize = 1024
+
+// AuditRecord is one line of an audit log. An "open" record is written when a
+// tunnel is established and a "close" record, with the traffic statistics,
+// when it is closed.
+type AuditRecord struct {
+	Time          time.Time `json:"time"`
+	Event         string    `json:"event"`
+	TunnelID      string    `json:"tunnel_id"`
+	Principal     string    `json:"principal,omitempty"`
+	SourceIP      string    `json:"source_ip"`
+	Path          string    `json:"path"`
+	Protocol      string    `json:"protocol,omitempty"`
+	Target        string    `json:"target,omitempty"`
+	Duration      float64   `json:"duration_seconds,omitempty"`
+	BytesReceived int64     `json:"bytes_received,omitempty"`
+	BytesSent     int64     `json:"bytes_sent,omitempty"`
+	CloseReason   string    `json:"close_reason,omitempty"`
+}
+
+// An AuditLog writes a JSON Lines record of every tunnel accepted by a
+// Hijacker. Records are queued and written by a background goroutine so that
+// the tunnels are never blocked; when the queue is full, records are dropped
+// and counted.
+//
+// It is safe to share an AuditLog between Hijackers.
+type AuditLog struct {
+	// Principal returns the identity of the client making the request.
+	// If nil, the common name of the verified TLS client certificate or the
+	// basic auth username is used.
+	Principal func(*http.Request) string
+	// Target returns the destination of the tunnel for the request. If nil,
+	// no target is recorded.
+	Target func(*http.Request) string
+
+	w       io.Writer
+	records chan AuditRecord
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	mu     sync.RWMutex
+	closed bool
+
+	closeOnce sync.Once
+	// err is written by run until done is closed, then by the first Close
+	err error
+}
+
+// NewAuditLog returns an AuditLog writing to w. If w is an io.Closer, it is
+// closed by AuditLog.Close.
+func NewAuditLog(w io.Writer) *AuditLog {
+	a := &AuditLog{
+		w:       w,
+		records: make(chan AuditRecord, defaultAuditQueueSize),
+		done:    make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *AuditLog) run() {
+	defer close(a.done)
+	bw := bufio.NewWriter(a.w)
+	enc := json.NewEncoder(bw)
+	for record := range a.records {
+		if err := enc.Encode(record); err != nil && a.err == nil {
+			a.err = err
+		}
+		// Flush once the queue has been drained
+		if len(a.records) == 0 {
+			if err := bw.Flush(); err != nil && a.err == nil {
+				a.err = err
+			}
+		}
+	}
+	if err := bw.Flush(); err != nil && a.err == nil {
+		a.err = err
+	}
+}
+
+// Dropped returns the number of records dropped because the queue was full.
+func (a *AuditLog) Dropped() uint64 {
+	return a.dropped.Load()
+}
+
+// Close writes the queued records and closes the underlying writer if it is
+// an io.Closer. It returns the first error encountered while writing.
+// Records logged after Close are dropped.
+func (a *AuditLog) Close() error {
+	a.closeOnce.Do(func() {
+		a.mu.Lock()
+		a.closed = true
+		close(a.records)
+		a.mu.Unlock()
+
+		<-a.done
+		if c, ok := a.w.(io.Closer); ok {
+			if err := c.Close(); err != nil && a.err == nil {
+				a.err = err
+			}
+		}
+	})
+	return a.err
+}
+
+func (a *AuditLog) log(record AuditRecord) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		a.dropped.Add(1)
+		return
+	}
+	select {
+	case a.records <- record:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// newRecord returns the fields of the records of the tunnel for r.
+func (a *AuditLog) newRecord(w http.ResponseWriter, r *http.Request, tunnelID string) AuditRecord {
+	record := AuditRecord{
+		TunnelID: tunnelID,
+		SourceIP: r.RemoteAddr,
+		Path:     r.URL.Path,
+		Protocol: r.Header.Get("Upgrade"),
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		record.SourceIP = host
+	}
+	if w != nil {
+		if protocol := w.Header().Get("Upgrade"); protocol != "" {
+			record.Protocol = protocol
+		}
+	}
+	if a.Principal != nil {
+		record.Principal = a.Principal(r)
+	} else {
+		record.Principal = defaultPrincipal(r)
+	}
+	if a.Target != nil {
+		record.Target = a.Target(r)
+	}
+	return record
+}
+
+func defaultPrincipal(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	return ""
+}
+
+// tunnelAudit records the open and close of a single tunnel.
+type tunnelAudit struct {
+	log    *AuditLog
+	record AuditRecord
+}
+
+func (ta *tunnelAudit) open() {
+	if ta == nil {
+		return
+	}
+	record := ta.record
+	record.Time = time.Now()
+	record.Event = "open"
+	ta.log.log(record)
+}
+
+func (ta *tunnelAudit) close(reason CloseReason, stats ConnStats) {
+	if ta == nil {
+		return
+	}
+	record := ta.record
+	record.Time = time.Now()
+	record.Event = "close"
+	record.Duration = stats.Duration.Seconds()
+	record.BytesReceived = stats.BytesReceived
+	record.BytesSent = stats.BytesSent
+	record.CloseReason = reason.String()
+	ta.log.log(record)
+}
+
+// A RotatingFile is an io.WriteCloser appending to a file that is rotated
+// once it grows past a maximum size. Rotated files are renamed with the
+// suffixes .1, .2, ... up to the maximum number of backups, .1 being the
+// most recent.
+type RotatingFile struct {
+	// Logger, if not nil, receives the rotation failures. The file is then
+	// appended to until the rotation succeeds.
+	Logger *slog.Logger
+
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens path for appending, creating it if needed. The file
+// is rotated when a write would grow it past maxSize bytes, keeping at most
+// maxBackups rotated files.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("httptunnel: rotating file size must be positive")
+	}
+	rf := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			// Keep appending rather than losing the writes, and try again
+			// once another maxSize bytes have been written
+			rf.logger().Warn("file rotation failed", "path", rf.path, "error", err)
+			if rf.f == nil {
+				if err := rf.open(); err != nil {
+					return 0, err
+				}
+			}
+			rf.size = 0
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) logger() *slog.Logger {
+	if rf.Logger == nil {
+		return discardLogger
+	}
+	return rf.Logger
+}
+
+func (rf *RotatingFile) rotate() error {
+	err := rf.f.Close()
+	rf.f = nil
+	if err != nil {
+		return err
+	}
+	if rf.maxBackups > 0 {
+		for i := rf.maxBackups - 1; i > 0; i-- {
+			err := os.Rename(backupName(rf.path, i), backupName(rf.path, i+1))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		if err := os.Rename(rf.path, backupName(rf.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func backupName(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// Close closes the file.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return os.ErrClosed
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
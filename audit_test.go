@@ -0,0 +1,181 @@
+package httptunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	var out syncBuffer
+	audit := NewAuditLog(&out)
+	audit.Target = func(r *http.Request) string { return "ssh.internal:22" }
+	s := newServerHijacker(t, &Hijacker{Audit: audit})
+
+	options := &ConnectionOptions{
+		PrepareRequest: func(r *http.Request) error {
+			r.SetBasicAuth("alice", "password")
+			return testDialOptions.PrepareRequest(r)
+		},
+	}
+	conn, _, resp, err := testDialer.Dial(s.URL, options)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	sendRecv(conn, resp, t)
+	conn.Close()
+	s.Close()
+	if err := audit.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got: %v", lines)
+	}
+	var open, closed AuditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &open); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &closed); err != nil {
+		t.Fatal(err)
+	}
+	if open.Event != "open" || closed.Event != "close" {
+		t.Errorf("expected open then close, got: %v, %v", open.Event, closed.Event)
+	}
+	if open.TunnelID == "" || open.TunnelID != closed.TunnelID {
+		t.Errorf("expected matching tunnel IDs, got: %q, %q", open.TunnelID, closed.TunnelID)
+	}
+	expected := AuditRecord{
+		Principal: "alice",
+		SourceIP:  "127.0.0.1",
+		Path:      testPath,
+		Protocol:  testProtocol,
+		Target:    "ssh.internal:22",
+	}
+	for _, record := range []AuditRecord{open, closed} {
+		if record.Principal != expected.Principal ||
+			record.SourceIP != expected.SourceIP ||
+			record.Path != expected.Path ||
+			record.Protocol != expected.Protocol ||
+			record.Target != expected.Target {
+			t.Errorf("expected %+v, got: %+v", expected, record)
+		}
+	}
+	if closed.BytesReceived != 4 || closed.BytesSent != 4 {
+		t.Errorf("expected 4 bytes each way, got: %v received, %v sent", closed.BytesReceived, closed.BytesSent)
+	}
+	if closed.CloseReason != "local" {
+		t.Errorf("expected close reason local, got: %v", closed.CloseReason)
+	}
+}
+
+func TestAuditLogClosed(t *testing.T) {
+	var out syncBuffer
+	audit := NewAuditLog(&out)
+	audit.Close()
+	(&tunnelAudit{log: audit}).open()
+	if dropped := audit.Dropped(); dropped != 1 {
+		t.Errorf("expected 1 dropped record, got: %v", dropped)
+	}
+}
+
+// failingCloser is a writer whose Close fails.
+type failingCloser struct {
+	syncBuffer
+}
+
+func (*failingCloser) Close() error {
+	return errors.New("close failed")
+}
+
+func TestAuditLogConcurrentClose(t *testing.T) {
+	audit := NewAuditLog(&failingCloser{})
+	errs := make(chan error, 4)
+	for range cap(errs) {
+		go func() { errs <- audit.Close() }()
+	}
+	for range cap(errs) {
+		if err := <-errs; err == nil || err.Error() != "close failed" {
+			t.Errorf("expected the close error, got: %v", err)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	rf, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != expected {
+			t.Errorf("%v: expected %q, got: %q", name, expected, b)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 backups, got: %v", err)
+	}
+}
+
+func TestRotatingFileFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// The file cannot be renamed over a directory
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	rf, err := OpenRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	var out syncBuffer
+	rf.Logger = slog.New(slog.NewJSONHandler(&out, nil))
+
+	for _, line := range []string{"first\n", "second\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if b, _ := os.ReadFile(path); string(b) != "first\nsecond\n" {
+		t.Errorf("expected the writes to be appended, got: %q", b)
+	}
+	records := out.records(t)
+	if len(records) != 1 || records[0]["msg"] != "file rotation failed" {
+		t.Errorf("expected the failure to be logged, got: %v", records)
+	}
+
+	// The rotation is tried again once it can succeed
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"third\n", "fourth\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if b, _ := os.ReadFile(path); string(b) != "fourth\n" {
+		t.Errorf("expected the file to be rotated, got: %q", b)
+	}
+}
@@ -0,0 +1,230 @@
+package httptunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A CertReloader provides TLS certificates and root CAs loaded from PEM
+// files, reloaded when the files change so that rotated certificates are
+// used without a restart.
+//
+// New files are validated before they are used: the key must match the
+// certificate, the certificate must be valid now and the CA file must
+// contain at least one certificate. When they are not, the previous material
+// is kept.
+//
+// It is safe to call CertReloader's methods concurrently.
+type CertReloader struct {
+	// Logger, if not nil, receives the reloads and their failures.
+	Logger *slog.Logger
+
+	certFile, keyFile, caFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	roots   *x509.CertPool
+	version map[string]fileVersion
+}
+
+// fileVersion identifies the content of a file.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewCertReloader loads the certificate chain and key in certFile and
+// keyFile and the root CAs in caFile. Either the certificate and key files
+// or the CA file may be empty.
+func NewCertReloader(certFile, keyFile, caFile string) (*CertReloader, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("httptunnel: certificate and key files must be given together")
+	}
+	if certFile == "" && caFile == "" {
+		return nil, errors.New("httptunnel: no certificate or CA file")
+	}
+	r := &CertReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) logger() *slog.Logger {
+	if r.Logger == nil {
+		return discardLogger
+	}
+	return r.Logger
+}
+
+func (r *CertReloader) files() []string {
+	var files []string
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// Reload loads and validates the files, and uses them if they are valid.
+func (r *CertReloader) Reload() error {
+	version := make(map[string]fileVersion)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		version[file] = fileVersion{modTime: info.ModTime(), size: info.Size()}
+	}
+
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return err
+		}
+		if c.Leaf == nil {
+			// Not set with GODEBUG x509keypairleaf=0
+			if c.Leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		if now.Before(c.Leaf.NotBefore) || now.After(c.Leaf.NotAfter) {
+			return fmt.Errorf("httptunnel: certificate of %s is valid from %v to %v", r.certFile, c.Leaf.NotBefore, c.Leaf.NotAfter)
+		}
+		cert = &c
+	}
+
+	var roots *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("httptunnel: no certificate in %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert, r.roots, r.version = cert, roots, version
+	r.mu.Unlock()
+	r.logger().Info("tls material loaded", "files", r.files())
+	return nil
+}
+
+// changed reports whether a file changed since the last reload.
+func (r *CertReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for file, version := range r.version {
+		info, err := os.Stat(file)
+		if err != nil {
+			// Possibly in the middle of a rotation
+			continue
+		}
+		if !info.ModTime().Equal(version.modTime) || info.Size() != version.size {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the files when they change, checking them every interval,
+// and on SIGHUP. It returns when ctx is done. The failed reloads are logged
+// and the previous material is kept.
+func (r *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+		}
+		if err := r.Reload(); err != nil {
+			r.logger().Warn("tls material reload failed, keeping the previous one", "error", err)
+		}
+	}
+}
+
+// Certificate returns the current certificate, or nil if there is no
+// certificate file.
+func (r *CertReloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// GetCertificate returns the current certificate. It can be used as
+// tls.Config.GetCertificate on the server.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := r.Certificate(); cert != nil {
+		return cert, nil
+	}
+	return nil, errors.New("httptunnel: no certificate")
+}
+
+// GetClientCertificate returns the current certificate. It can be used as
+// tls.Config.GetClientCertificate in Dialer.TLSClientConfig.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if cert := r.Certificate(); cert != nil {
+		return cert, nil
+	}
+	// No certificate is sent
+	return &tls.Certificate{}, nil
+}
+
+// RootCAs returns the current root CAs, or nil if there is no CA file. The
+// pool is not updated by the later reloads; see VerifyConnection.
+func (r *CertReloader) RootCAs() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.roots
+}
+
+// VerifyConnection verifies the certificate chain and host name of a server
+// with the current root CAs. Since tls.Config.RootCAs cannot change, it is
+// used with InsecureSkipVerify to verify the servers with reloaded CAs:
+//
+//	dialer.TLSClientConfig = &tls.Config{
+//		GetClientCertificate: reloader.GetClientCertificate,
+//		// The chain is verified by VerifyConnection
+//		InsecureSkipVerify: true,
+//		VerifyConnection:   reloader.VerifyConnection,
+//	}
+func (r *CertReloader) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("httptunnel: no server certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         r.RootCAs(),
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,163 @@
+package httptunnel
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for example.com valid until
+// notAfter and its key to dir, and returns their paths.
+func writeTestCert(t *testing.T, dir string, notAfter time.Time) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "httptunnel test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	return certFile, keyFile
+}
+
+// writeFile replaces the content of path, making sure its modification time
+// changes.
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(path, time.Time{}, modTime.Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, time.Now().Add(time.Hour))
+	r, err := NewCertReloader(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := r.Certificate()
+
+	// Broken and expired material is not used
+	certPEM, _ := os.ReadFile(certFile)
+	writeFile(t, certFile, certPEM[:len(certPEM)/2])
+	if err := r.Reload(); err == nil {
+		t.Error("expected an error for a truncated certificate")
+	}
+	writeTestCert(t, dir, time.Now().Add(-time.Minute))
+	if err := r.Reload(); err == nil {
+		t.Error("expected an error for an expired certificate")
+	}
+	if r.Certificate() != first {
+		t.Fatal("expected the previous certificate to be kept")
+	}
+
+	writeTestCert(t, dir, time.Now().Add(time.Hour))
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cert := r.Certificate(); cert == first || cert.Leaf.NotAfter.Before(time.Now()) {
+		t.Error("expected the new certificate")
+	}
+
+	if _, err := NewCertReloader(certFile, "", ""); err == nil {
+		t.Error("expected an error for a certificate without key")
+	}
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, time.Now().Add(time.Hour))
+
+	// The server and client both use the reloader, the certificate being its
+	// own CA
+	r, err := NewCertReloader(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	var s mockServer
+	s.Server = httptest.NewUnstartedServer(testHandler{T: t, s: &s, hijacker: testHijacker})
+	s.Server.TLS = &tls.Config{GetCertificate: r.GetCertificate}
+	s.Server.StartTLS()
+	s.Server.URL += testRequestURI
+	s.URL = s.Server.URL
+	defer s.Close()
+
+	d := testDialer
+	d.TLSClientConfig = &tls.Config{
+		// httptest only uses GetCertificate with SNI
+		ServerName:           "example.com",
+		GetClientCertificate: r.GetClientCertificate,
+		InsecureSkipVerify:   true,
+		VerifyConnection:     r.VerifyConnection,
+		// Every dial makes a full handshake
+		SessionTicketsDisabled: true,
+	}
+	dial := func() *x509.Certificate {
+		t.Helper()
+		conn, _, resp, err := d.Dial(s.URL, testDialOptions)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer conn.Close()
+		sendRecv(conn, resp, t)
+		state, _ := conn.(*Conn).TLSConnectionState()
+		return state.PeerCertificates[0]
+	}
+	first := dial()
+
+	writeTestCert(t, dir, time.Now().Add(time.Hour))
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Certificate().Leaf.Equal(first) {
+		if time.Now().After(deadline) {
+			t.Fatal("the certificate was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dial().Equal(first) {
+		t.Error("expected the server to use the new certificate")
+	}
+}
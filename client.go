@@ -4,14 +4,17 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdh"
 	"crypto/tls"
 	_ "embed"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httptrace"
 	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -39,12 +42,67 @@ type Dialer struct {
 	// If Proxy is nil or returns a nil *URL, no proxy is used.
 	Proxy func(*http.Request) (*url.URL, error)
 
+	// ProxyChain specifies a function to return the proxies to go through
+	// for a given Request, in order: the first proxy is dialed directly and
+	// each following proxy is reached through the previous ones. If
+	// ProxyChain is set, Proxy and ProxyFailover are ignored. If ProxyChain
+	// returns no proxies, no proxy is used. See ProxyRules.
+	ProxyChain func(*http.Request) ([]*url.URL, error)
+
+	// ProxyFailover specifies a function to return the proxies to try in
+	// order for a given Request, a nil *URL standing for a direct
+	// connection. When the connection through a proxy fails, the next one
+	// is tried. If ProxyFailover is set, Proxy is ignored. See PAC.
+	ProxyFailover func(*http.Request) ([]*url.URL, error)
+
+	// ProxyTLSClientConfig specifies the TLS configuration to use with an
+	// https proxy. If nil, the default configuration is used.
+	ProxyTLSClientConfig *tls.Config
+
+	// ProxyConnectHeader specifies the headers to send to an http or https
+	// proxy in the CONNECT request, for example User-Agent. A
+	// Proxy-Authorization header takes precedence over the credentials of
+	// the proxy URL.
+	ProxyConnectHeader http.Header
+
+	// ProxyCredentials, if not nil, returns the credentials used to answer
+	// the Basic and Digest authentication challenges of http and https
+	// proxies. If nil, the credentials of the proxy URL are used. See
+	// NetrcProxyCredentials.
+	ProxyCredentials ProxyCredentialsFunc
+
 	// TLSClientConfig specifies the TLS configuration to use with tls.Client.
 	// If nil, the default configuration is used.
 	// If either NetDialTLS or NetDialTLSContext are set, Dial assumes the TLS handshake
 	// is done there and TLSClientConfig is ignored.
+	// If its ClientSessionCache is nil, the sessions are cached in a cache
+	// shared by the dials with the same TLSClientConfig, so that they can be
+	// resumed. The same applies to ProxyTLSClientConfig. See also
+	// ClientSessionCacheFromContext.
 	TLSClientConfig *tls.Config
 
+	// KeyLogWriter, if not nil, receives the TLS secrets of the connections
+	// to the servers and https proxies in the NSS key log format, to decrypt
+	// the captured traffic with Wireshark. It takes precedence over the
+	// KeyLogWriter of TLSClientConfig and ProxyTLSClientConfig. A warning is
+	// logged for each handshake, to Logger or slog.Default() if nil. It must
+	// only be used to debug; see KeyLogFromEnvironment.
+	KeyLogWriter io.Writer
+
+	// Pins, if not nil, pins the certificates of the servers and https
+	// proxies by host name. See PinSet.
+	Pins PinSet
+
+	// Noise, if not nil, encrypts the tunnels end to end with the Hijacker
+	// of the server, independently of TLS. The dial fails if the server
+	// does not accept the encryption. See NoiseConfig.
+	Noise *NoiseConfig
+
+	// Compression, if not nil, requests the compression of the tunnels. If
+	// the server does not accept it, the tunnels are not compressed. Each
+	// write is flushed; see CompressionConfig for why and how to batch them.
+	Compression *CompressionConfig
+
 	// HandshakeTimeout specifies the duration for the handshake to complete.
 	HandshakeTimeout time.Duration
 
@@ -57,6 +115,44 @@ type Dialer struct {
 	// If Jar is nil, cookies are not sent in requests and ignored
 	// in responses.
 	Jar http.CookieJar
+
+	// Metrics, if not nil, records handshakes and traffic of the tunnels
+	// created by this Dialer.
+	Metrics *Metrics
+
+	// Observer, if not nil, is notified of the lifecycle events of the
+	// tunnels created by this Dialer.
+	Observer Observer
+
+	// Logger, if not nil, receives structured records about the handshake
+	// and close of the tunnels created by this Dialer. Credentials are
+	// redacted.
+	Logger *slog.Logger
+
+	// Resume, if not nil, requests resumable tunnels. If the server assigns
+	// a session, a broken tunnel is transparently redialed and resumed. See
+	// ResumeConfig.
+	Resume *ResumeConfig
+
+	// Retry, if not nil, retries failed handshakes. See RetryPolicy.
+	Retry *RetryPolicy
+
+	// Redirect, if not nil, follows the redirects returned by the server.
+	// If Redirect is nil, a redirect response is returned as is. See
+	// RedirectPolicy.
+	Redirect *RedirectPolicy
+
+	// Endpoints, if not nil, is the set of servers to dial. The URL given to
+	// Dial is resolved against the URL of the endpoint chosen, so it may be
+	// empty or contain only a path. See EndpointPool.
+	Endpoints *EndpointPool
+
+	// SpanExporter, if not nil, receives a span for each dial. The span is
+	// a child of the span context carried by the dial's context, if any, and
+	// is propagated to the server in the traceparent and tracestate headers.
+	// If SpanExporter is nil, the span context of the dial's context is
+	// propagated as is.
+	SpanExporter SpanExporter
 }
 
 var DefaultDialer = &Dialer{
@@ -75,8 +171,10 @@ func (d *Dialer) Dial(
 }
 
 type ConnectionOptions struct {
-	OverrideGetUrl    func(string) (*url.URL, error)
-	PrepareRequest    func(r *http.Request) error
+	OverrideGetUrl func(string) (*url.URL, error)
+	PrepareRequest func(r *http.Request) error
+	// OverrideNewReader creates the reader for the handshake response and
+	// the reader returned for the tunnel connection.
 	OverrideNewReader func(net.Conn) (*bufio.Reader, error)
 }
 
@@ -101,6 +199,10 @@ func (opts ConnectionOptions) NewReader(conn net.Conn) (*bufio.Reader, error) {
 // sent.
 //
 // The context will be used in the request and in the Dialer.
+//
+// The returned net.Conn is a *Conn. If the server responds without
+// upgrading the connection, the response is returned with a nil error, and
+// the handshake is reported as rejected to the Metrics and Observer.
 func (d *Dialer) DialContext(
 	ctx context.Context,
 	urlStr string,
@@ -110,10 +212,141 @@ func (d *Dialer) DialContext(
 		d = &nilDialer
 	}
 
+	parent, _ := SpanContextFromContext(ctx)
+	inst := d.instruments().withSpan(startSpan("httptunnel.dial", SideClient, parent, d.SpanExporter))
+	inst.span.setAttribute("url", redactURL(urlStr))
+	info := HandshakeInfo{Side: SideClient, ID: inst.id, URL: redactURL(urlStr), Start: time.Now()}
+	inst.handshakeStart(info)
 	if options == nil {
 		options = &ConnectionOptions{}
 	}
+	netConn, br, resp, dialed, err := d.dialWithRetry(ctx, urlStr, options, inst)
+	if err != nil {
+		inst.handshakeDone(info, nil, outcomeError, err)
+		return nil, br, resp, err
+	}
+
+	var stream net.Conn = &bufferedConn{Conn: netConn, r: br}
+	if d.Resume != nil {
+		params, ok := parseResumeHeader(resp.Header.Get(resumeHeader))
+		if ok && params.token != "" {
+			session := newResumableConn(params.token, d.Resume, d.resumeFunc(dialed, options, inst, params.token))
+			session.peerWindow = params.window
+			session.start(stream)
+			stream = session
+		}
+	}
+	var noisePeer *ecdh.PublicKey
+	if d.Noise != nil && resp.StatusCode == http.StatusSwitchingProtocols {
+		err := ErrEncryptionRequired
+		var encrypted *noiseConn
+		if resp.Header.Get(encryptionHeader) == noiseProtocol {
+			noiseCtx, cancel := ctx, context.CancelFunc(func() {})
+			if d.HandshakeTimeout != 0 {
+				noiseCtx, cancel = context.WithTimeout(ctx, d.HandshakeTimeout)
+			}
+			encrypted, err = d.Noise.initiate(noiseCtx, stream)
+			cancel()
+		}
+		if err != nil {
+			_ = stream.Close()
+			inst.logger.Warn("noise handshake failed", "error", err)
+			inst.handshakeDone(info, nil, outcomeError, err)
+			return nil, nil, resp, err
+		}
+		stream, noisePeer = encrypted, encrypted.peer
+	}
+	if d.Compression != nil && resp.StatusCode == http.StatusSwitchingProtocols &&
+		acceptsDeflate(resp.Header.Get(compressionHeader)) {
+		compressed, err := newCompressedConn(stream, d.Compression)
+		if err != nil {
+			_ = stream.Close()
+			inst.handshakeDone(info, nil, outcomeError, err)
+			return nil, nil, resp, err
+		}
+		stream = compressed
+	}
+	conn := newConn(stream, inst)
+	conn.endpoint = dialed
+	conn.noisePeer = noisePeer
+	if tlsConn, ok := netConn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		state := tlsConn.ConnectionState()
+		conn.tlsState = &state
+	}
+	if br, err = options.NewReader(conn); err != nil {
+		_ = conn.Close()
+		inst.handshakeDone(info, nil, outcomeError, err)
+		return nil, nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// The response is returned for the caller to handle, but no tunnel
+		// was opened
+		inst.handshakeDone(info, nil, outcomeRejected, &unexpectedStatusError{resp.StatusCode, resp.Status})
+		return conn, br, resp, nil
+	}
+	inst.handshakeDone(info, conn, outcomeSuccess, nil)
+	return conn, br, resp, nil
+}
+
+// resumeFunc returns the function used by a resumable tunnel to redial the
+// server.
+func (d *Dialer) resumeFunc(
+	urlStr string,
+	options *ConnectionOptions,
+	inst instruments,
+	token string,
+) func(context.Context, uint64) (net.Conn, uint64, error) {
+	return func(ctx context.Context, received uint64) (net.Conn, uint64, error) {
+		opts := *options
+		opts.PrepareRequest = func(r *http.Request) error {
+			if options.PrepareRequest != nil {
+				if err := options.PrepareRequest(r); err != nil {
+					return err
+				}
+			}
+			r.Header.Set(resumeHeader, resumeParams{
+				token:       token,
+				received:    received,
+				hasReceived: true,
+			}.String())
+			return nil
+		}
+		// Each attempt has its own span, the span of the original handshake
+		// having ended
+		inst := inst
+		inst.span = startSpan("httptunnel.resume", SideClient, inst.span.spanContext(), d.SpanExporter)
+		netConn, br, resp, err := d.dial(ctx, urlStr, &opts, inst)
+		if err != nil {
+			inst.logger.Warn("tunnel resume failed", "error", err)
+			inst.span.end(err)
+			return nil, 0, err
+		}
+		params, ok := parseResumeHeader(resp.Header.Get(resumeHeader))
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			err = ErrSessionNotFound
+		case resp.StatusCode != http.StatusSwitchingProtocols || !ok || params.token != token || !params.hasReceived:
+			err = fmt.Errorf("httptunnel: unexpected response resuming tunnel: %s", resp.Status)
+		}
+		if err != nil {
+			_ = netConn.Close()
+			inst.logger.Warn("tunnel resume failed", "error", err)
+			inst.span.end(err)
+			return nil, 0, err
+		}
+		inst.logger.Info("tunnel resumed")
+		inst.span.end(nil)
+		return &bufferedConn{Conn: netConn, r: br}, params.received, nil
+	}
+}
 
+// dial makes a single attempt at establishing a tunnel.
+func (d *Dialer) dial(
+	ctx context.Context,
+	urlStr string,
+	options *ConnectionOptions,
+	inst instruments,
+) (net.Conn, *bufio.Reader, *http.Response, error) {
 	u, err := options.GetUrl(urlStr)
 	if err != nil {
 		return nil, nil, nil, err
@@ -130,6 +363,19 @@ func (d *Dialer) DialContext(
 	}
 	req = req.WithContext(ctx)
 
+	if sc := inst.span.spanContext(); sc.IsValid() {
+		injectSpanContext(req.Header, sc)
+	}
+	if d.Resume != nil {
+		req.Header.Set(resumeHeader, resumeParams{window: d.Resume.bufferSize()}.String())
+	}
+	if d.Noise != nil {
+		req.Header.Set(encryptionHeader, noiseProtocol)
+	}
+	if d.Compression != nil {
+		req.Header.Set(compressionHeader, compressionDeflate)
+	}
+
 	// Set the cookies present in the cookie jar of the dialer
 	if d.Jar != nil {
 		for _, cookie := range d.Jar.Cookies(u) {
@@ -149,9 +395,9 @@ func (d *Dialer) DialContext(
 		defer cancel()
 	}
 
-	netDial := dialerFuncForURL(u, d)
+	netDial := markConnectErrors(dialerFuncForURL(u, d))
 	netDial = maybeWrapDeadline(netDial, ctx)
-	netDial, err = maybeWrapProxy(netDial, d, req)
+	routes, err := maybeWrapProxy(netDial, d, req, inst.logger)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -162,9 +408,28 @@ func (d *Dialer) DialContext(
 		trace.GetConn(hostPort)
 	}
 
-	netConn, err := netDial(ctx, "tcp", hostPort)
-	if err != nil {
-		return nil, nil, nil, err
+	if u.Scheme == "https" && d.NetDialTLSContext != nil {
+		ctx = context.WithValue(ctx, sessionCacheKey{}, sessionCache(d.TLSClientConfig, "server"))
+	}
+
+	var (
+		netConn  net.Conn
+		proxyURL *url.URL
+	)
+	for i, route := range routes {
+		proxyURL = route.proxyURL
+		netConn, err = route.netDial(ctx, "tcp", hostPort)
+		if err == nil {
+			break
+		}
+		if i == len(routes)-1 || ctx.Err() != nil {
+			return nil, nil, nil, newNetDialError(hostPort, proxyURL, err)
+		}
+		proxy := "DIRECT"
+		if proxyURL != nil {
+			proxy = proxyURL.Redacted()
+		}
+		inst.logger.Warn("proxy failed, trying the next one", "proxy", proxy, "error", err)
 	}
 	if trace != nil && trace.GotConn != nil {
 		trace.GotConn(httptrace.GotConnInfo{
@@ -191,19 +456,43 @@ func (d *Dialer) DialContext(
 		if cfg.ServerName == "" {
 			cfg.ServerName = hostNoPort
 		}
+		cfg.ClientSessionCache = sessionCache(d.TLSClientConfig, "server")
+		setKeyLog(cfg, d.KeyLogWriter, inst.logger)
+		d.Pins.configure(cfg)
 		tlsConn := tls.Client(netConn, cfg)
 		netConn = tlsConn
 
 		if trace != nil && trace.TLSHandshakeStart != nil {
 			trace.TLSHandshakeStart()
 		}
-		err := doHandshake(ctx, tlsConn, cfg)
+		err := doHandshake(ctx, tlsConn, cfg, d.Pins, inst.logger)
 		if trace != nil && trace.TLSHandshakeDone != nil {
 			trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
 		}
 
 		if err != nil {
-			return nil, nil, nil, err
+			inst.logger.Warn("tls handshake failed", "server_name", cfg.ServerName, "error", err)
+			return nil, nil, nil, &DialError{Phase: PhaseTLS, Addr: hostPort, Proxy: proxyURL, Err: err}
+		}
+		state := tlsConn.ConnectionState()
+		inst.logger.Debug("tls handshake done",
+			"server_name", cfg.ServerName,
+			"version", tls.VersionName(state.Version),
+			"cipher_suite", tls.CipherSuiteName(state.CipherSuite),
+			"resumed", state.DidResume,
+		)
+	} else if tlsConn, ok := netConn.(*tls.Conn); ok && u.Scheme == "https" {
+		// As net/http does, complete the handshake in case NetDialTLSContext
+		// did not, and report it.
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		err := tlsConn.HandshakeContext(ctx)
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+		}
+		if err != nil {
+			return nil, nil, nil, &DialError{Phase: PhaseTLS, Addr: hostPort, Proxy: proxyURL, Err: err}
 		}
 	}
 
@@ -214,7 +503,7 @@ func (d *Dialer) DialContext(
 	}
 
 	if err := req.Write(netConn); err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, &DialError{Phase: PhaseWriteRequest, Addr: hostPort, Proxy: proxyURL, Err: err}
 	}
 
 	if trace != nil && trace.GotFirstResponseByte != nil {
@@ -228,16 +517,19 @@ func (d *Dialer) DialContext(
 		if d.TLSClientConfig != nil {
 			for _, proto := range d.TLSClientConfig.NextProtos {
 				if proto != "http/1.1" {
-					return nil, nil, nil, fmt.Errorf(
+					err = fmt.Errorf(
 						"httptunnel: protocol %q was given but is not supported;"+
 							"sharing tls.Config with net/http Transport can cause this error: %w",
 						proto, err,
 					)
+					break
 				}
 			}
 		}
-		return nil, nil, nil, err
+		return nil, nil, nil, &DialError{Phase: PhaseReadResponse, Addr: hostPort, Proxy: proxyURL, Err: err}
 	}
+	inst.logger.Info("upgrade response", "status", resp.Status)
+	inst.span.setAttribute("http.status_code", strconv.Itoa(resp.StatusCode))
 
 	if d.Jar != nil {
 		if rc := resp.Cookies(); len(rc) > 0 {
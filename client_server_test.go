@@ -274,6 +274,49 @@ func TestProxyAuthorizationDial(t *testing.T) {
 	sendRecv(conn, resp, t)
 }
 
+func TestHTTPSProxyDial(t *testing.T) {
+	s := newTLSServer(t)
+	defer s.Close()
+
+	surl, _ := url.Parse(s.Server.URL)
+
+	testDialer := testDialer
+	testDialer.Proxy = http.ProxyURL(&url.URL{Scheme: "https", Host: surl.Host})
+	testDialer.ProxyTLSClientConfig = &tls.Config{RootCAs: rootCAs(t, s.Server)}
+	testDialer.ProxyConnectHeader = http.Header{"User-Agent": {"httptunnel-test"}}
+
+	connect := false
+	origHandler := s.Server.Config.Handler
+
+	s.Server.Config.Handler = http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodConnect {
+				if r.TLS == nil || r.UserAgent() != "httptunnel-test" {
+					http.Error(w, "expected a TLS connection and the connect header", http.StatusForbidden)
+					return
+				}
+				connect = true
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			if !connect {
+				t.Log("connect not received")
+				http.Error(w, "connect not received", http.StatusMethodNotAllowed)
+				return
+			}
+			origHandler.ServeHTTP(w, r)
+		})
+
+	// The tunneled request is served by the proxy itself
+	conn, _, resp, err := testDialer.Dial("http://tunnel.example"+testRequestURI, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	sendRecv(conn, resp, t)
+}
+
 func rootCAs(t *testing.T, s *httptest.Server) *x509.CertPool {
 	certs := x509.NewCertPool()
 	for _, c := range s.TLS.Certificates {
@@ -0,0 +1,163 @@
+package httptunnel
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	compressionHeader  = "Tunnel-Compression"
+	compressionDeflate = "deflate"
+)
+
+// CompressionConfig configures the deflate compression of the tunnel
+// payload, which benefits text-heavy protocols over slow links.
+//
+// The compression is requested by the Dialer with the Tunnel-Compression
+// header and accepted by a Hijacker with a CompressionConfig in its 101
+// response. If either end does not support it, the tunnel is not
+// compressed.
+//
+// Each write to the tunnel is flushed, which is not configurable: the
+// tunnels carry interactive protocols, whose requests and responses would
+// stall if the compressor held them back, and flushing on a timer instead
+// would leave Close to either block on the network or drop the data written
+// last. A flush costs a few bytes, so to compress larger blocks, buffer the
+// writes to the tunnel, for example with a bufio.Writer, and flush it when
+// the peer expects the data.
+type CompressionConfig struct {
+	// Level is the compression level of the data sent, from
+	// flate.BestSpeed to flate.BestCompression, or flate.HuffmanOnly. Zero
+	// means flate.DefaultCompression.
+	Level int
+}
+
+func (cfg *CompressionConfig) level() int {
+	if cfg.Level == 0 {
+		return flate.DefaultCompression
+	}
+	return cfg.Level
+}
+
+// acceptsDeflate reports whether the Tunnel-Compression header value v
+// lists deflate.
+func acceptsDeflate(v string) bool {
+	for _, method := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(method), compressionDeflate) {
+			return true
+		}
+	}
+	return false
+}
+
+// newCompressedConn compresses the data written to conn and decompresses
+// the data read from it.
+func newCompressedConn(conn net.Conn, cfg *CompressionConfig) (*compressedConn, error) {
+	w, err := flate.NewWriter(conn, cfg.level())
+	if err != nil {
+		return nil, err
+	}
+	c := &compressedConn{Conn: conn, w: w}
+	c.r, c.decompressed = net.Pipe()
+	go c.decompress()
+	return c, nil
+}
+
+// compressedConn is the net.Conn of a compressed tunnel. A goroutine
+// decompresses the data read from the connection into a synchronous pipe,
+// and the read deadlines apply to the pipe, so that a timeout never
+// interrupts the decompressor.
+type compressedConn struct {
+	net.Conn
+
+	r            net.Conn
+	decompressed net.Conn
+	readErr      error // set before decompressed is closed
+
+	writeMu sync.Mutex
+	w       *flate.Writer
+}
+
+// compressedSource records whether the connection read by the decompressor
+// reached its end.
+type compressedSource struct {
+	r   io.Reader
+	eof bool
+}
+
+func (s *compressedSource) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err == io.EOF {
+		s.eof = true
+	}
+	return n, err
+}
+
+// decompress copies the decompressed data to the pipe until the connection
+// fails or the pipe is closed.
+func (c *compressedConn) decompress() {
+	src := &compressedSource{r: c.Conn}
+	_, err := io.Copy(c.decompressed, flate.NewReader(src))
+	// Every write is flushed, so the end of the connection is the end of the
+	// stream
+	if err == nil || errors.Is(err, io.ErrUnexpectedEOF) && src.eof {
+		err = io.EOF
+	}
+	c.readErr = err
+	_ = c.decompressed.Close()
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	switch {
+	case err == io.EOF:
+		err = c.readErr
+	case errors.Is(err, io.ErrClosedPipe):
+		err = net.ErrClosed
+	}
+	return n, err
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.w.Write(p); err != nil {
+		return 0, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CloseWrite ends the compressed stream, which the peer reads as io.EOF,
+// and shuts down the writing side of the connection.
+func (c *compressedConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.w.Close(); err != nil {
+		return err
+	}
+	return closeWrite(c.Conn)
+}
+
+func (c *compressedConn) Close() error {
+	_ = c.r.Close()
+	return c.Conn.Close()
+}
+
+func (c *compressedConn) SetDeadline(t time.Time) error {
+	if err := c.r.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *compressedConn) SetReadDeadline(t time.Time) error {
+	return c.r.SetReadDeadline(t)
+}
@@ -0,0 +1,124 @@
+package httptunnel
+
+import (
+	"compress/flate"
+	"context"
+	"crypto/ecdh"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompression(t *testing.T) {
+	s := newNoiseServer(t, Hijacker{Compression: &CompressionConfig{}}, nil)
+	defer s.Close()
+
+	var recorded *recordingConn
+	d := testDialer
+	d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		recorded = &recordingConn{Conn: conn}
+		return recorded, nil
+	}
+	d.Compression = &CompressionConfig{Level: flate.BestCompression}
+	conn, _, resp, err := d.Dial(s.URL, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if v := resp.Header.Get(compressionHeader); v != compressionDeflate {
+		t.Fatalf("expected the compression to be accepted, got: %q", v)
+	}
+	if netConn := conn.(*Conn).NetConn(); netConn != recorded {
+		t.Errorf("expected NetConn to return the dialed connection, got: %T", netConn)
+	}
+
+	recorded.mu.Lock()
+	before := recorded.written.Len()
+	recorded.mu.Unlock()
+	msg := strings.Repeat("SELECT * FROM logs WHERE level = 'info';\n", 1000)
+	echo(t, conn, msg)
+	echo(t, conn, "a small write is flushed")
+
+	// A read timeout leaves the tunnel usable
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a timeout, got: %v", err)
+	}
+	echo(t, conn, "read after a timeout")
+
+	recorded.mu.Lock()
+	defer recorded.mu.Unlock()
+	if sent := recorded.written.Len() - before; sent >= len(msg)/10 {
+		t.Errorf("expected the payload to be compressed, sent %v bytes for %v", sent, len(msg))
+	}
+}
+
+func TestCompressionFallback(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		client, server *CompressionConfig
+	}{
+		{name: "not supported by the server", client: &CompressionConfig{}},
+		{name: "not requested by the client", server: &CompressionConfig{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newNoiseServer(t, Hijacker{Compression: tc.server}, nil)
+			defer s.Close()
+
+			d := testDialer
+			d.Compression = tc.client
+			conn, _, resp, err := d.Dial(s.URL, nil)
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer conn.Close()
+			if v := resp.Header.Get(compressionHeader); v != "" {
+				t.Errorf("expected no compression, got: %q", v)
+			}
+			echo(t, conn, "raw")
+		})
+	}
+}
+
+func TestCompressionNoise(t *testing.T) {
+	serverKey, clientKey := newNoiseKey(t), newNoiseKey(t)
+	s := newNoiseServer(t, Hijacker{
+		Noise:       &NoiseConfig{StaticKey: serverKey, ClientKeys: []*ecdh.PublicKey{clientKey.PublicKey()}},
+		Compression: &CompressionConfig{Level: flate.BestSpeed},
+	}, nil)
+	defer s.Close()
+
+	d := testDialer
+	d.Noise = &NoiseConfig{StaticKey: clientKey, ServerKey: serverKey.PublicKey()}
+	d.Compression = &CompressionConfig{}
+	conn, _, resp, err := d.Dial(s.URL, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status 101, got: %v", resp.Status)
+	}
+	echo(t, conn, strings.Repeat("compressed then encrypted ", 5000))
+}
+
+func TestAcceptsDeflate(t *testing.T) {
+	for v, expected := range map[string]bool{
+		"":              false,
+		"deflate":       true,
+		"gzip, Deflate": true,
+		"deflater":      false,
+	} {
+		if actual := acceptsDeflate(v); actual != expected {
+			t.Errorf("%q: expected %v, got: %v", v, expected, actual)
+		}
+	}
+}
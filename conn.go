@@ -0,0 +1,290 @@
+package httptunnel
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Side identifies which end of a tunnel a connection belongs to.
+type Side int
+
+const (
+	// SideClient is a connection returned by a Dialer.
+	SideClient Side = iota
+	// SideServer is a connection returned by a Hijacker.
+	SideServer
+)
+
+func (s Side) String() string {
+	switch s {
+	case SideClient:
+		return "client"
+	case SideServer:
+		return "server"
+	default:
+		return "unknown"
+	}
+}
+
+// Conn is the tunnel connection returned by Dialer and Hijacker. It wraps the
+// underlying network connection to keep track of the tunnel's lifetime and
+// the bytes sent over it.
+//
+// Use NetConn to access the underlying connection, for example a *tls.Conn.
+type Conn struct {
+	net.Conn
+	inst     instruments
+	endpoint string
+	tlsState *tls.ConnectionState
+	// noisePeer is the static key of the peer of the Noise handshake.
+	noisePeer *ecdh.PublicKey
+
+	start      time.Time
+	opened     atomic.Bool
+	lastSample atomic.Int64 // unix nanoseconds
+	closeOnce  sync.Once
+
+	bytesReceived, bytesSent atomic.Int64
+
+	mu  sync.Mutex
+	err error // first error that ended the tunnel
+
+	// The message being read by ReadMessage, kept across the reads
+	// interrupted by a deadline.
+	msgMu     sync.Mutex
+	msgPrefix [messagePrefixLen]byte
+	msg       []byte
+	msgRead   int // bytes of the prefix and message read so far
+}
+
+func newConn(netConn net.Conn, inst instruments) *Conn {
+	return &Conn{Conn: netConn, inst: inst}
+}
+
+// open marks the end of the handshake. Tunnels are only reported as active,
+// and their close only recorded, once they have been opened.
+func (c *Conn) open() {
+	c.start = time.Now()
+	c.lastSample.Store(c.start.UnixNano())
+	c.opened.Store(true)
+	c.inst.metrics.tunnelOpened(c.inst.side)
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.bytesReceived.Add(int64(n))
+		c.inst.metrics.bytesReceived(c.inst.side, n)
+		c.sample()
+	}
+	if err != nil {
+		c.recordError(err)
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.bytesSent.Add(int64(n))
+		c.inst.metrics.bytesSent(c.inst.side, n)
+		c.sample()
+	}
+	if err != nil {
+		c.recordError(err)
+	}
+	return n, err
+}
+
+// sample reports the traffic totals to the observer if enough time has passed
+// since the last report.
+func (c *Conn) sample() {
+	if c.inst.observer == nil || !c.opened.Load() {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := c.lastSample.Load()
+	if now-last < int64(observerSampleInterval) || !c.lastSample.CompareAndSwap(last, now) {
+		return
+	}
+	c.inst.observer.OnBytes(c, c.Stats())
+}
+
+func (c *Conn) recordError(err error) {
+	var netErr net.Error
+	if errors.Is(err, net.ErrClosed) || errors.As(err, &netErr) && netErr.Timeout() {
+		return
+	}
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	if err == io.EOF || !c.opened.Load() {
+		return
+	}
+	c.inst.logger.Debug("tunnel error", "error", err)
+	if c.inst.observer != nil {
+		c.inst.observer.OnError(c, err)
+	}
+}
+
+// Close closes the underlying connection. Only the first call is recorded.
+func (c *Conn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		if !c.opened.Load() {
+			return
+		}
+		stats, reason := c.Stats(), c.closeReason()
+		c.inst.metrics.tunnelClosed(c.inst.side, stats.Duration)
+		c.inst.logger.Info("tunnel closed",
+			"reason", reason.String(),
+			"duration", stats.Duration,
+			"bytes_received", stats.BytesReceived,
+			"bytes_sent", stats.BytesSent,
+		)
+		c.inst.audit.close(reason, stats)
+		if c.inst.observer != nil {
+			c.inst.observer.OnClose(c, reason, stats)
+		}
+	})
+	return err
+}
+
+func (c *Conn) closeReason() CloseReason {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.err == nil:
+		return CloseLocal
+	case c.err == io.EOF:
+		return ClosePeer
+	default:
+		return CloseError
+	}
+}
+
+// Stats returns the traffic statistics of the tunnel so far.
+func (c *Conn) Stats() ConnStats {
+	stats := ConnStats{
+		BytesReceived: c.bytesReceived.Load(),
+		BytesSent:     c.bytesSent.Load(),
+	}
+	if c.opened.Load() {
+		stats.Opened = c.start
+		stats.Duration = time.Since(c.start)
+	}
+	return stats
+}
+
+// CloseWrite shuts down the writing side of the tunnel, so that the peer reads
+// io.EOF once it has received everything, while c can still be read. It
+// returns an error wrapping errors.ErrUnsupported if the underlying
+// connection cannot be half-closed, as with the resumable tunnels.
+func (c *Conn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// NetConn returns the network connection carrying the tunnel, for example a
+// *tls.Conn, beneath its compression, encryption and resumption layers. The
+// connection of a resumable tunnel is replaced whenever it resumes, and
+// NetConn returns the latest one.
+func (c *Conn) NetConn() net.Conn {
+	conn := c.Conn
+	for {
+		switch layer := conn.(type) {
+		case *compressedConn:
+			conn = layer.Conn
+		case *noiseConn:
+			conn = layer.Conn
+		case *resumableConn:
+			conn = layer.netConn()
+		case *bufferedConn:
+			conn = layer.Conn
+		default:
+			return conn
+		}
+	}
+}
+
+// ID returns the random identifier of the tunnel. It matches the tunnel_id
+// attribute of log records and HandshakeInfo.ID.
+func (c *Conn) ID() string {
+	return c.inst.id
+}
+
+// SpanContext returns the trace context of the tunnel handshake. On the
+// server side it is a child of the span context propagated by the client.
+// It is the zero SpanContext if the handshake was not traced.
+func (c *Conn) SpanContext() SpanContext {
+	return c.inst.span.spanContext()
+}
+
+// Endpoint returns the URL the tunnel was dialed to. For a Dialer with an
+// EndpointPool, it identifies the endpoint chosen. It is empty on the server
+// side.
+func (c *Conn) Endpoint() string {
+	return c.endpoint
+}
+
+// TLSConnectionState returns the state of the TLS connection the tunnel was
+// opened on, for example to check whether the TLS session was resumed, and
+// whether there is one. Through a proxy, it is the connection to the server.
+func (c *Conn) TLSConnectionState() (tls.ConnectionState, bool) {
+	if c.tlsState == nil {
+		return tls.ConnectionState{}, false
+	}
+	return *c.tlsState, true
+}
+
+// NoisePeerKey returns the static public key the peer proved to hold in the
+// Noise handshake, or nil if the tunnel is not encrypted with Noise. On the
+// server side, it identifies the client.
+func (c *Conn) NoisePeerKey() *ecdh.PublicKey {
+	return c.noisePeer
+}
+
+// Side reports which end of the tunnel c belongs to.
+func (c *Conn) Side() Side {
+	return c.inst.side
+}
+
+// bufferedConn is a net.Conn that returns the bytes buffered in r before
+// reading from the connection itself.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if c.r != nil {
+		if c.r.Buffered() > 0 {
+			return c.r.Read(p)
+		}
+		c.r = nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// closeWrite shuts down the writing side of conn, or returns an error
+// wrapping errors.ErrUnsupported if conn cannot be half-closed.
+func closeWrite(conn net.Conn) error {
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		return fmt.Errorf("httptunnel: %T cannot be half-closed: %w", conn, errors.ErrUnsupported)
+	}
+	return cw.CloseWrite()
+}
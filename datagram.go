@@ -0,0 +1,436 @@
+package httptunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// MaxMessageSize is the maximum size of a message sent with
+	// Conn.WriteMessage, which fits any UDP datagram.
+	MaxMessageSize = 1<<16 - 1
+
+	messagePrefixLen = 2
+
+	// defaultUDPIdleTimeout is the default idle timeout of UDP flows.
+	defaultUDPIdleTimeout = 2 * time.Minute
+	// udpFlowQueue is the number of datagrams queued while the tunnel of a
+	// flow is dialed. Further datagrams are dropped.
+	udpFlowQueue = 64
+)
+
+// ErrMessageTooLarge is returned by Conn.WriteMessage for messages larger
+// than MaxMessageSize.
+var ErrMessageTooLarge = errors.New("httptunnel: message too large")
+
+// WriteMessage sends p as a single message, prefixed by its length, to be
+// read by ReadMessage on the other end of the tunnel. The messages keep the
+// boundaries of datagrams, for example to carry UDP over the tunnel.
+//
+// Messages and plain writes must not be mixed on the same tunnel.
+func (c *Conn) WriteMessage(p []byte) error {
+	if len(p) > MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	buf := make([]byte, messagePrefixLen+len(p))
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	copy(buf[messagePrefixLen:], p)
+	_, err := c.Write(buf)
+	return err
+}
+
+// ReadMessage reads the next message sent with WriteMessage. If a read
+// deadline interrupts it, the message is kept and the next call resumes
+// reading it.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	c.msgMu.Lock()
+	defer c.msgMu.Unlock()
+	for c.msgRead < messagePrefixLen {
+		n, err := c.Read(c.msgPrefix[c.msgRead:])
+		c.msgRead += n
+		if c.msgRead == messagePrefixLen {
+			c.msg = make([]byte, binary.BigEndian.Uint16(c.msgPrefix[:]))
+			break
+		}
+		if err != nil {
+			return nil, c.messageError(err)
+		}
+	}
+	for c.msgRead-messagePrefixLen < len(c.msg) {
+		n, err := c.Read(c.msg[c.msgRead-messagePrefixLen:])
+		c.msgRead += n
+		if err != nil && c.msgRead-messagePrefixLen < len(c.msg) {
+			return nil, c.messageError(err)
+		}
+	}
+	msg := c.msg
+	c.msg, c.msgRead = nil, 0
+	return msg, nil
+}
+
+func (c *Conn) messageError(err error) error {
+	if err == io.EOF && c.msgRead > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// idleTimer closes a flow once it has been idle for a timeout.
+type idleTimer struct {
+	timeout    time.Duration
+	lastActive atomic.Int64 // unix nanoseconds
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	t.active()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timer = time.AfterFunc(timeout, func() {
+		idle := time.Since(time.Unix(0, t.lastActive.Load()))
+		if idle < t.timeout {
+			t.mu.Lock()
+			t.timer.Reset(t.timeout - idle)
+			t.mu.Unlock()
+			return
+		}
+		onIdle()
+	})
+	return t
+}
+
+func (t *idleTimer) active() {
+	t.lastActive.Store(time.Now().UnixNano())
+}
+
+func (t *idleTimer) stop() {
+	t.mu.Lock()
+	t.timer.Stop()
+	t.mu.Unlock()
+}
+
+// A UDPForwarder forwards the datagrams received on a local UDP socket
+// through tunnels, and the datagrams received from the tunnels back to their
+// sources. Each source address is a flow with its own tunnel, closed once
+// idle. The server forwards the datagrams with ForwardUDP.
+type UDPForwarder struct {
+	// Dialer dials the tunnels. If nil, a zero Dialer is used.
+	Dialer *Dialer
+	// URL and Options are passed to Dialer.DialContext.
+	URL     string
+	Options *ConnectionOptions
+	// IdleTimeout is the time after which a flow without traffic is closed.
+	// If zero, it is 2 minutes.
+	IdleTimeout time.Duration
+	// Logger, if not nil, receives the opening and closing of the flows.
+	Logger *slog.Logger
+}
+
+func (f *UDPForwarder) logger() *slog.Logger {
+	if f.Logger == nil {
+		return discardLogger
+	}
+	return f.Logger
+}
+
+func (f *UDPForwarder) idleTimeout() time.Duration {
+	if f.IdleTimeout == 0 {
+		return defaultUDPIdleTimeout
+	}
+	return f.IdleTimeout
+}
+
+// ListenAndServe listens on the UDP address addr and calls Serve.
+func (f *UDPForwarder) ListenAndServe(ctx context.Context, addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return f.Serve(ctx, pc)
+}
+
+// Serve forwards the datagrams received on pc until ctx is done or pc fails.
+// It closes pc and the flows when it returns.
+func (f *UDPForwarder) Serve(ctx context.Context, pc net.PacketConn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { _ = pc.Close() })
+	defer stop()
+
+	flows := newUDPFlows(f.idleTimeout(), f.logger())
+	defer func() {
+		cancel()
+		_ = pc.Close()
+		flows.closeAll()
+	}()
+
+	buf := make([]byte, MaxMessageSize)
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		flows.send(ctx, src.String(), buf[:n],
+			func(ctx context.Context) (*Conn, error) {
+				return dialTunnel(ctx, f.Dialer, f.URL, f.Options)
+			},
+			func(msg []byte) error {
+				_, err := pc.WriteTo(msg, src)
+				return err
+			},
+		)
+	}
+}
+
+// dialTunnel dials a tunnel and checks that the server upgraded it.
+func dialTunnel(ctx context.Context, d *Dialer, urlStr string, options *ConnectionOptions) (*Conn, error) {
+	netConn, _, resp, err := d.DialContext(ctx, urlStr, options)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		_ = netConn.Close()
+		return nil, &unexpectedStatusError{resp.StatusCode, resp.Status}
+	}
+	return netConn.(*Conn), nil
+}
+
+// unexpectedStatusError is returned by dialTunnel, and reported by
+// DialContext, when the server did not upgrade the tunnel.
+type unexpectedStatusError struct {
+	code   int
+	status string
+}
+
+func (e *unexpectedStatusError) Error() string {
+	return "httptunnel: unexpected response status: " + e.status
+}
+
+// udpFlows are the flows of datagrams forwarded through tunnels, by key,
+// for example the source address of the datagrams.
+type udpFlows struct {
+	idleTimeout time.Duration
+	logger      *slog.Logger
+
+	mu    sync.Mutex
+	flows map[string]*udpFlow
+	wg    sync.WaitGroup
+}
+
+func newUDPFlows(idleTimeout time.Duration, logger *slog.Logger) *udpFlows {
+	return &udpFlows{idleTimeout: idleTimeout, logger: logger, flows: make(map[string]*udpFlow)}
+}
+
+// send queues the datagram msg to the flow of key. If the flow is new, its
+// tunnel is dialed with dial, and the messages received from it are passed
+// to deliver.
+func (fs *udpFlows) send(
+	ctx context.Context,
+	key string,
+	msg []byte,
+	dial func(context.Context) (*Conn, error),
+	deliver func([]byte) error,
+) {
+	fs.mu.Lock()
+	flow, ok := fs.flows[key]
+	if !ok {
+		flow = &udpFlow{queue: make(chan []byte, udpFlowQueue), done: make(chan struct{})}
+		fs.flows[key] = flow
+		fs.wg.Add(1)
+		go func() {
+			defer fs.wg.Done()
+			fs.run(ctx, key, flow, dial, deliver)
+			fs.mu.Lock()
+			delete(fs.flows, key)
+			fs.mu.Unlock()
+		}()
+	}
+	fs.mu.Unlock()
+	select {
+	case flow.queue <- append([]byte(nil), msg...):
+	default:
+		fs.logger.Debug("udp datagram dropped", "flow", key)
+	}
+}
+
+// closeAll closes the flows and waits for them to end.
+func (fs *udpFlows) closeAll() {
+	fs.mu.Lock()
+	for _, flow := range fs.flows {
+		flow.close()
+	}
+	fs.mu.Unlock()
+	fs.wg.Wait()
+}
+
+// udpFlow is the tunnel of a flow of datagrams.
+type udpFlow struct {
+	queue     chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (flow *udpFlow) close() {
+	flow.closeOnce.Do(func() { close(flow.done) })
+}
+
+// run dials the tunnel of flow and forwards its datagrams until the flow is
+// closed or idle.
+func (fs *udpFlows) run(
+	ctx context.Context,
+	key string,
+	flow *udpFlow,
+	dial func(context.Context) (*Conn, error),
+	deliver func([]byte) error,
+) {
+	logger := fs.logger.With("flow", key)
+	conn, err := dial(ctx)
+	if err != nil {
+		logger.Warn("udp flow failed", "error", err)
+		return
+	}
+	defer conn.Close()
+	logger.Debug("udp flow opened", "tunnel_id", conn.ID())
+
+	idle := newIdleTimer(fs.idleTimeout, flow.close)
+	defer idle.stop()
+	go func() {
+		defer flow.close()
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			idle.active()
+			if err := deliver(msg); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-flow.done:
+			logger.Debug("udp flow closed", "tunnel_id", conn.ID())
+			return
+		case msg := <-flow.queue:
+			idle.active()
+			if err := conn.WriteMessage(msg); err != nil {
+				logger.Debug("udp flow closed", "tunnel_id", conn.ID(), "error", err)
+				return
+			}
+		}
+	}
+}
+
+// ForwardUDP forwards the messages of the tunnel conn, sent by a
+// UDPForwarder or with Conn.WriteMessage, as datagrams to the UDP address
+// target, and the datagrams received from target back to the tunnel. It
+// returns when ctx is done, the tunnel is closed, or no datagram was
+// forwarded for idleTimeout, if not zero. It closes conn.
+func ForwardUDP(ctx context.Context, conn *Conn, target string, idleTimeout time.Duration) error {
+	defer conn.Close()
+	var d net.Dialer
+	udpConn, err := d.DialContext(ctx, "udp", target)
+	if err != nil {
+		return err
+	}
+	return forwardUDP(ctx, conn, udpConn, idleTimeout)
+}
+
+// forwardUDP forwards the messages of conn to udpConn and back. It closes
+// udpConn.
+func forwardUDP(ctx context.Context, conn *Conn, udpConn net.Conn, idleTimeout time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+		_ = udpConn.Close()
+	})
+	defer stop()
+	defer udpConn.Close()
+	if idleTimeout > 0 {
+		idle := newIdleTimer(idleTimeout, cancel)
+		defer idle.stop()
+		udpConn = &activeConn{Conn: udpConn, idle: idle}
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil && ctx.Err() == nil && err != io.EOF {
+			firstErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, MaxMessageSize)
+		for {
+			n, err := udpConn.Read(buf)
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				// The target is not listening yet
+				continue
+			}
+			if err != nil {
+				fail(err)
+				return
+			}
+			if err := conn.WriteMessage(buf[:n]); err != nil {
+				fail(err)
+				return
+			}
+		}
+	}()
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			fail(err)
+			break
+		}
+		if _, err := udpConn.Write(msg); err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+			fail(err)
+			break
+		}
+	}
+	<-done
+	mu.Lock()
+	defer mu.Unlock()
+	return firstErr
+}
+
+// activeConn marks a flow active on each datagram read or written.
+type activeConn struct {
+	net.Conn
+	idle *idleTimer
+}
+
+func (c *activeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.idle.active()
+	}
+	return n, err
+}
+
+func (c *activeConn) Write(p []byte) (int, error) {
+	c.idle.active()
+	return c.Conn.Write(p)
+}
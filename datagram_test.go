@@ -0,0 +1,197 @@
+package httptunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMessages(t *testing.T) {
+	s := newNoiseServer(t, Hijacker{}, nil)
+	defer s.Close()
+
+	netConn, _, _, err := testDialer.Dial(s.URL, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer netConn.Close()
+	conn := netConn.(*Conn)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, size := range []int{0, 1, 1500, MaxMessageSize} {
+		msg := bytes.Repeat([]byte{byte(size)}, size)
+		if err := conn.WriteMessage(msg); err != nil {
+			t.Fatalf("WriteMessage: %v", err)
+		}
+		received, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		if !bytes.Equal(received, msg) {
+			t.Errorf("expected a message of %v bytes, got: %v bytes", size, len(received))
+		}
+	}
+	if err := conn.WriteMessage(make([]byte, MaxMessageSize+1)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("expected ErrMessageTooLarge, got: %v", err)
+	}
+
+	// A message interrupted by a deadline is resumed by the next read
+	if _, err := conn.Write([]byte{0, 5, 'h', 'e'}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.ReadMessage(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a timeout, got: %v", err)
+	}
+	if _, err := conn.Write([]byte("llo")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if msg, err := conn.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Errorf("expected hello, got: %q, %v", msg, err)
+	}
+}
+
+// newUDPEchoServer returns the address of a UDP server echoing datagrams.
+func newUDPEchoServer(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, MaxMessageSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func udpEcho(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(buf[:n]) != msg {
+		t.Fatalf("expected %q, got: %q", msg, buf[:n])
+	}
+}
+
+func TestUDPForwarder(t *testing.T) {
+	target := newUDPEchoServer(t)
+	results := make(chan error, 2)
+	var tunnels atomic.Int32
+	s := newServer(t)
+	defer s.Close()
+	s.Server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.wg.Add(1)
+		defer s.wg.Done()
+		conn, _, err := Hijacker{}.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade: %v", err)
+			return
+		}
+		tunnels.Add(1)
+		results <- ForwardUDP(r.Context(), conn.(*Conn), target, 0)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := testDialer
+	f := &UDPForwarder{Dialer: &d, URL: s.URL, IdleTimeout: 100 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- f.Serve(ctx, pc) }()
+
+	// Each source address is a flow
+	for _, msg := range []string{"first", "second"} {
+		client, err := net.Dial("udp", pc.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		udpEcho(t, client, msg+" query")
+		udpEcho(t, client, msg+" query again")
+	}
+	if n := tunnels.Load(); n != 2 {
+		t.Errorf("expected 2 tunnels, got: %v", n)
+	}
+
+	// The idle flows are closed
+	for range 2 {
+		select {
+		case err := <-results:
+			if err != nil {
+				t.Errorf("ForwardUDP: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the idle flows to be closed")
+		}
+	}
+
+	cancel()
+	if err := <-served; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Serve to return context.Canceled, got: %v", err)
+	}
+}
+
+func TestForwardUDPIdleTimeout(t *testing.T) {
+	target := newUDPEchoServer(t)
+	results := make(chan error, 1)
+	s := newServer(t)
+	defer s.Close()
+	s.Server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.wg.Add(1)
+		defer s.wg.Done()
+		conn, _, err := Hijacker{}.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade: %v", err)
+			return
+		}
+		results <- ForwardUDP(r.Context(), conn.(*Conn), target, 50*time.Millisecond)
+	})
+
+	netConn, _, _, err := testDialer.Dial(s.URL, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer netConn.Close()
+	conn := netConn.(*Conn)
+	if err := conn.WriteMessage([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if msg, err := conn.ReadMessage(); err != nil || string(msg) != "ping" {
+		t.Fatalf("expected ping, got: %q, %v", msg, err)
+	}
+	select {
+	case err := <-results:
+		if err != nil {
+			t.Errorf("ForwardUDP: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the idle tunnel to be closed")
+	}
+	if _, err := conn.ReadMessage(); err == nil {
+		t.Error("expected the tunnel to be closed by the server")
+	}
+}
@@ -0,0 +1,172 @@
+package httptunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// devCAValidity is the validity of the certificates of a DevCA.
+const devCAValidity = 7 * 24 * time.Hour
+
+// A DevCA is an ephemeral certificate authority for local development and
+// tests. It issues server and client certificates so that tunnels can use
+// TLS, and mutual TLS, without any setup:
+//
+//	ca, _ := httptunnel.NewDevCA()
+//	serverConfig, _ := ca.ServerTLSConfig("localhost", "127.0.0.1")
+//	server := &http.Server{Handler: handler, TLSConfig: serverConfig}
+//	go server.ListenAndServeTLS("", "")
+//
+//	dialer := httptunnel.Dialer{TLSClientConfig: ca.ClientTLSConfig()}
+//
+// Its key only lives in memory, so the certificates cannot be issued again
+// after the process exits. It must not be used in production.
+type DevCA struct {
+	// Certificate is the certificate of the CA.
+	Certificate *x509.Certificate
+
+	key *ecdsa.PrivateKey
+}
+
+// NewDevCA generates a CA valid for 7 days.
+func NewDevCA() (*DevCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template, err := devCertTemplate("httptunnel development CA")
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &DevCA{Certificate: cert, key: key}, nil
+}
+
+func devCertTemplate(commonName string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		// Tolerate clocks slightly off
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(devCAValidity),
+	}, nil
+}
+
+// issue returns a certificate signed by the CA for template.
+func (ca *DevCA) issue(template *x509.Certificate) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if template.NotAfter.After(ca.Certificate.NotAfter) {
+		template.NotAfter = ca.Certificate.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der, ca.Certificate.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// ServerCertificate issues a server certificate for hosts, which are host
+// names or IP addresses.
+func (ca *DevCA) ServerCertificate(hosts ...string) (tls.Certificate, error) {
+	if len(hosts) == 0 {
+		return tls.Certificate{}, errors.New("httptunnel: no host for the server certificate")
+	}
+	template, err := devCertTemplate(hosts[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return ca.issue(template)
+}
+
+// ClientCertificate issues a client certificate with the common name
+// commonName.
+func (ca *DevCA) ClientCertificate(commonName string) (tls.Certificate, error) {
+	template, err := devCertTemplate(commonName)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return ca.issue(template)
+}
+
+// CertPool returns a pool containing the CA.
+func (ca *DevCA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+	return pool
+}
+
+// WriteCertFile writes the certificate of the CA to path in PEM format, for
+// example to trust it with curl --cacert or CertReloader.
+func (ca *DevCA) WriteCertFile(path string) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate.Raw}), 0o644)
+}
+
+// ServerTLSConfig returns a server TLS configuration with a certificate for
+// hosts. Clients presenting a certificate must present one issued by the
+// CA; set ClientAuth to tls.RequireAndVerifyClientCert to require them.
+func (ca *DevCA) ServerTLSConfig(hosts ...string) (*tls.Config, error) {
+	cert, err := ca.ServerCertificate(hosts...)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    ca.CertPool(),
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}, nil
+}
+
+// ClientTLSConfig returns a client TLS configuration trusting the CA, to be
+// used as Dialer.TLSClientConfig, presenting the given client certificates.
+func (ca *DevCA) ClientTLSConfig(certs ...tls.Certificate) *tls.Config {
+	return &tls.Config{
+		RootCAs:      ca.CertPool(),
+		Certificates: certs,
+	}
+}
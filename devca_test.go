@@ -0,0 +1,90 @@
+package httptunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// newDevCAServer returns a server using a certificate of ca and requiring
+// client certificates.
+func newDevCAServer(t *testing.T, ca *DevCA) *mockServer {
+	cfg, err := ca.ServerTLSConfig("127.0.0.1", "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	var s mockServer
+	s.Server = httptest.NewUnstartedServer(testHandler{T: t, s: &s, hijacker: testHijacker})
+	s.Server.TLS = cfg
+	// The rejected handshakes are expected
+	s.Server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	s.Server.StartTLS()
+	s.Server.URL += testRequestURI
+	s.URL = s.Server.URL
+	return &s
+}
+
+func TestDevCA(t *testing.T) {
+	ca, err := NewDevCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newDevCAServer(t, ca)
+	defer s.Close()
+
+	clientCert, err := ca.ClientCertificate("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := testDialer
+	d.TLSClientConfig = ca.ClientTLSConfig(clientCert)
+	conn, _, resp, err := d.Dial(s.URL, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	sendRecv(conn, resp, t)
+	conn.Close()
+
+	// The server requires a client certificate
+	d.TLSClientConfig = ca.ClientTLSConfig()
+	if _, _, _, err := d.Dial(s.URL, testDialOptions); err == nil {
+		t.Error("expected the dial without client certificate to fail")
+	}
+
+	// Another CA is not trusted
+	other, err := NewDevCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.TLSClientConfig = other.ClientTLSConfig(clientCert)
+	if _, _, _, err := d.Dial(s.URL, testDialOptions); err == nil {
+		t.Error("expected the certificate of another CA to be rejected")
+	}
+}
+
+func TestDevCAWriteCertFile(t *testing.T) {
+	ca, err := NewDevCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ca.WriteCertFile(file); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewCertReloader("", "", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.ServerCertificate("tunnel.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: r.RootCAs(), DNSName: "tunnel.example"}); err != nil {
+		t.Error(err)
+	}
+}
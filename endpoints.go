@@ -0,0 +1,189 @@
+package httptunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultEndpointCooldown = 30 * time.Second
+
+// ErrNoEndpoints is returned when an EndpointPool has no endpoint to dial.
+var ErrNoEndpoints = errors.New("httptunnel: no endpoints")
+
+// An Endpoint is a tunneling server that a Dialer can connect to.
+type Endpoint struct {
+	// URL is the base URL of the server. The URL given to Dial is resolved
+	// against it.
+	URL string
+
+	// Priority orders the endpoints: the endpoints with the lowest priority
+	// are tried first, in round-robin order.
+	Priority int
+}
+
+// An EndpointPool is a set of equivalent tunneling servers. A Dialer with an
+// EndpointPool tries the endpoints by priority, and in round-robin order
+// within a priority, until a handshake succeeds or fails with an error that
+// is not worth retrying (see RetryPolicy). Endpoints that failed recently
+// are only tried once the others have failed too.
+//
+// The endpoint chosen is reported by Conn.Endpoint and by the GetConn hook
+// of the httptrace.ClientTrace of the dial's context.
+//
+// It is safe to share an EndpointPool between Dialers.
+type EndpointPool struct {
+	// Endpoints are the servers of the pool.
+	Endpoints []Endpoint
+
+	// Resolve, if not nil, returns the servers of the pool for each dial
+	// instead of Endpoints, for example from DNS SRV records.
+	Resolve func(ctx context.Context) ([]Endpoint, error)
+
+	// Cooldown is how long an endpoint is avoided after a failure. If zero,
+	// 30 seconds is used.
+	Cooldown time.Duration
+
+	mu     sync.Mutex
+	next   map[int]int          // round-robin position by priority
+	failed map[string]time.Time // end of the cooldown by URL
+}
+
+func (p *EndpointPool) cooldown() time.Duration {
+	if p.Cooldown <= 0 {
+		return defaultEndpointCooldown
+	}
+	return p.Cooldown
+}
+
+// order returns the URLs of the endpoints in the order they should be tried.
+func (p *EndpointPool) order(ctx context.Context) ([]string, error) {
+	endpoints := p.Endpoints
+	if p.Resolve != nil {
+		var err error
+		if endpoints, err = p.Resolve(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	endpoints = append([]Endpoint(nil), endpoints...)
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return endpoints[i].Priority < endpoints[j].Priority
+	})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.next == nil {
+		p.next = make(map[int]int)
+	}
+	now := time.Now()
+	var ready, cooling []string
+	for i := 0; i < len(endpoints); {
+		j := i
+		for j < len(endpoints) && endpoints[j].Priority == endpoints[i].Priority {
+			j++
+		}
+		group := endpoints[i:j]
+		start := p.next[group[0].Priority] % len(group)
+		p.next[group[0].Priority] = start + 1
+		for k := range group {
+			u := group[(start+k)%len(group)].URL
+			if until, ok := p.failed[u]; ok && now.Before(until) {
+				cooling = append(cooling, u)
+			} else {
+				ready = append(ready, u)
+			}
+		}
+		i = j
+	}
+	return append(ready, cooling...), nil
+}
+
+func (p *EndpointPool) markFailed(u string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failed == nil {
+		p.failed = make(map[string]time.Time)
+	}
+	p.failed[u] = time.Now().Add(p.cooldown())
+}
+
+func (p *EndpointPool) markSucceeded(u string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.failed, u)
+}
+
+// resolveEndpoint resolves the URL given to Dial against the URL of an
+// endpoint.
+func resolveEndpoint(endpoint, urlStr string) (string, error) {
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(urlStr)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// dialEndpoints makes a single attempt at establishing a tunnel, failing
+// over between the endpoints of the Dialer's EndpointPool. It returns the
+// URL that was dialed.
+func (d *Dialer) dialEndpoints(
+	ctx context.Context,
+	urlStr string,
+	options *ConnectionOptions,
+	inst instruments,
+) (net.Conn, *bufio.Reader, *http.Response, string, error) {
+	pool := d.Endpoints
+	if pool == nil {
+		return d.dialRedirects(ctx, urlStr, options, inst)
+	}
+
+	endpoints, err := pool.order(ctx)
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+	var (
+		netConn net.Conn
+		br      *bufio.Reader
+		resp    *http.Response
+		u       string
+	)
+	for i, endpoint := range endpoints {
+		if u, err = resolveEndpoint(endpoint, urlStr); err != nil {
+			return nil, nil, nil, "", err
+		}
+		inst.logger.Debug("dialing endpoint", "endpoint", redactURL(endpoint))
+		netConn, br, resp, u, err = d.dialRedirects(ctx, u, options, inst)
+		if !retryable(resp, err) {
+			if err == nil && resp.StatusCode == http.StatusSwitchingProtocols {
+				pool.markSucceeded(endpoint)
+			}
+			break
+		}
+		pool.markFailed(endpoint)
+		status := ""
+		if resp != nil {
+			status = resp.Status
+		}
+		inst.logger.Warn("endpoint failed", "endpoint", redactURL(endpoint), "status", status, "error", err)
+		if i == len(endpoints)-1 || ctx.Err() != nil {
+			break
+		}
+		if netConn != nil {
+			_ = netConn.Close()
+		}
+	}
+	return netConn, br, resp, u, err
+}
@@ -0,0 +1,113 @@
+package httptunnel
+
+import (
+	"context"
+	"net"
+	"net/http/httptrace"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// baseURL returns the URL of s without the test path and query.
+func baseURL(s *mockServer) string {
+	u, _ := url.Parse(s.URL)
+	return "http://" + u.Host
+}
+
+func TestEndpointFailover(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := l.Addr().String()
+	l.Close()
+
+	d := testDialer
+	d.Endpoints = &EndpointPool{Endpoints: []Endpoint{
+		{URL: baseURL(s), Priority: 1},
+		{URL: "http://" + deadAddr},
+	}}
+	var hosts []string
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		GetConn: func(hostPort string) { hosts = append(hosts, hostPort) },
+	})
+
+	for i, expected := range [][]string{
+		{deadAddr, s.Server.Listener.Addr().String()},
+		{s.Server.Listener.Addr().String()},
+	} {
+		hosts = nil
+		conn, _, resp, err := d.DialContext(ctx, testRequestURI, testDialOptions)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		sendRecv(conn, resp, t)
+		conn.Close()
+		if endpoint := conn.(*Conn).Endpoint(); endpoint != s.URL {
+			t.Errorf("expected endpoint %v, got: %v", s.URL, endpoint)
+		}
+		if !reflect.DeepEqual(hosts, expected) {
+			t.Errorf("dial %v: expected hosts %v, got: %v", i, expected, hosts)
+		}
+	}
+}
+
+func TestEndpointRoundRobin(t *testing.T) {
+	s1 := newServer(t)
+	defer s1.Close()
+	s2 := newServer(t)
+	defer s2.Close()
+
+	d := testDialer
+	d.Endpoints = &EndpointPool{Endpoints: []Endpoint{{URL: baseURL(s1)}, {URL: baseURL(s2)}}}
+	var endpoints []string
+	for i := 0; i < 4; i++ {
+		conn, _, resp, err := d.Dial(testRequestURI, testDialOptions)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		sendRecv(conn, resp, t)
+		conn.Close()
+		endpoints = append(endpoints, conn.(*Conn).Endpoint())
+	}
+	expected := []string{s1.URL, s2.URL, s1.URL, s2.URL}
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("expected %v, got: %v", expected, endpoints)
+	}
+}
+
+func TestEndpointPoolOrder(t *testing.T) {
+	p := &EndpointPool{
+		Resolve: func(ctx context.Context) ([]Endpoint, error) {
+			return []Endpoint{
+				{URL: "http://c", Priority: 2},
+				{URL: "http://a1", Priority: 1},
+				{URL: "http://a2", Priority: 1},
+				{URL: "http://b"},
+			}, nil
+		},
+		Cooldown: time.Hour,
+	}
+	p.markFailed("http://b")
+	for _, expected := range [][]string{
+		{"http://a1", "http://a2", "http://c", "http://b"},
+		{"http://a2", "http://a1", "http://c", "http://b"},
+	} {
+		order, err := p.order(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(order, expected) {
+			t.Errorf("expected %v, got: %v", expected, order)
+		}
+	}
+
+	if _, err := (&EndpointPool{}).order(context.Background()); err != ErrNoEndpoints {
+		t.Errorf("expected %v, got: %v", ErrNoEndpoints, err)
+	}
+}
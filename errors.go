@@ -0,0 +1,140 @@
+package httptunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// A DialPhase identifies the step of a tunnel handshake.
+type DialPhase int
+
+const (
+	// PhaseDNS is the resolution of the server or proxy host name.
+	PhaseDNS DialPhase = iota
+	// PhaseConnect is the connection to the server or proxy.
+	PhaseConnect
+	// PhaseProxy is the negotiation of a tunnel with the proxy, for example
+	// an HTTP CONNECT request.
+	PhaseProxy
+	// PhaseTLS is the TLS handshake with the server.
+	PhaseTLS
+	// PhaseWriteRequest is the write of the upgrade request.
+	PhaseWriteRequest
+	// PhaseReadResponse is the read of the upgrade response.
+	PhaseReadResponse
+)
+
+func (p DialPhase) String() string {
+	switch p {
+	case PhaseDNS:
+		return "dns lookup"
+	case PhaseConnect:
+		return "connect"
+	case PhaseProxy:
+		return "proxy connect"
+	case PhaseTLS:
+		return "tls handshake"
+	case PhaseWriteRequest:
+		return "write request"
+	case PhaseReadResponse:
+		return "read response"
+	default:
+		return "unknown phase"
+	}
+}
+
+// A DialError is returned by DialContext when the handshake fails on the
+// network. Errors in the configuration of the dial, such as an invalid URL,
+// are returned as is.
+type DialError struct {
+	// Phase is the step of the handshake that failed.
+	Phase DialPhase
+	// Addr is the address of the server, as host:port.
+	Addr string
+	// Proxy is the URL of the proxy used to reach the server, or nil. With
+	// a chain of proxies, it is the last one.
+	Proxy *url.URL
+	// Err is the cause of the failure.
+	Err error
+}
+
+func (e *DialError) Error() string {
+	s := "httptunnel: " + e.Phase.String() + " " + e.Addr
+	if e.Proxy != nil {
+		s += " via proxy " + e.Proxy.Redacted()
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the handshake timed out.
+func (e *DialError) Timeout() bool {
+	var netErr net.Error
+	return errors.Is(e.Err, context.DeadlineExceeded) ||
+		errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+// A ProxyError is returned when an HTTP proxy rejects the CONNECT request.
+// It is wrapped in a DialError of phase PhaseProxy.
+type ProxyError struct {
+	// StatusCode and Status are the status of the proxy's response, for
+	// example 407 and "407 Proxy Authentication Required".
+	StatusCode int
+	Status     string
+	// Header is the header of the proxy's response.
+	Header http.Header
+}
+
+func (e *ProxyError) Error() string {
+	return "proxy responded " + e.Status
+}
+
+// connectError marks the errors of the connection to the server or to the
+// first proxy, to tell them apart from the errors of the proxies.
+type connectError struct {
+	err error
+}
+
+func (e *connectError) Error() string {
+	return e.err.Error()
+}
+
+func (e *connectError) Unwrap() error {
+	return e.err
+}
+
+func markConnectErrors(netDial netDialerFunc) netDialerFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := netDial(ctx, network, addr)
+		if err != nil {
+			return nil, &connectError{err: err}
+		}
+		return c, nil
+	}
+}
+
+// newNetDialError returns the DialError for an error of a dial function
+// wrapped by markConnectErrors.
+func newNetDialError(addr string, proxyURL *url.URL, err error) *DialError {
+	var (
+		connectErr *connectError
+		dnsErr     *net.DNSError
+	)
+	phase := PhaseProxy
+	if errors.As(err, &connectErr) {
+		phase = PhaseConnect
+		if errors.As(err, &dnsErr) {
+			phase = PhaseDNS
+		}
+		if connectErr == err {
+			err = connectErr.err
+		}
+	}
+	return &DialError{Phase: phase, Addr: addr, Proxy: proxyURL, Err: err}
+}
@@ -0,0 +1,138 @@
+package httptunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+)
+
+func TestDialErrorPhases(t *testing.T) {
+	tlsServer := newTLSServer(t)
+	defer tlsServer.Close()
+
+	proxy := newServer(t)
+	defer proxy.Close()
+	proxy.Server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proxy-Reason", "denied")
+		http.Error(w, "denied", http.StatusForbidden)
+	})
+	proxyURL, _ := url.Parse(proxy.Server.URL)
+
+	hangup, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hangup.Close()
+	go func() {
+		for {
+			c, err := hangup.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	for _, tt := range []struct {
+		name  string
+		url   string
+		setup func(d *Dialer)
+		phase DialPhase
+		cause error
+	}{
+		{
+			name: "dns",
+			url:  "http://tunnel.invalid" + testRequestURI,
+			setup: func(d *Dialer) {
+				d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Name: "tunnel.invalid", IsNotFound: true}}
+				}
+			},
+			phase: PhaseDNS,
+		},
+		{
+			name: "connect",
+			url:  "http://127.0.0.1:1" + testRequestURI,
+			setup: func(d *Dialer) {
+				d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+				}
+			},
+			phase: PhaseConnect,
+			cause: syscall.ECONNREFUSED,
+		},
+		{
+			name:  "proxy",
+			url:   "http://tunnel.example:8080" + testRequestURI,
+			setup: func(d *Dialer) { d.Proxy = http.ProxyURL(proxyURL) },
+			phase: PhaseProxy,
+		},
+		{
+			name:  "tls",
+			url:   tlsServer.URL,
+			phase: PhaseTLS,
+		},
+		{
+			name:  "read response",
+			url:   "http://" + hangup.Addr().String() + testRequestURI,
+			phase: PhaseReadResponse,
+		},
+	} {
+		d := testDialer
+		if tt.setup != nil {
+			tt.setup(&d)
+		}
+		_, _, _, err := d.Dial(tt.url, nil)
+		var dialErr *DialError
+		if !errors.As(err, &dialErr) {
+			t.Errorf("%v: expected a *DialError, got: %v", tt.name, err)
+			continue
+		}
+		if dialErr.Phase != tt.phase {
+			t.Errorf("%v: expected phase %v, got: %v (%v)", tt.name, tt.phase, dialErr.Phase, err)
+		}
+		if tt.cause != nil && !errors.Is(err, tt.cause) {
+			t.Errorf("%v: expected cause %v, got: %v", tt.name, tt.cause, err)
+		}
+	}
+}
+
+func TestProxyError(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	s.Server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		http.Error(w, "authentication required", http.StatusProxyAuthRequired)
+	})
+	surl, _ := url.Parse(s.Server.URL)
+	surl = &url.URL{Scheme: "http", User: url.UserPassword("username", "secret"), Host: surl.Host}
+
+	d := testDialer
+	d.Proxy = http.ProxyURL(surl)
+	_, _, _, err := d.Dial("http://tunnel.example"+testRequestURI, nil)
+
+	var dialErr *DialError
+	if !errors.As(err, &dialErr) {
+		t.Fatalf("expected a *DialError, got: %v", err)
+	}
+	if dialErr.Addr != "tunnel.example:80" || dialErr.Proxy == nil || dialErr.Proxy.Host != surl.Host {
+		t.Errorf("expected the target and proxy to be recorded, got: %+v", dialErr)
+	}
+	var proxyErr *ProxyError
+	if !errors.As(err, &proxyErr) {
+		t.Fatalf("expected a *ProxyError, got: %v", err)
+	}
+	if proxyErr.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("expected status %v, got: %v", http.StatusProxyAuthRequired, proxyErr.StatusCode)
+	}
+	if v := proxyErr.Header.Get("Proxy-Authenticate"); v != `Basic realm="proxy"` {
+		t.Errorf("expected the proxy's header, got: %q", v)
+	}
+	if msg := err.Error(); msg != "httptunnel: proxy connect tunnel.example:80 via proxy http://username:xxxxx@"+surl.Host+": proxy responded 407 Proxy Authentication Required" {
+		t.Errorf("unexpected error message: %v", msg)
+	}
+}
@@ -2,4 +2,9 @@ module github.com/TylerZeroMaster/httptunnel
 
 go 1.23.0
 
-require golang.org/x/net v0.33.0
+require (
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.33.0
+)
+
+require golang.org/x/sys v0.28.0 // indirect
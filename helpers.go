@@ -10,9 +10,11 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/base64"
-	"errors"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strings"
 	"unicode/utf8"
@@ -55,9 +57,19 @@ func (fn netDialerFunc) DialContext(ctx context.Context, network, addr string) (
 	return fn(ctx, network, addr)
 }
 
-func proxyFromURL(proxyURL *url.URL, forwardDial netDialerFunc) (netDialerFunc, error) {
-	if proxyURL.Scheme == "http" {
-		return (&httpProxyDialer{proxyURL: proxyURL, forwardDial: forwardDial}).DialContext, nil
+func proxyFromURL(proxyURL *url.URL, forwardDial netDialerFunc, d *Dialer, logger *slog.Logger) (netDialerFunc, error) {
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return (&httpProxyDialer{
+			proxyURL:      proxyURL,
+			forwardDial:   forwardDial,
+			tlsConfig:     d.ProxyTLSClientConfig,
+			pins:          d.Pins,
+			keyLogWriter:  d.KeyLogWriter,
+			connectHeader: d.ProxyConnectHeader,
+			credentials:   d.ProxyCredentials,
+			logger:        logger,
+		}).DialContext, nil
 	}
 	dialer, err := proxy.FromURL(proxyURL, forwardDial)
 	if err != nil {
@@ -74,17 +86,22 @@ func proxyFromURL(proxyURL *url.URL, forwardDial netDialerFunc) (netDialerFunc,
 type httpProxyDialer struct {
 	proxyURL    *url.URL
 	forwardDial netDialerFunc
+	// tlsConfig is the TLS configuration of the connection to an https
+	// proxy.
+	tlsConfig     *tls.Config
+	pins          PinSet
+	keyLogWriter  io.Writer
+	connectHeader http.Header
+	credentials   ProxyCredentialsFunc
+	logger        *slog.Logger
 }
 
 func (hpd *httpProxyDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
-	hostPort, _ := hostPortNoPort(hpd.proxyURL)
-	conn, err := hpd.forwardDial(ctx, network, hostPort)
-	if err != nil {
-		return nil, err
+	connectHeader := hpd.connectHeader.Clone()
+	if connectHeader == nil {
+		connectHeader = make(http.Header)
 	}
-
-	connectHeader := make(http.Header)
-	if user := hpd.proxyURL.User; user != nil {
+	if user := hpd.proxyURL.User; user != nil && connectHeader.Get("Proxy-Authorization") == "" {
 		proxyUser := user.Username()
 		if proxyPassword, passwordSet := user.Password(); passwordSet {
 			credential := base64.StdEncoding.EncodeToString([]byte(proxyUser + ":" + proxyPassword))
@@ -92,6 +109,73 @@ func (hpd *httpProxyDialer) DialContext(ctx context.Context, network string, add
 		}
 	}
 
+	conn, resp, err := hpd.connect(ctx, network, addr, connectHeader)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		// Answer the challenge on a new connection, as proxies commonly
+		// close the connection after a 407.
+		authorization, err := hpd.authorize(addr, resp.Header.Values("Proxy-Authenticate"))
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		if authorization != "" && authorization != connectHeader.Get("Proxy-Authorization") {
+			_ = conn.Close()
+			connectHeader.Set("Proxy-Authorization", authorization)
+			if conn, resp, err = hpd.connect(ctx, network, addr, connectHeader); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, &ProxyError{StatusCode: resp.StatusCode, Status: resp.Status, Header: resp.Header}
+	}
+	return conn, nil
+}
+
+// connect sends a CONNECT request for addr to the proxy on a new connection.
+// The connection is returned with the response whatever its status.
+func (hpd *httpProxyDialer) connect(
+	ctx context.Context,
+	network string,
+	addr string,
+	connectHeader http.Header,
+) (net.Conn, *http.Response, error) {
+	hostPort, hostNoPort := hostPortNoPort(hpd.proxyURL)
+	conn, err := hpd.forwardDial(ctx, network, hostPort)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if hpd.proxyURL.Scheme == "https" {
+		cfg := cloneTLSConfig(hpd.tlsConfig)
+		if cfg.ServerName == "" {
+			cfg.ServerName = hostNoPort
+		}
+		cfg.ClientSessionCache = sessionCache(hpd.tlsConfig, "proxy")
+		setKeyLog(cfg, hpd.keyLogWriter, hpd.logger)
+		hpd.pins.configure(cfg)
+		tlsConn := tls.Client(conn, cfg)
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		err := doHandshake(ctx, tlsConn, cfg, hpd.pins, hpd.logger)
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+		}
+		if err != nil {
+			hpd.logger.Warn("proxy tls handshake failed", "proxy", hpd.proxyURL.Redacted(), "error", err)
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
+
 	connectReq := &http.Request{
 		Method: http.MethodConnect,
 		URL:    &url.URL{Opaque: addr},
@@ -99,18 +183,34 @@ func (hpd *httpProxyDialer) DialContext(ctx context.Context, network string, add
 		Header: connectHeader,
 	}
 
+	hpd.logger.Debug("proxy connect",
+		"proxy", hpd.proxyURL.Redacted(),
+		"target", addr,
+		"header", redactHeader(connectHeader),
+	)
 	if err := connectReq.Write(conn); err != nil {
 		conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Read response. It's OK to use and discard buffered reader here because
-	// the remote server does not speak until spoken to.
+	// Read response. Bytes read past the response, such as the greeting of a
+	// server that speaks first, are replayed by the returned connection.
 	br := bufio.NewReader(conn)
 	resp, err := http.ReadResponse(br, connectReq)
 	if err != nil {
+		hpd.logger.Warn("proxy connect failed", "proxy", hpd.proxyURL.Redacted(), "target", addr, "error", err)
 		conn.Close()
-		return nil, err
+		return nil, nil, err
+	}
+	hpd.logger.Info("proxy connect response",
+		"proxy", hpd.proxyURL.Redacted(),
+		"target", addr,
+		"status", resp.Status,
+	)
+
+	if resp.StatusCode == http.StatusOK && br.Buffered() > 0 {
+		// A successful response to CONNECT has no body
+		return &bufferedConn{Conn: conn, r: br}, resp, nil
 	}
 
 	// Close the response body to silence false positives from linters. Reset
@@ -123,12 +223,7 @@ func (hpd *httpProxyDialer) DialContext(ctx context.Context, network string, add
 	br.Reset(bytes.NewReader(nil))
 	_ = resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		_ = conn.Close()
-		f := strings.SplitN(resp.Status, " ", 2)
-		return nil, errors.New(f[1])
-	}
-	return conn, nil
+	return conn, resp, nil
 }
 
 func dialerFuncForURL(u *url.URL, d *Dialer) netDialerFunc {
@@ -166,21 +261,66 @@ func maybeWrapDeadline(netDial netDialerFunc, ctx context.Context) netDialerFunc
 	return netDial
 }
 
-func maybeWrapProxy(netDial netDialerFunc, d *Dialer, req *http.Request) (netDialerFunc, error) {
+// A proxyRoute is a way to reach the server, directly or through proxies.
+type proxyRoute struct {
+	netDial netDialerFunc
+	// proxyURL is the last proxy of the route, or nil for a direct
+	// connection.
+	proxyURL *url.URL
+}
+
+// maybeWrapProxy returns the routes to try in order to reach the server of
+// req. There is at least one route.
+func maybeWrapProxy(netDial netDialerFunc, d *Dialer, req *http.Request, logger *slog.Logger) ([]proxyRoute, error) {
 	// If needed, wrap the dial function to connect through a proxy.
-	if d.Proxy != nil {
+	var chains [][]*url.URL
+	switch {
+	case d.ProxyChain != nil:
+		chain, err := d.ProxyChain(req)
+		if err != nil {
+			return nil, err
+		}
+		chains = [][]*url.URL{chain}
+	case d.ProxyFailover != nil:
+		alternatives, err := d.ProxyFailover(req)
+		if err != nil {
+			return nil, err
+		}
+		for _, proxyURL := range alternatives {
+			if proxyURL == nil {
+				chains = append(chains, nil)
+			} else {
+				chains = append(chains, []*url.URL{proxyURL})
+			}
+		}
+	case d.Proxy != nil:
 		proxyURL, err := d.Proxy(req)
 		if err != nil {
 			return nil, err
 		}
 		if proxyURL != nil {
-			netDial, err = proxyFromURL(proxyURL, netDial)
+			chains = [][]*url.URL{{proxyURL}}
+		}
+	}
+	if len(chains) == 0 {
+		return []proxyRoute{{netDial: netDial}}, nil
+	}
+
+	routes := make([]proxyRoute, len(chains))
+	for i, chain := range chains {
+		// Each proxy is reached through the previous ones
+		route := proxyRoute{netDial: netDial}
+		for _, proxyURL := range chain {
+			var err error
+			route.netDial, err = proxyFromURL(proxyURL, route.netDial, d, logger)
 			if err != nil {
 				return nil, err
 			}
+			route.proxyURL = proxyURL
 		}
+		routes[i] = route
 	}
-	return netDial, nil
+	return routes, nil
 }
 
 func cloneTLSConfig(cfg *tls.Config) *tls.Config {
@@ -190,7 +330,7 @@ func cloneTLSConfig(cfg *tls.Config) *tls.Config {
 	return cfg.Clone()
 }
 
-func doHandshake(ctx context.Context, tlsConn *tls.Conn, cfg *tls.Config) error {
+func doHandshake(ctx context.Context, tlsConn *tls.Conn, cfg *tls.Config, pins PinSet, logger *slog.Logger) error {
 	if err := tlsConn.HandshakeContext(ctx); err != nil {
 		return err
 	}
@@ -199,6 +339,13 @@ func doHandshake(ctx context.Context, tlsConn *tls.Conn, cfg *tls.Config) error
 			return err
 		}
 	}
+	backup, err := pins.verify(cfg.ServerName, tlsConn.ConnectionState())
+	if err != nil {
+		return err
+	}
+	if backup {
+		logger.Warn("certificate matched a backup pin", "server_name", cfg.ServerName)
+	}
 	return nil
 }
 
@@ -1,9 +1,14 @@
 package httptunnel
 
 import (
+	"bufio"
+	"context"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func TestCheckSameOrigin(t *testing.T) {
@@ -46,3 +51,53 @@ func TestEqualASCIIFold(t *testing.T) {
 		}
 	}
 }
+
+func TestHTTPProxyDialerEarlyData(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(c)); err != nil {
+			return
+		}
+		// The response and the greeting of a server that speaks first
+		// arrive together
+		_, _ = io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\nSSH-2.0-test\r\n")
+		_, _ = io.Copy(c, c)
+	}()
+
+	proxyURL := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	forwardDial := netDialerFunc((&net.Dialer{}).DialContext)
+	dial, err := proxyFromURL(proxyURL, forwardDial, &Dialer{}, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial(context.Background(), "tcp", "ssh.example:22")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	greeting := make([]byte, len("SSH-2.0-test\r\n"))
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(greeting) != "SSH-2.0-test\r\n" {
+		t.Errorf("expected the early data to be preserved, got: %q", greeting)
+	}
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "ping" {
+		t.Errorf("expected the connection to be usable after the early data, got: %q, %v", echo, err)
+	}
+}
@@ -0,0 +1,77 @@
+package httptunnel
+
+import (
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"os"
+)
+
+const keyLogWarning = "TLS KEY LOGGING IS ENABLED: the traffic can be decrypted by anyone reading the key log"
+
+// OpenKeyLogFile opens path for appending the TLS secrets in the NSS key log
+// format, understood by Wireshark, creating it if needed. See
+// Dialer.KeyLogWriter and WithKeyLog.
+//
+// Anyone who can read the file can decrypt the captured traffic.
+func OpenKeyLogFile(path string) (io.WriteCloser, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+}
+
+// KeyLogFromEnvironment opens the key log file named by the SSLKEYLOGFILE
+// environment variable, as browsers and curl do. It returns nil if the
+// variable is not set.
+func KeyLogFromEnvironment() (io.WriteCloser, error) {
+	path := os.Getenv("SSLKEYLOGFILE")
+	if path == "" {
+		return nil, nil
+	}
+	return OpenKeyLogFile(path)
+}
+
+// keyLogLogger returns the logger of the key log warnings. They are never
+// discarded: slog.Default() is used when no logger is configured.
+func keyLogLogger(logger *slog.Logger) *slog.Logger {
+	if logger == nil || logger == discardLogger {
+		return slog.Default()
+	}
+	return logger
+}
+
+// setKeyLog sets the key log writer of cfg to w, if not nil, and warns when
+// the secrets of cfg are logged.
+func setKeyLog(cfg *tls.Config, w io.Writer, logger *slog.Logger) {
+	if w != nil {
+		cfg.KeyLogWriter = w
+	}
+	if cfg.KeyLogWriter != nil {
+		keyLogLogger(logger).Warn(keyLogWarning, "server_name", cfg.ServerName)
+	}
+}
+
+// WithKeyLog returns a copy of the server TLS configuration cfg logging
+// the TLS secrets to w, for example a file returned by OpenKeyLogFile, to
+// decrypt the captured traffic with Wireshark. It logs a warning to logger,
+// or slog.Default() if nil, for each handshake.
+//
+// It must only be used to debug.
+func WithKeyLog(cfg *tls.Config, w io.Writer, logger *slog.Logger) *tls.Config {
+	logger = keyLogLogger(logger)
+	cfg = cloneTLSConfig(cfg)
+	cfg.KeyLogWriter = w
+	getConfigForClient := cfg.GetConfigForClient
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		logger.Warn(keyLogWarning, "server_name", hello.ServerName, "remote_addr", hello.Conn.RemoteAddr().String())
+		if getConfigForClient == nil {
+			return nil, nil
+		}
+		clientCfg, err := getConfigForClient(hello)
+		if clientCfg != nil {
+			clientCfg = clientCfg.Clone()
+			clientCfg.KeyLogWriter = w
+		}
+		return clientCfg, err
+	}
+	logger.Warn(keyLogWarning)
+	return cfg
+}
@@ -0,0 +1,167 @@
+package httptunnel
+
+import (
+	"crypto/tls"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// countKeyLogWarnings returns the number of key log warnings in out.
+func countKeyLogWarnings(t *testing.T, out *syncBuffer) int {
+	n := 0
+	for _, record := range out.records(t) {
+		if record["level"] == "WARN" && record["msg"] == keyLogWarning {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDialKeyLog(t *testing.T) {
+	s := newTLSServer(t)
+	defer s.Close()
+
+	var keyLog, out syncBuffer
+	d := testDialer
+	d.TLSClientConfig = &tls.Config{RootCAs: rootCAs(t, s.Server)}
+	d.KeyLogWriter = &keyLog
+	d.Logger = slog.New(slog.NewJSONHandler(&out, nil))
+	conn, _, resp, err := d.Dial(s.URL, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	sendRecv(conn, resp, t)
+
+	if !strings.Contains(keyLog.buf.String(), "CLIENT_TRAFFIC_SECRET_0 ") {
+		t.Errorf("expected the secrets in the key log, got: %q", keyLog.buf.String())
+	}
+	if n := countKeyLogWarnings(t, &out); n != 1 {
+		t.Errorf("expected 1 warning, got: %v", n)
+	}
+}
+
+func TestHTTPSProxyKeyLog(t *testing.T) {
+	s := newTLSServer(t)
+	defer s.Close()
+	origHandler := s.Server.Config.Handler
+	s.Server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		origHandler.ServeHTTP(w, r)
+	})
+	surl, _ := url.Parse(s.Server.URL)
+
+	var keyLog, out syncBuffer
+	d := testDialer
+	d.Proxy = http.ProxyURL(&url.URL{Scheme: "https", Host: surl.Host})
+	d.ProxyTLSClientConfig = &tls.Config{RootCAs: rootCAs(t, s.Server)}
+	d.KeyLogWriter = &keyLog
+	d.Logger = slog.New(slog.NewJSONHandler(&out, nil))
+	conn, _, resp, err := d.Dial("http://tunnel.example"+testRequestURI, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	sendRecv(conn, resp, t)
+
+	if !strings.Contains(keyLog.buf.String(), "CLIENT_TRAFFIC_SECRET_0 ") {
+		t.Errorf("expected the secrets of the proxy connection in the key log")
+	}
+	if n := countKeyLogWarnings(t, &out); n != 1 {
+		t.Errorf("expected 1 warning, got: %v", n)
+	}
+}
+
+func TestWithKeyLog(t *testing.T) {
+	ca, err := NewDevCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ca.ServerTLSConfig("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyLog, out syncBuffer
+	var s mockServer
+	s.Server = httptest.NewUnstartedServer(testHandler{T: t, s: &s, hijacker: testHijacker})
+	s.Server.TLS = WithKeyLog(cfg, &keyLog, slog.New(slog.NewJSONHandler(&out, nil)))
+	s.Server.StartTLS()
+	s.Server.URL += testRequestURI
+	s.URL = s.Server.URL
+	defer s.Close()
+
+	d := testDialer
+	d.TLSClientConfig = ca.ClientTLSConfig()
+	conn, _, resp, err := d.Dial(s.URL, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	sendRecv(conn, resp, t)
+
+	if !strings.Contains(keyLog.buf.String(), "SERVER_TRAFFIC_SECRET_0 ") {
+		t.Errorf("expected the secrets in the key log")
+	}
+	// One warning when enabled and one for the handshake
+	if n := countKeyLogWarnings(t, &out); n != 2 {
+		t.Errorf("expected 2 warnings, got: %v", n)
+	}
+}
+
+func TestKeyLogDefaultLogger(t *testing.T) {
+	var out syncBuffer
+	// slog.SetDefault redirects the log package as well
+	defer log.SetFlags(log.Flags())
+	defer log.SetOutput(log.Writer())
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&out, nil)))
+
+	s := newTLSServer(t)
+	defer s.Close()
+	var keyLog syncBuffer
+	d := testDialer
+	d.TLSClientConfig = &tls.Config{RootCAs: rootCAs(t, s.Server)}
+	d.KeyLogWriter = &keyLog
+	conn, _, resp, err := d.Dial(s.URL, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	sendRecv(conn, resp, t)
+	if n := countKeyLogWarnings(t, &out); n != 1 {
+		t.Errorf("expected 1 warning, got: %v", n)
+	}
+
+	WithKeyLog(&tls.Config{}, &keyLog, nil)
+	if n := countKeyLogWarnings(t, &out); n != 2 {
+		t.Errorf("expected 2 warnings, got: %v", n)
+	}
+}
+
+func TestKeyLogFromEnvironment(t *testing.T) {
+	t.Setenv("SSLKEYLOGFILE", "")
+	if w, err := KeyLogFromEnvironment(); w != nil || err != nil {
+		t.Errorf("expected no key log, got: %v, %v", w, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "keys.log")
+	t.Setenv("SSLKEYLOGFILE", path)
+	w, err := KeyLogFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("expected a private key log file, got: %v, %v", info, err)
+	}
+}
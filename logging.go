@@ -0,0 +1,62 @@
+package httptunnel
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// discardLogger is used when no logger is configured so that logging calls do
+// not need to be guarded.
+var discardLogger = slog.New(discardHandler{})
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// newTunnelID returns a random identifier used to correlate the records and
+// events of a single tunnel.
+func newTunnelID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// sensitiveHeaders are replaced by redactHeader.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"Set-Cookie",
+}
+
+// redactHeader returns a copy of h that is safe to log. The header names
+// are compared case-insensitively, as h may not be canonicalized.
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for k := range h {
+		for _, sensitive := range sensitiveHeaders {
+			if strings.EqualFold(k, sensitive) {
+				h[k] = []string{"REDACTED"}
+			}
+		}
+	}
+	return h
+}
+
+// redactURL returns the url s with its password redacted, so that it is
+// safe to log and export. An invalid url is redacted entirely.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "REDACTED"
+	}
+	return u.Redacted()
+}
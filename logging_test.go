@@ -0,0 +1,137 @@
+package httptunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) records(t *testing.T) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("bad log record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestDialLogging(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	surl, _ := url.Parse(s.Server.URL)
+	surl.User = url.UserPassword("username", "secret-password")
+
+	var out syncBuffer
+	spans := &spanCollector{}
+	d := testDialer
+	d.Proxy = http.ProxyURL(surl)
+	d.Logger = slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	d.SpanExporter = spans
+
+	origHandler := s.Server.Config.Handler
+	s.Server.Config.Handler = http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodConnect {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			origHandler.ServeHTTP(w, r)
+		})
+
+	tunnelURL, _ := url.Parse(s.URL)
+	tunnelURL.User = url.UserPassword("username", "tunnel-password")
+	conn, _, resp, err := d.Dial(tunnelURL.String(), testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	sendRecv(conn, resp, t)
+	conn.Close()
+
+	for _, secret := range []string{"secret-password", "tunnel-password"} {
+		if strings.Contains(out.buf.String(), secret) {
+			t.Errorf("credentials were logged: %v", out.buf.String())
+		}
+		if len(spans.spans) != 1 || strings.Contains(spans.spans[0].Attributes["url"], secret) {
+			t.Errorf("credentials were exported: %v", spans.spans)
+		}
+	}
+	expected := []string{
+		"proxy connect",
+		"proxy connect response",
+		"upgrade response",
+		"tunnel opened",
+		"tunnel closed",
+	}
+	records := out.records(t)
+	if len(records) != len(expected) {
+		t.Fatalf("expected %v records, got: %v", len(expected), records)
+	}
+	id := conn.(*Conn).ID()
+	for i, record := range records {
+		if record["msg"] != expected[i] {
+			t.Errorf("expected message %q, got: %v", expected[i], record["msg"])
+		}
+		if record["tunnel_id"] != id {
+			t.Errorf("expected tunnel_id %v, got: %v", id, record["tunnel_id"])
+		}
+	}
+}
+
+func TestHijackLogging(t *testing.T) {
+	var out syncBuffer
+	hijacker := Hijacker{Logger: slog.New(slog.NewJSONHandler(&out, nil))}
+	r, _ := http.NewRequest(http.MethodGet, "http://test.com/", nil)
+	r.Header.Set("Origin", "http://not-test.com/")
+	if _, _, err := hijacker.Hijack(nil, r); err != ErrBadOrigin {
+		t.Fatalf("expected %v, got: %v", ErrBadOrigin, err)
+	}
+	records := out.records(t)
+	if len(records) != 2 || records[0]["msg"] != "origin rejected" {
+		t.Fatalf("expected origin rejection to be logged, got: %v", records)
+	}
+	if records[0]["side"] != "server" {
+		t.Errorf("expected side server, got: %v", records[0]["side"])
+	}
+}
+
+func TestRedactHeader(t *testing.T) {
+	h := http.Header{}
+	h.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	h.Set("User-Agent", "test")
+	h["cookie"] = []string{"session=secret"}
+	redacted := redactHeader(h)
+	if v := redacted["cookie"]; len(v) != 1 || v[0] != "REDACTED" {
+		t.Errorf("expected the non-canonical cookie header to be redacted, got: %v", v)
+	}
+	if v := redacted.Get("Proxy-Authorization"); v != "REDACTED" {
+		t.Errorf("expected Proxy-Authorization to be redacted, got: %v", v)
+	}
+	if v := redacted.Get("User-Agent"); v != "test" {
+		t.Errorf("expected User-Agent to be kept, got: %v", v)
+	}
+	if v := h.Get("Proxy-Authorization"); v != "Basic c2VjcmV0" {
+		t.Errorf("expected original header to be unchanged, got: %v", v)
+	}
+}
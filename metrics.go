@@ -0,0 +1,254 @@
+package httptunnel
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+type handshakeOutcome int
+
+const (
+	outcomeSuccess handshakeOutcome = iota
+	// The request was refused by the Hijacker, for example by the origin check
+	outcomeRejected
+	outcomeError
+	numOutcomes
+)
+
+var outcomeNames = [numOutcomes]string{"success", "rejected", "error"}
+
+var (
+	handshakeBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	tunnelBuckets    = []float64{1, 5, 15, 60, 300, 900, 3600, 14400, 86400}
+)
+
+// Metrics collects counters and histograms about tunnel handshakes and
+// traffic. The zero value is ready to use. A single Metrics may be shared by
+// any number of Dialers and Hijackers; values are labelled by Side.
+//
+// Metrics implements http.Handler, serving the Prometheus text exposition
+// format, and expvar.Var, so it can be published with expvar.Publish.
+//
+// It is safe to call Metrics' methods concurrently. All methods are no-ops
+// on a nil *Metrics.
+type Metrics struct {
+	sides [2]sideMetrics
+}
+
+type sideMetrics struct {
+	handshakes       [numOutcomes]atomic.Uint64
+	handshakeSeconds histogram
+	activeTunnels    atomic.Int64
+	bytesReceived    atomic.Uint64
+	bytesSent        atomic.Uint64
+	tunnelSeconds    histogram
+}
+
+// histogram is a cumulative histogram with at most 15 buckets. The bucket
+// bounds are supplied by the caller so that the zero value is usable.
+type histogram struct {
+	counts [16]atomic.Uint64
+	count  atomic.Uint64
+	sum    atomic.Uint64 // float64 bits
+}
+
+func (h *histogram) observe(bounds []float64, v float64) {
+	i := 0
+	for i < len(bounds) && v > bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if h.sum.CompareAndSwap(old, sum) {
+			return
+		}
+	}
+}
+
+func (h *histogram) total() (count uint64, sum float64) {
+	return h.count.Load(), math.Float64frombits(h.sum.Load())
+}
+
+func (m *Metrics) side(s Side) *sideMetrics {
+	return &m.sides[s]
+}
+
+func (m *Metrics) handshakeDone(s Side, outcome handshakeOutcome, d time.Duration) {
+	if m == nil {
+		return
+	}
+	sm := m.side(s)
+	sm.handshakes[outcome].Add(1)
+	sm.handshakeSeconds.observe(handshakeBuckets, d.Seconds())
+}
+
+func (m *Metrics) tunnelOpened(s Side) {
+	if m == nil {
+		return
+	}
+	m.side(s).activeTunnels.Add(1)
+}
+
+func (m *Metrics) tunnelClosed(s Side, d time.Duration) {
+	if m == nil {
+		return
+	}
+	sm := m.side(s)
+	sm.activeTunnels.Add(-1)
+	sm.tunnelSeconds.observe(tunnelBuckets, d.Seconds())
+}
+
+func (m *Metrics) bytesReceived(s Side, n int) {
+	if m == nil {
+		return
+	}
+	m.side(s).bytesReceived.Add(uint64(n))
+}
+
+func (m *Metrics) bytesSent(s Side, n int) {
+	if m == nil {
+		return
+	}
+	m.side(s).bytesSent.Add(uint64(n))
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = m.WritePrometheus(w)
+}
+
+// WritePrometheus writes the metrics to w in the Prometheus text exposition
+// format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	if m == nil {
+		return nil
+	}
+	p := promWriter{w: w}
+	sides := [...]Side{SideClient, SideServer}
+
+	p.header("httptunnel_handshakes_total", "counter", "Tunnel handshakes by outcome.")
+	for _, s := range sides {
+		for o, name := range outcomeNames {
+			p.sample("httptunnel_handshakes_total", labels(s, "outcome", name), m.side(s).handshakes[o].Load())
+		}
+	}
+	p.header("httptunnel_handshake_duration_seconds", "histogram", "Time taken by tunnel handshakes.")
+	for _, s := range sides {
+		p.histogram("httptunnel_handshake_duration_seconds", s, handshakeBuckets, &m.side(s).handshakeSeconds)
+	}
+	p.header("httptunnel_active_tunnels", "gauge", "Tunnels currently open.")
+	for _, s := range sides {
+		p.sample("httptunnel_active_tunnels", labels(s), m.side(s).activeTunnels.Load())
+	}
+	p.header("httptunnel_received_bytes_total", "counter", "Bytes read from tunnel connections.")
+	for _, s := range sides {
+		p.sample("httptunnel_received_bytes_total", labels(s), m.side(s).bytesReceived.Load())
+	}
+	p.header("httptunnel_sent_bytes_total", "counter", "Bytes written to tunnel connections.")
+	for _, s := range sides {
+		p.sample("httptunnel_sent_bytes_total", labels(s), m.side(s).bytesSent.Load())
+	}
+	p.header("httptunnel_tunnel_duration_seconds", "histogram", "Lifetime of closed tunnels.")
+	for _, s := range sides {
+		p.histogram("httptunnel_tunnel_duration_seconds", s, tunnelBuckets, &m.side(s).tunnelSeconds)
+	}
+	return p.err
+}
+
+// String returns the metrics as a JSON object, implementing expvar.Var.
+func (m *Metrics) String() string {
+	if m == nil {
+		return "null"
+	}
+	type histogramJSON struct {
+		Count uint64  `json:"count"`
+		Sum   float64 `json:"sum"`
+	}
+	type sideJSON struct {
+		Handshakes       map[string]uint64 `json:"handshakes"`
+		HandshakeSeconds histogramJSON     `json:"handshake_seconds"`
+		ActiveTunnels    int64             `json:"active_tunnels"`
+		BytesReceived    uint64            `json:"bytes_received"`
+		BytesSent        uint64            `json:"bytes_sent"`
+		TunnelSeconds    histogramJSON     `json:"tunnel_seconds"`
+	}
+	out := make(map[string]sideJSON, len(m.sides))
+	for _, s := range [...]Side{SideClient, SideServer} {
+		sm := m.side(s)
+		v := sideJSON{
+			Handshakes:    make(map[string]uint64, numOutcomes),
+			ActiveTunnels: sm.activeTunnels.Load(),
+			BytesReceived: sm.bytesReceived.Load(),
+			BytesSent:     sm.bytesSent.Load(),
+		}
+		for o, name := range outcomeNames {
+			v.Handshakes[name] = sm.handshakes[o].Load()
+		}
+		v.HandshakeSeconds.Count, v.HandshakeSeconds.Sum = sm.handshakeSeconds.total()
+		v.TunnelSeconds.Count, v.TunnelSeconds.Sum = sm.tunnelSeconds.total()
+		out[s.String()] = v
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		return "null"
+	}
+	return string(b)
+}
+
+// Publish registers m with the expvar package under name. Like
+// expvar.Publish, it panics if name is already registered.
+func (m *Metrics) Publish(name string) {
+	expvar.Publish(name, m)
+}
+
+func labels(s Side, kv ...string) string {
+	l := `side="` + s.String() + `"`
+	for i := 0; i+1 < len(kv); i += 2 {
+		l += `,` + kv[i] + `="` + kv[i+1] + `"`
+	}
+	return l
+}
+
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *promWriter) printf(format string, args ...any) {
+	if p.err != nil {
+		return
+	}
+	_, p.err = fmt.Fprintf(p.w, format, args...)
+}
+
+func (p *promWriter) header(name, typ, help string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *promWriter) sample(name, labels string, v any) {
+	p.printf("%s{%s} %v\n", name, labels, v)
+}
+
+func (p *promWriter) histogram(name string, s Side, bounds []float64, h *histogram) {
+	var cumulative uint64
+	for i, b := range bounds {
+		cumulative += h.counts[i].Load()
+		le := strconv.FormatFloat(b, 'g', -1, 64)
+		p.sample(name+"_bucket", labels(s, "le", le), cumulative)
+	}
+	count, sum := h.total()
+	p.sample(name+"_bucket", labels(s, "le", "+Inf"), count)
+	p.sample(name+"_sum", labels(s), strconv.FormatFloat(sum, 'g', -1, 64))
+	p.sample(name+"_count", labels(s), count)
+}
@@ -0,0 +1,127 @@
+package httptunnel
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	m := &Metrics{}
+	s := newServerHijacker(t, &Hijacker{Metrics: m})
+
+	d := testDialer
+	d.Metrics = m
+	conn, _, resp, err := d.Dial(s.URL, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	sendRecv(conn, resp, t)
+	if active := m.side(SideClient).activeTunnels.Load(); active != 1 {
+		t.Errorf("expected 1 active client tunnel, got: %v", active)
+	}
+	conn.Close()
+	s.Close()
+
+	for _, side := range []Side{SideClient, SideServer} {
+		sm := m.side(side)
+		if n := sm.handshakes[outcomeSuccess].Load(); n != 1 {
+			t.Errorf("%v: expected 1 successful handshake, got: %v", side, n)
+		}
+		if active := sm.activeTunnels.Load(); active != 0 {
+			t.Errorf("%v: expected 0 active tunnels, got: %v", side, active)
+		}
+		if count, _ := sm.tunnelSeconds.total(); count != 1 {
+			t.Errorf("%v: expected 1 tunnel duration, got: %v", side, count)
+		}
+		if sm.bytesReceived.Load() == 0 || sm.bytesSent.Load() == 0 {
+			t.Errorf("%v: expected bytes to be counted", side)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE httptunnel_handshakes_total counter",
+		`httptunnel_handshakes_total{side="client",outcome="success"} 1`,
+		`httptunnel_handshakes_total{side="server",outcome="success"} 1`,
+		`httptunnel_active_tunnels{side="server"} 0`,
+		`httptunnel_tunnel_duration_seconds_bucket{side="client",le="+Inf"} 1`,
+		`httptunnel_handshake_duration_seconds_count{side="server"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%v", line, body)
+		}
+	}
+
+	var vars map[string]map[string]any
+	if err := json.Unmarshal([]byte(m.String()), &vars); err != nil {
+		t.Fatalf("String: %v", err)
+	}
+	if _, ok := vars["server"]["bytes_sent"]; !ok {
+		t.Errorf("expected server bytes_sent in %v", vars)
+	}
+}
+
+func TestMetricsRejected(t *testing.T) {
+	m := &Metrics{}
+	hijacker := Hijacker{Metrics: m}
+	r := httptest.NewRequest(http.MethodGet, "http://test.com/", nil)
+	r.Header.Set("Origin", "http://not-test.com/")
+	if _, _, err := hijacker.Hijack(httptest.NewRecorder(), r); err != ErrBadOrigin {
+		t.Fatalf("expected %v, got: %v", ErrBadOrigin, err)
+	}
+	if n := m.side(SideServer).handshakes[outcomeRejected].Load(); n != 1 {
+		t.Errorf("expected 1 rejected handshake, got: %v", n)
+	}
+}
+
+func TestMetricsRejectedUpgrade(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer s.Close()
+
+	m := &Metrics{}
+	o := &recordingObserver{}
+	d := testDialer
+	d.Metrics = m
+	d.Observer = o
+	conn, _, resp, err := d.Dial(s.URL, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got: %v", resp.Status)
+	}
+	conn.Close()
+
+	sm := m.side(SideClient)
+	if n := sm.handshakes[outcomeRejected].Load(); n != 1 {
+		t.Errorf("expected 1 rejected handshake, got: %v", n)
+	}
+	if n := sm.handshakes[outcomeSuccess].Load(); n != 0 {
+		t.Errorf("expected no successful handshake, got: %v", n)
+	}
+	if active := sm.activeTunnels.Load(); active != 0 {
+		t.Errorf("expected no active tunnel, got: %v", active)
+	}
+	if count, _ := sm.tunnelSeconds.total(); count != 0 {
+		t.Errorf("expected no tunnel duration, got: %v", count)
+	}
+	if len(o.events) != 2 || o.events[1] != "fail client" {
+		t.Errorf("expected a failed handshake and no tunnel, got: %v", o.events)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.handshakeDone(SideClient, outcomeSuccess, 0)
+	m.tunnelOpened(SideClient)
+	if err := m.WritePrometheus(&strings.Builder{}); err != nil {
+		t.Fatal(err)
+	}
+}
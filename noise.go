@@ -0,0 +1,439 @@
+package httptunnel
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	encryptionHeader = "Tunnel-Encryption"
+	// noiseProtocol is the Noise protocol name, which is also the value of
+	// the Tunnel-Encryption header.
+	noiseProtocol = "Noise_IK_25519_ChaChaPoly_SHA256"
+	noisePrologue = "httptunnel"
+
+	noiseKeyLen = 32
+	noiseTagLen = 16
+	// noiseMaxMessage is the maximum size of a Noise message.
+	noiseMaxMessage = 65535
+
+	// noiseHandshakeTimeout bounds the Noise handshake on the server.
+	noiseHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	// ErrEncryptionRequired is returned by Upgrade when the Hijacker
+	// requires Noise encryption and the client did not request it, and by
+	// the Dialer when the server did not accept it.
+	ErrEncryptionRequired = errors.New("httptunnel: tunnel encryption required")
+
+	// ErrUnknownPeerKey is returned when the static key of the peer of a
+	// Noise handshake is not allowed.
+	ErrUnknownPeerKey = errors.New("httptunnel: unknown noise static key")
+)
+
+// NoiseConfig configures the encryption of the tunnel payload with the
+// Noise protocol Noise_IK_25519_ChaChaPoly_SHA256, on top of the TLS
+// connection, if any. Only the Dialer and the Hijacker holding the static
+// keys can read the traffic, even when TLS is terminated by a load balancer
+// or CDN in front of the server.
+//
+// The encryption is requested by the Dialer with the Tunnel-Encryption
+// header and the handshake takes place right after the 101 response. The
+// Dialer must know the static public key of the server in advance; the
+// server learns the static key of the client from the handshake.
+type NoiseConfig struct {
+	// StaticKey is the X25519 static key of this end of the tunnel, for
+	// example generated with ecdh.X25519().GenerateKey(rand.Reader).
+	StaticKey *ecdh.PrivateKey
+
+	// ServerKey is the static public key of the server. It is required
+	// for a Dialer.
+	ServerKey *ecdh.PublicKey
+
+	// ClientKeys are the static public keys of the clients allowed by a
+	// Hijacker. If empty, any client is allowed; see Conn.NoisePeerKey.
+	ClientKeys []*ecdh.PublicKey
+}
+
+// noiseCipher is the CipherState of the Noise specification.
+type noiseCipher struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func newNoiseCipher(key []byte) *noiseCipher {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		panic(err) // The key size is always valid
+	}
+	return &noiseCipher{aead: aead}
+}
+
+func (c *noiseCipher) nonceBytes() []byte {
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], c.nonce)
+	return nonce[:]
+}
+
+func (c *noiseCipher) encrypt(dst, ad, plaintext []byte) ([]byte, error) {
+	if c.nonce == ^uint64(0) {
+		return nil, errors.New("httptunnel: noise nonce exhausted")
+	}
+	dst = c.aead.Seal(dst, c.nonceBytes(), plaintext, ad)
+	c.nonce++
+	return dst, nil
+}
+
+func (c *noiseCipher) decrypt(dst, ad, ciphertext []byte) ([]byte, error) {
+	if c.nonce == ^uint64(0) {
+		return nil, errors.New("httptunnel: noise nonce exhausted")
+	}
+	dst, err := c.aead.Open(dst, c.nonceBytes(), ciphertext, ad)
+	if err != nil {
+		return nil, errors.New("httptunnel: noise message authentication failed")
+	}
+	c.nonce++
+	return dst, nil
+}
+
+// noiseSymmetric is the SymmetricState of the Noise specification.
+type noiseSymmetric struct {
+	ck, h  []byte
+	cipher *noiseCipher
+}
+
+func newNoiseSymmetric() *noiseSymmetric {
+	// The protocol name is exactly HASHLEN bytes long
+	h := []byte(noiseProtocol)
+	s := &noiseSymmetric{ck: h, h: h}
+	s.mixHash([]byte(noisePrologue))
+	return s
+}
+
+func (s *noiseSymmetric) mixHash(data []byte) {
+	sum := sha256.New()
+	sum.Write(s.h)
+	sum.Write(data)
+	s.h = sum.Sum(nil)
+}
+
+func (s *noiseSymmetric) mixKey(ikm []byte) {
+	var key []byte
+	s.ck, key = noiseHKDF(s.ck, ikm)
+	s.cipher = newNoiseCipher(key)
+}
+
+func (s *noiseSymmetric) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext, err := s.cipher.encrypt(nil, s.h, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (s *noiseSymmetric) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := s.cipher.decrypt(nil, s.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the ciphers of the initiator and of the responder.
+func (s *noiseSymmetric) split() (*noiseCipher, *noiseCipher) {
+	k1, k2 := noiseHKDF(s.ck, nil)
+	return newNoiseCipher(k1), newNoiseCipher(k2)
+}
+
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{1})
+	out1 := mac.Sum(nil)
+	mac.Reset()
+	mac.Write(out1)
+	mac.Write([]byte{2})
+	return out1, mac.Sum(nil)
+}
+
+func noiseDH(key *ecdh.PrivateKey, peer *ecdh.PublicKey) ([]byte, error) {
+	secret, err := key.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("httptunnel: noise: %w", err)
+	}
+	return secret, nil
+}
+
+func writeNoiseMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readNoiseMessage(r io.Reader, buf []byte) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// noiseDeadline sets the deadline of conn for a handshake bounded by ctx
+// and returns a function restoring it.
+func noiseDeadline(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	return func() {
+		stop()
+		_ = conn.SetDeadline(time.Time{})
+	}
+}
+
+// initiate runs the handshake of the Dialer over conn.
+func (cfg *NoiseConfig) initiate(ctx context.Context, conn net.Conn) (*noiseConn, error) {
+	if cfg.StaticKey == nil || cfg.ServerKey == nil {
+		return nil, errors.New("httptunnel: noise static key and server key are required")
+	}
+	defer noiseDeadline(ctx, conn)()
+
+	s := newNoiseSymmetric()
+	s.mixHash(cfg.ServerKey.Bytes())
+
+	// -> e, es, s, ss
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	msg := append([]byte(nil), e.PublicKey().Bytes()...)
+	s.mixHash(e.PublicKey().Bytes())
+	dh, err := noiseDH(e, cfg.ServerKey)
+	if err != nil {
+		return nil, err
+	}
+	s.mixKey(dh)
+	encrypted, err := s.encryptAndHash(cfg.StaticKey.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	msg = append(msg, encrypted...)
+	if dh, err = noiseDH(cfg.StaticKey, cfg.ServerKey); err != nil {
+		return nil, err
+	}
+	s.mixKey(dh)
+	if encrypted, err = s.encryptAndHash(nil); err != nil {
+		return nil, err
+	}
+	msg = append(msg, encrypted...)
+	if err := writeNoiseMessage(conn, msg); err != nil {
+		return nil, err
+	}
+
+	// <- e, ee, se
+	if msg, err = readNoiseMessage(conn, nil); err != nil {
+		return nil, err
+	}
+	if len(msg) != noiseKeyLen+noiseTagLen {
+		return nil, errors.New("httptunnel: malformed noise handshake message")
+	}
+	re, err := ecdh.X25519().NewPublicKey(msg[:noiseKeyLen])
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(re.Bytes())
+	if dh, err = noiseDH(e, re); err != nil {
+		return nil, err
+	}
+	s.mixKey(dh)
+	if dh, err = noiseDH(cfg.StaticKey, re); err != nil {
+		return nil, err
+	}
+	s.mixKey(dh)
+	if _, err := s.decryptAndHash(msg[noiseKeyLen:]); err != nil {
+		return nil, err
+	}
+
+	send, recv := s.split()
+	return &noiseConn{Conn: conn, send: send, recv: recv, peer: cfg.ServerKey}, nil
+}
+
+// respond runs the handshake of the Hijacker over conn.
+func (cfg *NoiseConfig) respond(ctx context.Context, conn net.Conn) (*noiseConn, error) {
+	if cfg.StaticKey == nil {
+		return nil, errors.New("httptunnel: noise static key is required")
+	}
+	defer noiseDeadline(ctx, conn)()
+
+	s := newNoiseSymmetric()
+	s.mixHash(cfg.StaticKey.PublicKey().Bytes())
+
+	// -> e, es, s, ss
+	msg, err := readNoiseMessage(conn, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) != noiseKeyLen+noiseKeyLen+noiseTagLen+noiseTagLen {
+		return nil, errors.New("httptunnel: malformed noise handshake message")
+	}
+	re, err := ecdh.X25519().NewPublicKey(msg[:noiseKeyLen])
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(re.Bytes())
+	dh, err := noiseDH(cfg.StaticKey, re)
+	if err != nil {
+		return nil, err
+	}
+	s.mixKey(dh)
+	decrypted, err := s.decryptAndHash(msg[noiseKeyLen : 2*noiseKeyLen+noiseTagLen])
+	if err != nil {
+		return nil, err
+	}
+	rs, err := ecdh.X25519().NewPublicKey(decrypted)
+	if err != nil {
+		return nil, err
+	}
+	if dh, err = noiseDH(cfg.StaticKey, rs); err != nil {
+		return nil, err
+	}
+	s.mixKey(dh)
+	if _, err := s.decryptAndHash(msg[2*noiseKeyLen+noiseTagLen:]); err != nil {
+		return nil, err
+	}
+	if len(cfg.ClientKeys) > 0 {
+		allowed := false
+		for _, key := range cfg.ClientKeys {
+			if key.Equal(rs) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, ErrUnknownPeerKey
+		}
+	}
+
+	// <- e, ee, se
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	msg = append([]byte(nil), e.PublicKey().Bytes()...)
+	s.mixHash(e.PublicKey().Bytes())
+	if dh, err = noiseDH(e, re); err != nil {
+		return nil, err
+	}
+	s.mixKey(dh)
+	if dh, err = noiseDH(e, rs); err != nil {
+		return nil, err
+	}
+	s.mixKey(dh)
+	encrypted, err := s.encryptAndHash(nil)
+	if err != nil {
+		return nil, err
+	}
+	msg = append(msg, encrypted...)
+	if err := writeNoiseMessage(conn, msg); err != nil {
+		return nil, err
+	}
+
+	recv, send := s.split()
+	return &noiseConn{Conn: conn, send: send, recv: recv, peer: rs}, nil
+}
+
+// noiseConn encrypts the traffic of a tunnel with the ciphers resulting
+// from a Noise handshake. Each write is sent in one or more transport
+// messages.
+type noiseConn struct {
+	net.Conn
+	peer *ecdh.PublicKey
+
+	readMu  sync.Mutex
+	recv    *noiseCipher
+	readBuf []byte
+	pending []byte // decrypted and not yet read
+
+	writeMu  sync.Mutex
+	send     *noiseCipher
+	writeBuf []byte
+}
+
+func (c *noiseConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.pending) == 0 {
+		msg, err := readNoiseMessage(c.Conn, c.readBuf)
+		if err != nil {
+			return 0, err
+		}
+		c.readBuf = msg
+		if c.pending, err = c.recv.decrypt(msg[:0], nil, msg); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *noiseConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), noiseMaxMessage-noiseTagLen)]
+		buf := append(c.writeBuf[:0], 0, 0)
+		buf, err := c.send.encrypt(buf, nil, chunk)
+		if err != nil {
+			return written, err
+		}
+		c.writeBuf = buf
+		binary.BigEndian.PutUint16(buf, uint16(len(buf)-2))
+		if _, err := c.Conn.Write(buf); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *noiseConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,194 @@
+package httptunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newNoiseKey(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// newNoiseServer returns a server echoing the tunnels upgraded by hijacker.
+// The errors of Upgrade are sent to errs, if not nil.
+func newNoiseServer(t *testing.T, hijacker Hijacker, errs chan<- error) *mockServer {
+	s := newServer(t)
+	s.Server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.wg.Add(1)
+		defer s.wg.Done()
+		conn, _, err := hijacker.Upgrade(w, r, nil)
+		if err != nil {
+			if errs != nil {
+				errs <- err
+			}
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	})
+	return s
+}
+
+// recordingConn records the bytes written to the connection.
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(p)
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func TestNoise(t *testing.T) {
+	serverKey, clientKey := newNoiseKey(t), newNoiseKey(t)
+	s := newNoiseServer(t, Hijacker{Noise: &NoiseConfig{
+		StaticKey:  serverKey,
+		ClientKeys: []*ecdh.PublicKey{clientKey.PublicKey()},
+	}}, nil)
+	defer s.Close()
+
+	var recorded *recordingConn
+	d := testDialer
+	d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		recorded = &recordingConn{Conn: conn}
+		return recorded, nil
+	}
+	d.Noise = &NoiseConfig{StaticKey: clientKey, ServerKey: serverKey.PublicKey()}
+	conn, _, resp, err := d.Dial(s.URL, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status 101, got: %v", resp.Status)
+	}
+	if key := conn.(*Conn).NoisePeerKey(); !key.Equal(serverKey.PublicKey()) {
+		t.Errorf("expected the server key, got: %v", key)
+	}
+
+	const secret = "the secret message"
+	echo(t, conn, secret)
+	// Larger than a Noise message
+	echo(t, conn, strings.Repeat("x", 3*noiseMaxMessage))
+
+	recorded.mu.Lock()
+	defer recorded.mu.Unlock()
+	if bytes.Contains(recorded.written.Bytes(), []byte(secret)) {
+		t.Error("expected the payload to be encrypted on the wire")
+	}
+}
+
+func TestNoiseErrors(t *testing.T) {
+	serverKey, clientKey := newNoiseKey(t), newNoiseKey(t)
+	errs := make(chan error, 1)
+	s := newNoiseServer(t, Hijacker{Noise: &NoiseConfig{
+		StaticKey:  serverKey,
+		ClientKeys: []*ecdh.PublicKey{clientKey.PublicKey()},
+	}}, errs)
+	defer s.Close()
+
+	t.Run("not requested", func(t *testing.T) {
+		d := testDialer
+		conn, _, resp, err := d.Dial(s.URL, nil)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		conn.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status 403, got: %v", resp.Status)
+		}
+		if v := resp.Header.Get("Connection"); strings.EqualFold(v, "upgrade") {
+			t.Errorf("expected no upgrade headers, got: %v", resp.Header)
+		}
+		if err := <-errs; !errors.Is(err, ErrEncryptionRequired) {
+			t.Errorf("expected ErrEncryptionRequired, got: %v", err)
+		}
+	})
+
+	t.Run("wrong server key", func(t *testing.T) {
+		d := testDialer
+		d.Noise = &NoiseConfig{StaticKey: clientKey, ServerKey: newNoiseKey(t).PublicKey()}
+		if _, _, _, err := d.Dial(s.URL, nil); err == nil {
+			t.Error("expected the handshake to fail")
+		}
+		if err := <-errs; err == nil {
+			t.Error("expected the server handshake to fail")
+		}
+	})
+
+	t.Run("unknown client key", func(t *testing.T) {
+		d := testDialer
+		d.Noise = &NoiseConfig{StaticKey: newNoiseKey(t), ServerKey: serverKey.PublicKey()}
+		if _, _, _, err := d.Dial(s.URL, nil); err == nil {
+			t.Error("expected the handshake to fail")
+		}
+		if err := <-errs; !errors.Is(err, ErrUnknownPeerKey) {
+			t.Errorf("expected ErrUnknownPeerKey, got: %v", err)
+		}
+	})
+
+	t.Run("not accepted", func(t *testing.T) {
+		plain := newNoiseServer(t, Hijacker{}, nil)
+		defer plain.Close()
+		d := testDialer
+		d.Noise = &NoiseConfig{StaticKey: clientKey, ServerKey: serverKey.PublicKey()}
+		_, _, _, err := d.Dial(plain.URL, nil)
+		if !errors.Is(err, ErrEncryptionRequired) {
+			t.Errorf("expected ErrEncryptionRequired, got: %v", err)
+		}
+	})
+}
+
+func TestNoiseResume(t *testing.T) {
+	serverKey, clientKey := newNoiseKey(t), newNoiseKey(t)
+	s := newNoiseServer(t, Hijacker{
+		Sessions: &SessionStore{},
+		Noise:    &NoiseConfig{StaticKey: serverKey},
+	}, nil)
+	defer s.Close()
+
+	u, _ := url.Parse(s.URL)
+	f := newForwarder(t, u.Host)
+	defer f.Close()
+	u.Host = f.l.Addr().String()
+
+	// The resumed tunnel keeps the ciphers of the first handshake
+	d := testDialer
+	d.Resume = &ResumeConfig{InitialBackoff: 10 * time.Millisecond}
+	d.Noise = &NoiseConfig{StaticKey: clientKey, ServerKey: serverKey.PublicKey()}
+	conn, _, _, err := d.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	echo(t, conn, "before")
+	f.breakAll()
+	echo(t, conn, "after the break")
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	s.Close()
+}
@@ -0,0 +1,186 @@
+package httptunnel
+
+import (
+	"log/slog"
+	"time"
+)
+
+// observerSampleInterval is the minimum time between two calls to
+// Observer.OnBytes for the same tunnel.
+const observerSampleInterval = time.Second
+
+// HandshakeInfo describes a tunnel handshake reported to an Observer.
+type HandshakeInfo struct {
+	Side Side
+	// ID is a random identifier of the tunnel, also returned by Conn.ID and
+	// attached to log records.
+	ID string
+	// URL is the url being dialed by a Dialer, with its password redacted,
+	// or the request URI received by a Hijacker
+	URL string
+	// RemoteAddr is the address of the client on the server side. It is
+	// empty on the client side.
+	RemoteAddr string
+	Start      time.Time
+}
+
+// ConnStats holds the traffic statistics of a tunnel.
+type ConnStats struct {
+	// Opened is the time the handshake completed.
+	Opened        time.Time
+	Duration      time.Duration
+	BytesReceived int64
+	BytesSent     int64
+}
+
+// CloseReason describes why a tunnel was closed.
+type CloseReason int
+
+const (
+	// CloseLocal means Close was called without any prior error.
+	CloseLocal CloseReason = iota
+	// ClosePeer means the peer closed the tunnel.
+	ClosePeer
+	// CloseError means a read or write failed before Close was called.
+	CloseError
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseLocal:
+		return "local"
+	case ClosePeer:
+		return "peer"
+	case CloseError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// An Observer is notified of the lifecycle events of tunnels. It can be set
+// on both Dialer and Hijacker.
+//
+// Methods are called synchronously from the goroutine that caused the event
+// and must not block. Embed NopObserver to implement only some of them.
+type Observer interface {
+	// OnHandshakeStart is called when a Dialer begins to dial or when a
+	// Hijacker begins to handle a request.
+	OnHandshakeStart(info HandshakeInfo)
+	// OnHandshakeDone is called when the handshake completes. err is nil
+	// if the handshake succeeded, in which case OnOpen follows unless the
+	// handshake resumed an existing tunnel.
+	OnHandshakeDone(info HandshakeInfo, err error)
+	// OnOpen is called with the tunnel connection once it is established.
+	OnOpen(conn *Conn)
+	// OnBytes is called with the running traffic totals of a tunnel as they
+	// change, at most once per second.
+	OnBytes(conn *Conn, stats ConnStats)
+	// OnError is called when a read or write on the tunnel fails for a
+	// reason other than a timeout, the peer closing the tunnel, or the
+	// tunnel having been closed.
+	OnError(conn *Conn, err error)
+	// OnClose is called once, when the tunnel is closed.
+	OnClose(conn *Conn, reason CloseReason, stats ConnStats)
+}
+
+// NopObserver implements Observer with methods that do nothing. It can be
+// embedded to implement only part of the interface.
+type NopObserver struct{}
+
+func (NopObserver) OnHandshakeStart(HandshakeInfo)        {}
+func (NopObserver) OnHandshakeDone(HandshakeInfo, error)  {}
+func (NopObserver) OnOpen(*Conn)                          {}
+func (NopObserver) OnBytes(*Conn, ConnStats)              {}
+func (NopObserver) OnError(*Conn, error)                  {}
+func (NopObserver) OnClose(*Conn, CloseReason, ConnStats) {}
+
+// instruments holds the instrumentation configured on a Dialer or Hijacker
+// and reports the events of one side of a single tunnel to it.
+type instruments struct {
+	side     Side
+	id       string
+	logger   *slog.Logger
+	metrics  *Metrics
+	observer Observer
+	span     *tunnelSpan
+	audit    *tunnelAudit
+}
+
+func newInstruments(side Side, logger *slog.Logger, metrics *Metrics, observer Observer) instruments {
+	id := newTunnelID()
+	if logger == nil {
+		logger = discardLogger
+	} else {
+		logger = logger.With("tunnel_id", id, "side", side.String())
+	}
+	return instruments{
+		side:     side,
+		id:       id,
+		logger:   logger,
+		metrics:  metrics,
+		observer: observer,
+	}
+}
+
+func (d *Dialer) instruments() instruments {
+	return newInstruments(SideClient, d.Logger, d.Metrics, d.Observer)
+}
+
+func (h Hijacker) instruments() instruments {
+	return newInstruments(SideServer, h.Logger, h.Metrics, h.Observer)
+}
+
+// withSpan attaches the handshake span to in and its trace ID to the logger.
+func (in instruments) withSpan(span *tunnelSpan) instruments {
+	in.span = span
+	if sc := span.spanContext(); sc.IsValid() {
+		in.logger = in.logger.With("trace_id", sc.TraceID.String())
+	}
+	return in
+}
+
+func (in instruments) handshakeStart(info HandshakeInfo) {
+	if in.observer != nil {
+		in.observer.OnHandshakeStart(info)
+	}
+}
+
+// handshakeDone reports the outcome of a handshake. On success, conn is
+// opened.
+func (in instruments) handshakeDone(info HandshakeInfo, conn *Conn, outcome handshakeOutcome, err error) {
+	in.metrics.handshakeDone(in.side, outcome, time.Since(info.Start))
+	in.span.end(err)
+	if in.observer != nil {
+		in.observer.OnHandshakeDone(info, err)
+	}
+	if err != nil {
+		in.logger.Warn("tunnel handshake failed", "url", info.URL, "error", err)
+		return
+	}
+	in.logger.Info("tunnel opened", "url", info.URL, "remote_addr", conn.RemoteAddr().String())
+	conn.open()
+	in.audit.open()
+	if in.observer != nil {
+		in.observer.OnOpen(conn)
+	}
+}
+
+// handshakeResumed reports a handshake that resumed an existing tunnel
+// rather than opening a new one.
+func (in instruments) handshakeResumed(info HandshakeInfo, err error) {
+	outcome := outcomeSuccess
+	if err != nil {
+		outcome = outcomeError
+	}
+	in.metrics.handshakeDone(in.side, outcome, time.Since(info.Start))
+	in.span.end(err)
+	if in.observer != nil {
+		in.observer.OnHandshakeDone(info, err)
+	}
+	if err != nil {
+		in.logger.Warn("tunnel resume failed", "url", info.URL, "error", err)
+		return
+	}
+	in.logger.Info("tunnel resumed", "url", info.URL)
+}
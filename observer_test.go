@@ -0,0 +1,120 @@
+package httptunnel
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+type recordingObserver struct {
+	NopObserver
+	mu      sync.Mutex
+	events  []string
+	reasons []CloseReason
+	stats   []ConnStats
+}
+
+func (o *recordingObserver) record(event string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, event)
+}
+
+func (o *recordingObserver) OnHandshakeStart(info HandshakeInfo) {
+	o.record("start " + info.Side.String())
+}
+
+func (o *recordingObserver) OnHandshakeDone(info HandshakeInfo, err error) {
+	if err != nil {
+		o.record("fail " + info.Side.String())
+	} else {
+		o.record("done " + info.Side.String())
+	}
+}
+
+func (o *recordingObserver) OnOpen(conn *Conn) {
+	o.record("open " + conn.Side().String())
+}
+
+func (o *recordingObserver) OnClose(conn *Conn, reason CloseReason, stats ConnStats) {
+	o.record("close " + conn.Side().String())
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.reasons = append(o.reasons, reason)
+	o.stats = append(o.stats, stats)
+}
+
+func TestObserver(t *testing.T) {
+	clientObserver := &recordingObserver{}
+	serverObserver := &recordingObserver{}
+	hijacker := Hijacker{Observer: serverObserver}
+	s := newServer(t)
+	s.Server.Config.Handler = http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			s.wg.Add(1)
+			defer s.wg.Done()
+			w.WriteHeader(http.StatusSwitchingProtocols)
+			conn, _, err := hijacker.Hijack(w, r)
+			if err != nil {
+				t.Errorf("Hijack: %v", err)
+				return
+			}
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn)
+		},
+	)
+
+	d := testDialer
+	d.Observer = clientObserver
+	conn, _, _, err := d.Dial(s.URL, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if _, err := conn.Write([]byte("test")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	conn.Close()
+	s.Close()
+
+	for _, tt := range []struct {
+		o      *recordingObserver
+		side   string
+		reason CloseReason
+	}{
+		{clientObserver, "client", CloseLocal},
+		{serverObserver, "server", ClosePeer},
+	} {
+		expected := []string{"start " + tt.side, "done " + tt.side, "open " + tt.side, "close " + tt.side}
+		if len(tt.o.events) != len(expected) {
+			t.Fatalf("expected events %v, got: %v", expected, tt.o.events)
+		}
+		for i := range expected {
+			if tt.o.events[i] != expected[i] {
+				t.Errorf("expected events %v, got: %v", expected, tt.o.events)
+				break
+			}
+		}
+		if tt.o.reasons[0] != tt.reason {
+			t.Errorf("%v: expected close reason %v, got: %v", tt.side, tt.reason, tt.o.reasons[0])
+		}
+	}
+	if sent := clientObserver.stats[0].BytesSent; sent == 0 {
+		t.Errorf("expected client to have sent bytes")
+	}
+	if received := serverObserver.stats[0].BytesReceived; received == 0 {
+		t.Errorf("expected server to have received bytes")
+	}
+}
+
+func TestObserverHandshakeError(t *testing.T) {
+	o := &recordingObserver{}
+	d := testDialer
+	d.Observer = o
+	if _, _, _, err := d.Dial("http://127.0.0.1:0/", nil); err == nil {
+		t.Fatal("expected dial error")
+	}
+	if len(o.events) != 2 || o.events[1] != "fail client" {
+		t.Errorf("expected a failed handshake, got: %v", o.events)
+	}
+}
@@ -0,0 +1,457 @@
+package httptunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPACCacheTTL = 5 * time.Minute
+	maxPACCacheEntries = 1024
+	maxPACScriptSize   = 1 << 20
+	pacLoadTimeout     = 30 * time.Second
+)
+
+// ErrPACUnsupported is wrapped by the errors of ParsePAC and LoadPAC for the
+// scripts using features that the built-in interpreter does not support.
+var ErrPACUnsupported = errors.New("httptunnel: pac: unsupported script")
+
+// PAC evaluates a proxy auto-configuration script to choose the proxies of
+// the requests.
+//
+// The script must define the function FindProxyForURL(url, host). ParsePAC
+// and LoadPAC run it with a built-in interpreter of the subset of JavaScript
+// commonly found in PAC files: functions, var, let and const, if, for, while,
+// strings, numbers, booleans, arrays, the usual operators and the common
+// string and array methods. The helper functions isPlainHostName,
+// dnsDomainIs, localHostOrDomainIs, isResolvable, isInNet, dnsResolve,
+// myIpAddress, dnsDomainLevels, shExpMatch and convert_addr are available to
+// it. The scripts using regular expressions, objects, switch, try or new, or
+// calling weekdayRange, dateRange, timeRange or the Ex helper functions, are
+// rejected with an error wrapping ErrPACUnsupported. Use NewPAC to evaluate
+// them with another PACEvaluator.
+//
+// The built-in interpreter runs the top level of the script once, and its
+// calls of FindProxyForURL one at a time, so that the global variables of the
+// script persist between them as in browsers.
+//
+// The results are cached per URL. It is safe to call PAC's methods
+// concurrently.
+type PAC struct {
+	// Resolver is used to look up host names in the helper functions of the
+	// built-in interpreter. If nil, net.DefaultResolver is used.
+	Resolver *net.Resolver
+
+	// CacheTTL is how long the result for a URL is cached. If zero, a
+	// default of 5 minutes is used. If negative, results are not cached.
+	CacheTTL time.Duration
+
+	eval PACEvaluator
+
+	// myIPAddress returns the address of the host, replaced by tests.
+	myIPAddress func() string
+
+	mu    sync.Mutex
+	cache map[string]pacCacheEntry
+}
+
+// A PACEvaluator evaluates a proxy auto-configuration script, for example
+// with a complete JavaScript engine.
+type PACEvaluator interface {
+	// FindProxyForURL returns the result of the FindProxyForURL function of
+	// the script for url and host. It may be called concurrently.
+	FindProxyForURL(ctx context.Context, url, host string) (string, error)
+}
+
+// NewPAC returns a PAC evaluating its script with eval.
+func NewPAC(eval PACEvaluator) *PAC {
+	return &PAC{eval: eval}
+}
+
+type pacCacheEntry struct {
+	result  string
+	expires time.Time
+}
+
+// ParsePAC parses a proxy auto-configuration script and runs its top level
+// with the built-in interpreter.
+func ParsePAC(script string) (*PAC, error) {
+	stmts, err := parsePAC(script)
+	if err != nil {
+		return nil, err
+	}
+	p := &PAC{myIPAddress: myIPAddress}
+	in := newPACInterp(p.host(context.Background()))
+	if err := in.run(stmts); err != nil {
+		return nil, err
+	}
+	if fn, _ := in.global.lookup("FindProxyForURL"); pacTypeof(fn) != "function" {
+		return nil, errors.New("httptunnel: pac: FindProxyForURL is not defined")
+	}
+	p.eval = &pacScript{pac: p, in: in, sem: make(chan struct{}, 1)}
+	return p, nil
+}
+
+// pacScript is the PACEvaluator of ParsePAC. Its interpreter holds the
+// global variables of the script and runs one call at a time.
+type pacScript struct {
+	pac *PAC
+	in  *pacInterp
+	sem chan struct{}
+}
+
+func (s *pacScript) FindProxyForURL(ctx context.Context, url, host string) (string, error) {
+	select {
+	case s.sem <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-s.sem }()
+
+	s.in.reset(s.pac.host(ctx))
+	v, err := s.in.call("FindProxyForURL", url, host)
+	if err != nil {
+		return "", err
+	}
+	result, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("httptunnel: pac: FindProxyForURL returned %s", pacTypeof(v))
+	}
+	return result, nil
+}
+
+// LoadPAC loads a proxy auto-configuration script from location, which is
+// either a file path or a file, http or https URL. The script is downloaded
+// within 30 seconds, or less if ctx is done sooner.
+func LoadPAC(ctx context.Context, location string) (*PAC, error) {
+	var r io.ReadCloser
+	u, err := url.Parse(location)
+	switch {
+	case err == nil && (u.Scheme == "http" || u.Scheme == "https"):
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := (&http.Client{Timeout: pacLoadTimeout}).Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("httptunnel: pac: %s responded %s", u.Redacted(), resp.Status)
+		}
+		r = resp.Body
+	case err == nil && u.Scheme == "file":
+		if r, err = os.Open(u.Path); err != nil {
+			return nil, err
+		}
+	default:
+		if r, err = os.Open(location); err != nil {
+			return nil, err
+		}
+	}
+	defer r.Close()
+
+	script, err := io.ReadAll(io.LimitReader(r, maxPACScriptSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(script) > maxPACScriptSize {
+		return nil, errors.New("httptunnel: pac: script too large")
+	}
+	return ParsePAC(string(script))
+}
+
+// FindProxyForURL returns the result of the FindProxyForURL function of the
+// script for u, for example "PROXY proxy.example:3128; DIRECT".
+//
+// As browsers do, the path and query of https URLs are not passed to the
+// script.
+func (p *PAC) FindProxyForURL(ctx context.Context, u *url.URL) (string, error) {
+	scriptURL := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}
+	if u.Scheme != "https" {
+		scriptURL.Path, scriptURL.RawPath, scriptURL.RawQuery = u.Path, u.RawPath, u.RawQuery
+	}
+	key := scriptURL.String()
+
+	ttl := p.CacheTTL
+	if ttl == 0 {
+		ttl = defaultPACCacheTTL
+	}
+	now := time.Now()
+	if ttl > 0 {
+		p.mu.Lock()
+		entry, ok := p.cache[key]
+		p.mu.Unlock()
+		if ok && now.Before(entry.expires) {
+			return entry.result, nil
+		}
+	}
+
+	result, err := p.eval.FindProxyForURL(ctx, key, u.Hostname())
+	if err != nil {
+		return "", err
+	}
+
+	if ttl > 0 {
+		p.mu.Lock()
+		if len(p.cache) >= maxPACCacheEntries {
+			for k, entry := range p.cache {
+				if !now.Before(entry.expires) {
+					delete(p.cache, k)
+				}
+			}
+			if len(p.cache) >= maxPACCacheEntries {
+				clear(p.cache)
+			}
+		}
+		if p.cache == nil {
+			p.cache = make(map[string]pacCacheEntry)
+		}
+		p.cache[key] = pacCacheEntry{result: result, expires: now.Add(ttl)}
+		p.mu.Unlock()
+	}
+	return result, nil
+}
+
+// ProxyFailover returns the proxies chosen by the script for req, in order,
+// a nil *URL standing for a direct connection. It can be used as
+// Dialer.ProxyFailover.
+//
+// PROXY and HTTP entries are http proxies, HTTPS entries https proxies and
+// SOCKS and SOCKS5 entries SOCKS5 proxies. Other entries are skipped.
+func (p *PAC) ProxyFailover(req *http.Request) ([]*url.URL, error) {
+	result, err := p.FindProxyForURL(req.Context(), req.URL)
+	if err != nil {
+		return nil, err
+	}
+	return parsePACResult(result)
+}
+
+// Proxy returns the first proxy chosen by the script for req. It can be
+// used as Dialer.Proxy when failing over to the other proxies is not
+// needed.
+func (p *PAC) Proxy(req *http.Request) (*url.URL, error) {
+	proxies, err := p.ProxyFailover(req)
+	if err != nil {
+		return nil, err
+	}
+	return proxies[0], nil
+}
+
+// parsePACResult returns the proxies of the result of FindProxyForURL. There
+// is at least one.
+func parsePACResult(result string) ([]*url.URL, error) {
+	var proxies []*url.URL
+	entries := 0
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		entries++
+		var scheme string
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			proxies = append(proxies, nil)
+			continue
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5"
+		default:
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("httptunnel: pac: invalid result %q", result)
+		}
+		proxies = append(proxies, &url.URL{Scheme: scheme, Host: fields[1]})
+	}
+	switch {
+	case entries == 0:
+		return []*url.URL{nil}, nil
+	case len(proxies) == 0:
+		return nil, fmt.Errorf("httptunnel: pac: no supported proxy in %q", result)
+	}
+	return proxies, nil
+}
+
+// pacHost provides the helper functions of a script with DNS and the
+// address of the host.
+type pacHost struct {
+	ctx         context.Context
+	resolver    *net.Resolver
+	myIPAddress func() string
+	myIP        string // resolved once per call of the script
+}
+
+func (p *PAC) host(ctx context.Context) pacHost {
+	resolver := p.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return pacHost{ctx: ctx, resolver: resolver, myIPAddress: p.myIPAddress}
+}
+
+// resolve returns an address of host, preferably IPv4.
+func (h pacHost) resolve(host string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Unmap(), true
+	}
+	addrs, err := h.resolver.LookupNetIP(h.ctx, "ip", host)
+	if err != nil || len(addrs) == 0 {
+		return netip.Addr{}, false
+	}
+	for _, addr := range addrs {
+		if addr = addr.Unmap(); addr.Is4() {
+			return addr, true
+		}
+	}
+	return addrs[0], true
+}
+
+// localAddress returns the address of the host.
+func (h *pacHost) localAddress() string {
+	if h.myIP == "" {
+		h.myIP = h.myIPAddress()
+	}
+	return h.myIP
+}
+
+// myIPAddress returns the address of the interface used to reach the
+// internet, or the loopback address.
+func myIPAddress() string {
+	// No packet is sent to connect a UDP socket
+	c, err := net.Dial("udp4", "192.0.2.1:80")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+func pacArg(args []any, i int) string {
+	if i < len(args) {
+		return pacString(args[i])
+	}
+	return "undefined"
+}
+
+var pacBuiltins = map[string]pacBuiltin{
+	"isPlainHostName": func(in *pacInterp, args []any) (any, error) {
+		return !strings.Contains(pacArg(args, 0), "."), nil
+	},
+	"dnsDomainIs": func(in *pacInterp, args []any) (any, error) {
+		host, domain := strings.ToLower(pacArg(args, 0)), strings.ToLower(pacArg(args, 1))
+		return strings.HasSuffix(host, domain), nil
+	},
+	"localHostOrDomainIs": func(in *pacInterp, args []any) (any, error) {
+		host, hostdom := strings.ToLower(pacArg(args, 0)), strings.ToLower(pacArg(args, 1))
+		return host == hostdom || !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+"."), nil
+	},
+	"isResolvable": func(in *pacInterp, args []any) (any, error) {
+		_, ok := in.host.resolve(pacArg(args, 0))
+		return ok, nil
+	},
+	"dnsResolve": func(in *pacInterp, args []any) (any, error) {
+		if addr, ok := in.host.resolve(pacArg(args, 0)); ok {
+			return addr.String(), nil
+		}
+		return pacNull{}, nil
+	},
+	"isInNet": func(in *pacInterp, args []any) (any, error) {
+		pattern, err1 := netip.ParseAddr(pacArg(args, 1))
+		mask, err2 := netip.ParseAddr(pacArg(args, 2))
+		if err1 != nil || err2 != nil || !pattern.Is4() || !mask.Is4() {
+			return false, nil
+		}
+		addr, ok := in.host.resolve(pacArg(args, 0))
+		if !ok || !addr.Is4() {
+			return false, nil
+		}
+		a, p, m := addr.As4(), pattern.As4(), mask.As4()
+		for i := range a {
+			if a[i]&m[i] != p[i]&m[i] {
+				return false, nil
+			}
+		}
+		return true, nil
+	},
+	"myIpAddress": func(in *pacInterp, args []any) (any, error) {
+		return in.host.localAddress(), nil
+	},
+	"dnsDomainLevels": func(in *pacInterp, args []any) (any, error) {
+		return float64(strings.Count(pacArg(args, 0), ".")), nil
+	},
+	"shExpMatch": func(in *pacInterp, args []any) (any, error) {
+		return shExpMatch(pacArg(args, 0), pacArg(args, 1)), nil
+	},
+	"convert_addr": func(in *pacInterp, args []any) (any, error) {
+		addr, err := netip.ParseAddr(pacArg(args, 0))
+		if err != nil || !addr.Is4() {
+			return float64(0), nil
+		}
+		a := addr.As4()
+		return float64(uint32(a[0])<<24 | uint32(a[1])<<16 | uint32(a[2])<<8 | uint32(a[3])), nil
+	},
+	"alert": func(in *pacInterp, args []any) (any, error) {
+		return pacUndefined{}, nil
+	},
+}
+
+// maxShExpPatterns bounds the number of patterns held by shExpPatterns.
+const maxShExpPatterns = 1024
+
+// shExpPatterns caches the regular expressions of the shExpMatch patterns,
+// which scripts usually match against every URL.
+var shExpPatterns struct {
+	sync.Mutex
+	res map[string]*regexp.Regexp
+}
+
+// shExpMatch reports whether s matches the shell expression pattern, in
+// which * matches any string and ? any character.
+func shExpMatch(s, pattern string) bool {
+	shExpPatterns.Lock()
+	re, ok := shExpPatterns.res[pattern]
+	shExpPatterns.Unlock()
+	if !ok {
+		var b strings.Builder
+		b.WriteString("^")
+		for _, r := range pattern {
+			switch r {
+			case '*':
+				b.WriteString(".*")
+			case '?':
+				b.WriteString(".")
+			default:
+				b.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		b.WriteString("$")
+		var err error
+		if re, err = regexp.Compile(b.String()); err != nil {
+			return false
+		}
+		shExpPatterns.Lock()
+		if shExpPatterns.res == nil || len(shExpPatterns.res) >= maxShExpPatterns {
+			shExpPatterns.res = make(map[string]*regexp.Regexp)
+		}
+		shExpPatterns.res[pattern] = re
+		shExpPatterns.Unlock()
+	}
+	return re.MatchString(s)
+}
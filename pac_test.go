@@ -0,0 +1,375 @@
+package httptunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testPAC = `
+// Hosts dialed directly
+var direct = ["localhost", ".lan"];
+
+function isDirect(host) {
+	for (var i = 0; i < direct.length; i++) {
+		if (direct[i].charAt(0) == "." ? dnsDomainIs(host, direct[i]) : host == direct[i])
+			return true;
+	}
+	return false;
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (isPlainHostName(host) && host != "localhost") {
+		return "PROXY plain:3128";
+	}
+	if (isDirect(host) || isInNet(host, "10.0.0.0", "255.0.0.0"))
+		return "DIRECT";
+	if (shExpMatch(url, "http://*.example/private/*"))
+		return "PROXY private:3128; SOCKS5 private:1080";
+	if (localHostOrDomainIs(host, "www.example") || dnsDomainLevels(host) > 3)
+		return 'HTTPS secure:443';
+	if (url.substring(0, 6) === "https:") {
+		return "PROXY " + (myIpAddress() === "192.168.1.2" ? "home" : "office") + ":3128; DIRECT";
+	}
+	return "PROXY default:3128; DIRECT"
+}
+`
+
+func TestPACFindProxyForURL(t *testing.T) {
+	p, err := ParsePAC(testPAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.myIPAddress = func() string { return "192.168.1.2" }
+	for _, tt := range []struct {
+		url      string
+		expected string
+	}{
+		{"http://intranet/", "PROXY plain:3128"},
+		{"http://LOCALHOST:8080/", "DIRECT"},
+		{"http://printer.lan/", "DIRECT"},
+		{"http://10.1.2.3/", "DIRECT"},
+		{"http://11.1.2.3/", "PROXY default:3128; DIRECT"},
+		{"http://a.example/private/x?y", "PROXY private:3128; SOCKS5 private:1080"},
+		{"https://a.example/private/x", "PROXY home:3128; DIRECT"},
+		{"http://www/", "PROXY plain:3128"},
+		{"http://www.example/", "HTTPS secure:443"},
+		{"http://a.b.c.d.example/", "HTTPS secure:443"},
+	} {
+		u, _ := url.Parse(tt.url)
+		result, err := p.FindProxyForURL(context.Background(), u)
+		if err != nil {
+			t.Errorf("%v: %v", tt.url, err)
+			continue
+		}
+		if result != tt.expected {
+			t.Errorf("%v: expected %q, got: %q", tt.url, tt.expected, result)
+		}
+	}
+}
+
+func TestPACCache(t *testing.T) {
+	p, err := ParsePAC(`function FindProxyForURL(url, host) { return "PROXY " + myIpAddress() + ":3128"; }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	p.myIPAddress = func() string {
+		calls++
+		return "192.168.1.2"
+	}
+	u, _ := url.Parse("https://a.example/path")
+	other, _ := url.Parse("https://a.example/other")
+	for _, u := range []*url.URL{u, u, other} {
+		if _, err := p.FindProxyForURL(context.Background(), u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The path of https URLs is not part of the key
+	if calls != 1 {
+		t.Errorf("expected 1 evaluation, got: %v", calls)
+	}
+
+	p.CacheTTL = -1
+	if _, err := p.FindProxyForURL(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 evaluations, got: %v", calls)
+	}
+}
+
+func TestParsePACResult(t *testing.T) {
+	for _, tt := range []struct {
+		result   string
+		expected []*url.URL
+	}{
+		{"", []*url.URL{nil}},
+		{"DIRECT", []*url.URL{nil}},
+		{
+			"PROXY a:3128; HTTPS b:443;SOCKS c:1080; SOCKS4 d:1080; DIRECT",
+			[]*url.URL{
+				{Scheme: "http", Host: "a:3128"},
+				{Scheme: "https", Host: "b:443"},
+				{Scheme: "socks5", Host: "c:1080"},
+				nil,
+			},
+		},
+	} {
+		proxies, err := parsePACResult(tt.result)
+		if err != nil {
+			t.Errorf("%q: %v", tt.result, err)
+			continue
+		}
+		if !reflect.DeepEqual(proxies, tt.expected) {
+			t.Errorf("%q: expected %v, got: %v", tt.result, tt.expected, proxies)
+		}
+	}
+
+	for _, result := range []string{"PROXY", "SOCKS4 d:1080"} {
+		if _, err := parsePACResult(result); err == nil {
+			t.Errorf("%q: expected an error", result)
+		}
+	}
+}
+
+func TestParsePACErrors(t *testing.T) {
+	for _, script := range []string{
+		`function FindProxyForURL(url, host) { return "DIRECT"`,
+		`function FindProxyForURL(url, host) { return "DIRECT; }`,
+		`function findProxyForURL(url, host) { return "DIRECT"; }`,
+		`var x = ;`,
+		`undefinedFunction();`,
+	} {
+		if _, err := ParsePAC(script); err == nil {
+			t.Errorf("%q: expected an error", script)
+		}
+	}
+
+	deep := strings.Repeat("(", pacMaxNesting) + "1" + strings.Repeat(")", pacMaxNesting)
+	if _, err := ParsePAC(deep); !errors.Is(err, errPACNesting) {
+		t.Errorf("expected %v, got: %v", errPACNesting, err)
+	}
+
+	u, _ := url.Parse("http://a.example/")
+	for _, tt := range []struct {
+		body     string
+		expected error
+	}{
+		{"while (true) {}", nil},
+		{`var s = "x"; while (true) s += s;`, errPACStringTooLong},
+		{`var s = "x"; while (s.length < 1048576) s += s; var a = []; while (true) a.push(s + "");`, errPACMemory},
+		{`var a = ["x"]; for (var i = 0; i < 40; i++) a = [a, a]; return a + "";`, errPACStringTooLong},
+		{"function f() { return f(); } return f();", nil},
+	} {
+		p, err := ParsePAC(`function FindProxyForURL(url, host) { ` + tt.body + ` }`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p.FindProxyForURL(context.Background(), u)
+		if err == nil || tt.expected != nil && !errors.Is(err, tt.expected) {
+			t.Errorf("%q: expected an error matching %v, got: %v", tt.body, tt.expected, err)
+		}
+	}
+
+	// The arrays containing themselves are converted as in JavaScript
+	p, err := ParsePAC(`function FindProxyForURL(url, host) { var a = ["DIRECT"]; a.push(a); return a.join(""); }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := p.FindProxyForURL(context.Background(), u); result != "DIRECT" || err != nil {
+		t.Errorf("expected DIRECT, got: %q, %v", result, err)
+	}
+}
+
+func TestParsePACUnsupported(t *testing.T) {
+	for _, tt := range []struct {
+		body        string
+		unsupported bool
+	}{
+		{`if (/^intranet\./.test(host)) return "DIRECT";`, true},
+		{`return host.match(/example/) ? "DIRECT" : "PROXY p:1";`, true},
+		{`var o = {direct: true}; return "DIRECT";`, true},
+		{`switch (host) { case "a": return "DIRECT"; }`, true},
+		{`try { return "DIRECT"; } catch (e) {}`, true},
+		{`var d = new Date(); return "DIRECT";`, true},
+		{`if (weekdayRange("MON", "FRI")) return "DIRECT";`, true},
+		{`if (timeRange(8, 18)) return "DIRECT";`, true},
+		{`var n = host.length / 2; return n > 1 ? "DIRECT" : "PROXY p:1";`, false},
+		{`function dateRange() { return true; } if (dateRange()) return "DIRECT";`, false},
+		{`return "DIRECT"`, false},
+	} {
+		_, err := ParsePAC(`function FindProxyForURL(url, host) { ` + tt.body + ` }`)
+		if unsupported := errors.Is(err, ErrPACUnsupported); unsupported != tt.unsupported || !tt.unsupported && err != nil {
+			t.Errorf("%q: expected unsupported %v, got: %v", tt.body, tt.unsupported, err)
+		}
+	}
+
+	file := filepath.Join(t.TempDir(), "proxy.pac")
+	script := `function FindProxyForURL(url, host) { return /x/.test(host) ? "DIRECT" : "PROXY p:1"; }`
+	if err := os.WriteFile(file, []byte(script), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPAC(context.Background(), file); !errors.Is(err, ErrPACUnsupported) {
+		t.Errorf("expected %v, got: %v", ErrPACUnsupported, err)
+	}
+}
+
+func TestPACState(t *testing.T) {
+	// The top level runs once, and the global variables persist between the
+	// calls
+	p, err := ParsePAC(`
+var calls = 0;
+function FindProxyForURL(url, host) {
+	calls++;
+	return shExpMatch(host, "*.example") ? "PROXY " + myIpAddress() + myIpAddress() : "DIRECT " + calls;
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lookups atomic.Int32
+	p.myIPAddress = func() string {
+		lookups.Add(1)
+		return "192.168.1.2"
+	}
+	p.CacheTTL = -1
+	u, _ := url.Parse("http://a.example/")
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.FindProxyForURL(context.Background(), u); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// The address is looked up once per call
+	if n := lookups.Load(); n != 10 {
+		t.Errorf("expected 10 address lookups, got: %v", n)
+	}
+	other, _ := url.Parse("http://other/")
+	if result, err := p.FindProxyForURL(context.Background(), other); result != "DIRECT 11" || err != nil {
+		t.Errorf("expected DIRECT 11, got: %q, %v", result, err)
+	}
+	shExpPatterns.Lock()
+	_, cached := shExpPatterns.res["*.example"]
+	shExpPatterns.Unlock()
+	if !cached {
+		t.Error("expected the shExpMatch pattern to be cached")
+	}
+}
+
+type pacEvaluatorFunc func(ctx context.Context, url, host string) (string, error)
+
+func (f pacEvaluatorFunc) FindProxyForURL(ctx context.Context, url, host string) (string, error) {
+	return f(ctx, url, host)
+}
+
+func TestNewPAC(t *testing.T) {
+	p := NewPAC(pacEvaluatorFunc(func(ctx context.Context, url, host string) (string, error) {
+		if url != "https://a.example/" || host != "a.example" {
+			t.Errorf("unexpected arguments %q, %q", url, host)
+		}
+		return "SOCKS5 socks:1080; DIRECT", nil
+	}))
+	r := httptest.NewRequest(http.MethodGet, "https://a.example/private", nil)
+	proxies, err := p.ProxyFailover(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*url.URL{{Scheme: "socks5", Host: "socks:1080"}, nil}
+	if !reflect.DeepEqual(proxies, expected) {
+		t.Errorf("expected %v, got: %v", expected, proxies)
+	}
+}
+
+func TestLoadPACTimeout(t *testing.T) {
+	stalled := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	defer s.Close()
+	defer close(stalled)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := LoadPAC(ctx, s.URL+"/proxy.pac"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v, got: %v", context.DeadlineExceeded, err)
+	}
+}
+
+func FuzzPAC(f *testing.F) {
+	f.Add(testPAC)
+	f.Add(`function FindProxyForURL(url, host) { var a = [host, url.split("/")]; return a.join(a) + typeof a; }`)
+	f.Add(`function FindProxyForURL(url, host) { for (var i = 0; i < 10; i++) { if (i % 2) continue; host += i; } return host; }`)
+	f.Add(`function FindProxyForURL(url, host) { return isInNet(dnsResolve(host), "10.0.0.0", "255.0.0.0") ? "DIRECT" : "PROXY p:1"; }`)
+
+	// The lookups fail right away with a canceled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	host := pacHost{ctx: ctx, resolver: net.DefaultResolver, myIPAddress: func() string { return "192.168.1.2" }}
+	f.Fuzz(func(t *testing.T, script string) {
+		stmts, err := parsePAC(script)
+		if err != nil {
+			return
+		}
+		in := newPACInterp(host)
+		if err := in.run(stmts); err != nil {
+			return
+		}
+		_, _ = in.call("FindProxyForURL", "http://a.example/path?q", "a.example")
+	})
+}
+
+func TestPACFailover(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	// A port with nothing listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadProxy := l.Addr().String()
+	l.Close()
+
+	script := `function FindProxyForURL(url, host) { return "PROXY ` + deadProxy + `; DIRECT"; }`
+	file := filepath.Join(t.TempDir(), "proxy.pac")
+	if err := os.WriteFile(file, []byte(script), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pacServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		_, _ = w.Write([]byte(script))
+	}))
+	defer pacServer.Close()
+
+	for _, location := range []string{file, "file://" + filepath.ToSlash(file), pacServer.URL + "/proxy.pac"} {
+		p, err := LoadPAC(context.Background(), location)
+		if err != nil {
+			t.Fatalf("%v: %v", location, err)
+		}
+		d := testDialer
+		d.ProxyFailover = p.ProxyFailover
+		conn, _, resp, err := d.Dial(s.URL, testDialOptions)
+		if err != nil {
+			t.Fatalf("%v: Dial: %v", location, err)
+		}
+		sendRecv(conn, resp, t)
+		conn.Close()
+	}
+}
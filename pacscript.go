@@ -0,0 +1,1696 @@
+package httptunnel
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// This file implements the subset of JavaScript used by proxy
+// auto-configuration files: functions, var/let/const, if, for, while, return,
+// strings, numbers, booleans, arrays and the usual operators. The scripts
+// using regular expressions, objects or the other statements are rejected
+// with ErrPACUnsupported by the parser rather than with a syntax error, so
+// that they can be told apart from the broken scripts.
+
+const (
+	pacMaxSteps = 1_000_000
+	pacMaxDepth = 200
+	// pacMaxNesting limits the nesting of the statements and expressions,
+	// when parsed and run.
+	pacMaxNesting = 10_000
+	// pacMaxString limits the length of the strings built by the scripts,
+	// and pacMaxAlloc the bytes of the strings and arrays built by an
+	// evaluation.
+	pacMaxString = 1 << 20
+	pacMaxAlloc  = 64 << 20
+	// pacElemSize is the size charged for an element of an array.
+	pacElemSize = 16
+)
+
+var (
+	errPACSyntax        = errors.New("httptunnel: pac syntax error")
+	errPACNesting       = errors.New("httptunnel: pac: script too deeply nested")
+	errPACStringTooLong = errors.New("httptunnel: pac: string too long")
+	errPACMemory        = errors.New("httptunnel: pac: script uses too much memory")
+)
+
+// pacUnsupportedKeywords are the keywords of the unsupported statements and
+// expressions, with the name of the feature.
+var pacUnsupportedKeywords = map[string]string{
+	"switch": "switch statements",
+	"do":     "do statements",
+	"try":    "try statements",
+	"throw":  "throw statements",
+	"with":   "with statements",
+	"new":    "new expressions",
+	"delete": "delete expressions",
+	"class":  "classes",
+}
+
+// pacUnsupportedHelpers are the PAC helper functions that are not provided.
+var pacUnsupportedHelpers = map[string]bool{
+	"weekdayRange":      true,
+	"dateRange":         true,
+	"timeRange":         true,
+	"isResolvableEx":    true,
+	"isInNetEx":         true,
+	"dnsResolveEx":      true,
+	"myIpAddressEx":     true,
+	"sortIpAddressList": true,
+	"getClientVersion":  true,
+}
+
+func pacUnsupported(line int, format string, args ...any) error {
+	return fmt.Errorf("%w: line %d: %s", ErrPACUnsupported, line, fmt.Sprintf(format, args...))
+}
+
+type pacTokenKind int
+
+const (
+	pacTokEOF pacTokenKind = iota
+	pacTokIdent
+	pacTokNumber
+	pacTokString
+	pacTokPunct
+)
+
+type pacToken struct {
+	kind pacTokenKind
+	text string
+	num  float64
+	line int
+}
+
+var pacPunctuators = []string{
+	"===", "!==", "==", "!=", "<=", ">=", "&&", "||", "++", "--", "+=", "-=",
+	"{", "}", "(", ")", "[", "]", ";", ",", ".", "?", ":", "+", "-", "*", "/",
+	"%", "=", "<", ">", "!",
+}
+
+func lexPAC(src string) ([]pacToken, error) {
+	var toks []pacToken
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("%w: line %d: unterminated comment", errPACSyntax, line)
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+		case c == '_' || c == '$' || isASCIILetter(c):
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] == '$' || isASCIILetter(src[j]) || isASCIIDigit(src[j])) {
+				j++
+			}
+			toks = append(toks, pacToken{kind: pacTokIdent, text: src[i:j], line: line})
+			i = j
+		case isASCIIDigit(c) || c == '.' && i+1 < len(src) && isASCIIDigit(src[i+1]):
+			j := i
+			for j < len(src) && (isASCIIDigit(src[j]) || isASCIILetter(src[j]) || src[j] == '.') {
+				j++
+			}
+			text := src[i:j]
+			var n float64
+			if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") {
+				u, err := strconv.ParseUint(text[2:], 16, 64)
+				if err != nil {
+					return nil, fmt.Errorf("%w: line %d: invalid number %q", errPACSyntax, line, text)
+				}
+				n = float64(u)
+			} else {
+				f, err := strconv.ParseFloat(text, 64)
+				if err != nil {
+					return nil, fmt.Errorf("%w: line %d: invalid number %q", errPACSyntax, line, text)
+				}
+				n = f
+			}
+			toks = append(toks, pacToken{kind: pacTokNumber, text: text, num: n, line: line})
+			i = j
+		case c == '"' || c == '\'':
+			s, n, err := lexPACString(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%w: line %d: %v", errPACSyntax, line, err)
+			}
+			toks = append(toks, pacToken{kind: pacTokString, text: s, line: line})
+			i += n
+		case c == '/' && pacExpressionExpected(toks):
+			return nil, pacUnsupported(line, "regular expressions are not supported")
+		default:
+			matched := false
+			for _, p := range pacPunctuators {
+				if strings.HasPrefix(src[i:], p) {
+					toks = append(toks, pacToken{kind: pacTokPunct, text: p, line: line})
+					i += len(p)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("%w: line %d: unexpected character %q", errPACSyntax, line, c)
+			}
+		}
+	}
+	return append(toks, pacToken{kind: pacTokEOF, line: line}), nil
+}
+
+// pacExpressionExpected reports whether an expression may start after toks,
+// in which case a slash starts a regular expression rather than a division.
+func pacExpressionExpected(toks []pacToken) bool {
+	if len(toks) == 0 {
+		return true
+	}
+	switch t := toks[len(toks)-1]; t.kind {
+	case pacTokIdent:
+		return t.text == "return" || t.text == "typeof"
+	case pacTokPunct:
+		return t.text != ")" && t.text != "]" && t.text != "}"
+	}
+	return false
+}
+
+// lexPACString returns the value of the string literal at the start of s and
+// its length.
+func lexPACString(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\n':
+			return "", 0, errors.New("unterminated string")
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch e := s[i]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '0':
+				b.WriteByte(0)
+			case 'x', 'u':
+				n := 2
+				if e == 'u' {
+					n = 4
+				}
+				if i+n >= len(s) {
+					return "", 0, errors.New("invalid escape")
+				}
+				r, err := strconv.ParseUint(s[i+1:i+1+n], 16, 32)
+				if err != nil {
+					return "", 0, errors.New("invalid escape")
+				}
+				b.WriteRune(rune(r))
+				i += n
+			case '\n':
+				// Line continuation
+			default:
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+func isASCIILetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isASCIIDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// Statements
+type pacStmt interface{}
+
+type pacBlock struct {
+	stmts []pacStmt
+}
+
+type pacVarDecl struct {
+	names []string
+	inits []pacExpr
+}
+
+type pacFuncDecl struct {
+	name string
+	fn   *pacFuncLit
+}
+
+type pacIf struct {
+	cond      pacExpr
+	then, els pacStmt
+}
+
+type pacReturn struct {
+	x pacExpr
+}
+
+// pacFor is a for or while loop.
+type pacFor struct {
+	init       pacStmt
+	cond, post pacExpr
+	body       pacStmt
+}
+
+type pacExprStmt struct {
+	x pacExpr
+}
+
+type pacBreak struct{}
+
+type pacContinue struct{}
+
+// Expressions
+type pacExpr interface{}
+
+type pacLiteral struct {
+	v any
+}
+
+type pacIdentExpr struct {
+	name string
+}
+
+type pacArrayLit struct {
+	elems []pacExpr
+}
+
+type pacFuncLit struct {
+	params []string
+	body   []pacStmt
+}
+
+type pacUnary struct {
+	op string
+	x  pacExpr
+}
+
+type pacBinary struct {
+	op   string
+	x, y pacExpr
+}
+
+type pacConditional struct {
+	cond, a, b pacExpr
+}
+
+type pacAssign struct {
+	op            string
+	target, value pacExpr
+}
+
+type pacUpdate struct {
+	op     string
+	prefix bool
+	target pacExpr
+}
+
+type pacMember struct {
+	x    pacExpr
+	name string
+}
+
+type pacIndex struct {
+	x, index pacExpr
+}
+
+type pacCall struct {
+	fn   pacExpr
+	args []pacExpr
+}
+
+type pacParser struct {
+	toks    []pacToken
+	pos     int
+	nesting int
+}
+
+func parsePAC(src string) ([]pacStmt, error) {
+	toks, err := lexPAC(src)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPACHelpers(toks); err != nil {
+		return nil, err
+	}
+	p := &pacParser{toks: toks}
+	var stmts []pacStmt
+	for p.peek().kind != pacTokEOF {
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, s)
+	}
+	return stmts, nil
+}
+
+// checkPACHelpers rejects the calls of the unsupported helper functions
+// that the script does not define itself.
+func checkPACHelpers(toks []pacToken) error {
+	defined := make(map[string]bool)
+	for i := 1; i < len(toks); i++ {
+		if toks[i-1].kind == pacTokIdent && toks[i-1].text == "function" && toks[i].kind == pacTokIdent {
+			defined[toks[i].text] = true
+		}
+	}
+	for i := 0; i+1 < len(toks); i++ {
+		t := toks[i]
+		if t.kind == pacTokIdent && pacUnsupportedHelpers[t.text] && !defined[t.text] &&
+			toks[i+1].kind == pacTokPunct && toks[i+1].text == "(" {
+			return pacUnsupported(t.line, "%s is not supported", t.text)
+		}
+	}
+	return nil
+}
+
+func (p *pacParser) peek() pacToken {
+	return p.toks[p.pos]
+}
+
+func (p *pacParser) next() pacToken {
+	t := p.toks[p.pos]
+	if t.kind != pacTokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *pacParser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == pacTokPunct || t.kind == pacTokIdent) && t.text == text
+}
+
+func (p *pacParser) accept(text string) bool {
+	if p.is(text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *pacParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: line %d: %s", errPACSyntax, p.peek().line, fmt.Sprintf(format, args...))
+}
+
+func (p *pacParser) expect(text string) error {
+	if !p.accept(text) {
+		t := p.peek()
+		if t.kind == pacTokEOF {
+			return p.errorf("expected %q, got end of script", text)
+		}
+		return p.errorf("expected %q, got %q", text, t.text)
+	}
+	return nil
+}
+
+func (p *pacParser) ident() (string, error) {
+	t := p.peek()
+	if t.kind != pacTokIdent {
+		return "", p.errorf("expected identifier, got %q", t.text)
+	}
+	p.pos++
+	return t.text, nil
+}
+
+// endStatement consumes the optional semicolon ending a statement.
+func (p *pacParser) endStatement() {
+	p.accept(";")
+}
+
+// nest enters a level of nesting, to be left by calling the returned
+// function.
+func (p *pacParser) nest() (func(), error) {
+	p.nesting++
+	leave := func() { p.nesting-- }
+	if p.nesting > pacMaxNesting {
+		return leave, fmt.Errorf("%w: line %d", errPACNesting, p.peek().line)
+	}
+	return leave, nil
+}
+
+func (p *pacParser) statement() (pacStmt, error) {
+	leave, err := p.nest()
+	defer leave()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case p.accept(";"):
+		return &pacBlock{}, nil
+	case p.is("{"):
+		return p.block()
+	case p.is("var"), p.is("let"), p.is("const"):
+		s, err := p.varDecl()
+		p.endStatement()
+		return s, err
+	case p.is("function") && p.toks[p.pos+1].kind == pacTokIdent:
+		p.pos++
+		name, _ := p.ident()
+		fn, err := p.funcRest()
+		if err != nil {
+			return nil, err
+		}
+		return &pacFuncDecl{name: name, fn: fn}, nil
+	case p.accept("if"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		cond, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		then, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		s := &pacIf{cond: cond, then: then}
+		if p.accept("else") {
+			if s.els, err = p.statement(); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	case p.accept("return"):
+		s := &pacReturn{}
+		if !p.is(";") && !p.is("}") && p.peek().kind != pacTokEOF {
+			x, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			s.x = x
+		}
+		p.endStatement()
+		return s, nil
+	case p.accept("for"):
+		return p.forStatement()
+	case p.accept("while"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		cond, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		body, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		return &pacFor{cond: cond, body: body}, nil
+	case p.accept("break"):
+		p.endStatement()
+		return &pacBreak{}, nil
+	case p.accept("continue"):
+		p.endStatement()
+		return &pacContinue{}, nil
+	}
+	x, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	p.endStatement()
+	return &pacExprStmt{x: x}, nil
+}
+
+func (p *pacParser) block() (*pacBlock, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	b := &pacBlock{}
+	for !p.accept("}") {
+		if p.peek().kind == pacTokEOF {
+			return nil, p.errorf("expected %q, got end of script", "}")
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		b.stmts = append(b.stmts, s)
+	}
+	return b, nil
+}
+
+func (p *pacParser) varDecl() (*pacVarDecl, error) {
+	p.pos++ // var, let or const
+	d := &pacVarDecl{}
+	for {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		var init pacExpr
+		if p.accept("=") {
+			if init, err = p.assignment(); err != nil {
+				return nil, err
+			}
+		}
+		d.names = append(d.names, name)
+		d.inits = append(d.inits, init)
+		if !p.accept(",") {
+			return d, nil
+		}
+	}
+}
+
+func (p *pacParser) forStatement() (pacStmt, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	s := &pacFor{}
+	var err error
+	switch {
+	case p.is(";"):
+	case p.is("var"), p.is("let"), p.is("const"):
+		if s.init, err = p.varDecl(); err != nil {
+			return nil, err
+		}
+	default:
+		x, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		s.init = &pacExprStmt{x: x}
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.is(";") {
+		if s.cond, err = p.expression(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.is(")") {
+		if s.post, err = p.expression(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if s.body, err = p.statement(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// funcRest parses the parameters and body of a function.
+func (p *pacParser) funcRest() (*pacFuncLit, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	fn := &pacFuncLit{}
+	for !p.accept(")") {
+		if len(fn.params) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		fn.params = append(fn.params, name)
+	}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	fn.body = body.stmts
+	return fn, nil
+}
+
+func (p *pacParser) expression() (pacExpr, error) {
+	x, err := p.assignment()
+	for err == nil && p.accept(",") {
+		var y pacExpr
+		if y, err = p.assignment(); err == nil {
+			x = &pacBinary{op: ",", x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+func (p *pacParser) assignment() (pacExpr, error) {
+	leave, err := p.nest()
+	defer leave()
+	if err != nil {
+		return nil, err
+	}
+	x, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"=", "+=", "-="} {
+		if p.accept(op) {
+			switch x.(type) {
+			case *pacIdentExpr, *pacIndex, *pacMember:
+			default:
+				return nil, p.errorf("invalid assignment target")
+			}
+			value, err := p.assignment()
+			if err != nil {
+				return nil, err
+			}
+			return &pacAssign{op: op, target: x, value: value}, nil
+		}
+	}
+	return x, nil
+}
+
+func (p *pacParser) conditional() (pacExpr, error) {
+	cond, err := p.binary(0)
+	if err != nil || !p.accept("?") {
+		return cond, err
+	}
+	a, err := p.assignment()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	b, err := p.assignment()
+	if err != nil {
+		return nil, err
+	}
+	return &pacConditional{cond: cond, a: a, b: b}, nil
+}
+
+// pacPrecedence lists the binary operators from the lowest precedence.
+var pacPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"===", "!==", "==", "!="},
+	{"<=", ">=", "<", ">"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *pacParser) binary(level int) (pacExpr, error) {
+	if level == len(pacPrecedence) {
+		return p.unary()
+	}
+	x, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		matched := false
+		if t.kind == pacTokPunct {
+			for _, op := range pacPrecedence[level] {
+				if t.text == op {
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = &pacBinary{op: t.text, x: x, y: y}
+	}
+}
+
+func (p *pacParser) unary() (pacExpr, error) {
+	leave, err := p.nest()
+	defer leave()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t.kind == pacTokPunct && (t.text == "!" || t.text == "-" || t.text == "+") || t.kind == pacTokIdent && t.text == "typeof" {
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &pacUnary{op: t.text, x: x}, nil
+	}
+	if t.kind == pacTokPunct && (t.text == "++" || t.text == "--") {
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &pacUpdate{op: t.text, prefix: true, target: x}, nil
+	}
+	x, err := p.postfix()
+	if err != nil {
+		return nil, err
+	}
+	if p.is("++") || p.is("--") {
+		return &pacUpdate{op: p.next().text, target: x}, nil
+	}
+	return x, nil
+}
+
+func (p *pacParser) postfix() (pacExpr, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			x = &pacMember{x: x, name: name}
+		case p.accept("["):
+			index, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &pacIndex{x: x, index: index}
+		case p.accept("("):
+			call := &pacCall{fn: x}
+			for !p.accept(")") {
+				if len(call.args) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+				arg, err := p.assignment()
+				if err != nil {
+					return nil, err
+				}
+				call.args = append(call.args, arg)
+			}
+			x = call
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *pacParser) primary() (pacExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case pacTokNumber:
+		return &pacLiteral{v: t.num}, nil
+	case pacTokString:
+		return &pacLiteral{v: t.text}, nil
+	case pacTokIdent:
+		switch t.text {
+		case "true":
+			return &pacLiteral{v: true}, nil
+		case "false":
+			return &pacLiteral{v: false}, nil
+		case "null":
+			return &pacLiteral{v: pacNull{}}, nil
+		case "undefined":
+			return &pacLiteral{v: pacUndefined{}}, nil
+		case "function":
+			return p.funcRest()
+		}
+		if feature, ok := pacUnsupportedKeywords[t.text]; ok {
+			return nil, pacUnsupported(t.line, "%s are not supported", feature)
+		}
+		return &pacIdentExpr{name: t.text}, nil
+	case pacTokPunct:
+		switch t.text {
+		case "(":
+			x, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			a := &pacArrayLit{}
+			for !p.accept("]") {
+				if len(a.elems) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+					if p.accept("]") {
+						break
+					}
+				}
+				elem, err := p.assignment()
+				if err != nil {
+					return nil, err
+				}
+				a.elems = append(a.elems, elem)
+			}
+			return a, nil
+		case "{":
+			return nil, pacUnsupported(t.line, "objects are not supported")
+		}
+	case pacTokEOF:
+		p.pos = len(p.toks) - 1
+		return nil, p.errorf("unexpected end of script")
+	}
+	p.pos--
+	return nil, p.errorf("unexpected %q", t.text)
+}
+
+// Values are pacUndefined, pacNull, bool, float64, string, *pacArray,
+// *pacClosure and pacBuiltin.
+type (
+	pacUndefined struct{}
+	pacNull      struct{}
+	pacArray     struct{ elems []any }
+	pacClosure   struct {
+		fn  *pacFuncLit
+		env *pacEnv
+	}
+	pacBuiltin func(in *pacInterp, args []any) (any, error)
+)
+
+type pacEnv struct {
+	vars   map[string]any
+	parent *pacEnv
+}
+
+func newPACEnv(parent *pacEnv) *pacEnv {
+	return &pacEnv{vars: make(map[string]any), parent: parent}
+}
+
+func (e *pacEnv) lookup(name string) (any, bool) {
+	for ; e != nil; e = e.parent {
+		if v, ok := e.vars[name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func (e *pacEnv) set(name string, v any) {
+	for s := e; s != nil; s = s.parent {
+		if _, ok := s.vars[name]; ok || s.parent == nil {
+			s.vars[name] = v
+			return
+		}
+	}
+}
+
+type pacCompletion int
+
+const (
+	pacNormal pacCompletion = iota
+	pacReturned
+	pacBroke
+	pacContinued
+)
+
+// pacInterp runs a PAC script. It is not safe for concurrent use.
+type pacInterp struct {
+	global    *pacEnv
+	steps     int
+	depth     int
+	nesting   int
+	allocated int // bytes of the values built, see eval
+	// host provides the PAC helper functions with DNS and the local address.
+	host pacHost
+}
+
+func newPACInterp(host pacHost) *pacInterp {
+	in := &pacInterp{global: newPACEnv(nil), host: host}
+	for name, fn := range pacBuiltins {
+		in.global.vars[name] = fn
+	}
+	return in
+}
+
+// reset prepares in to call the functions of a script again with host.
+func (in *pacInterp) reset(host pacHost) {
+	in.host = host
+	in.steps, in.depth, in.nesting, in.allocated = 0, 0, 0, 0
+}
+
+// run runs the top level statements of a script.
+func (in *pacInterp) run(stmts []pacStmt) error {
+	_, _, err := in.execList(stmts, in.global)
+	return err
+}
+
+// call calls the global function name.
+func (in *pacInterp) call(name string, args ...any) (any, error) {
+	fn, ok := in.global.lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("httptunnel: pac: %s is not defined", name)
+	}
+	return in.callValue(fn, args)
+}
+
+func (in *pacInterp) callValue(fn any, args []any) (any, error) {
+	switch fn := fn.(type) {
+	case pacBuiltin:
+		return fn(in, args)
+	case *pacClosure:
+		if in.depth >= pacMaxDepth {
+			return nil, errors.New("httptunnel: pac: maximum call depth exceeded")
+		}
+		in.depth++
+		defer func() { in.depth-- }()
+		env := newPACEnv(fn.env)
+		for i, param := range fn.fn.params {
+			if i < len(args) {
+				env.vars[param] = args[i]
+			} else {
+				env.vars[param] = pacUndefined{}
+			}
+		}
+		completion, v, err := in.execList(fn.fn.body, env)
+		if err != nil || completion != pacReturned {
+			return pacUndefined{}, err
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("httptunnel: pac: %s is not a function", pacTypeof(fn))
+}
+
+// execList runs a list of statements in env, after hoisting its function
+// declarations.
+func (in *pacInterp) execList(stmts []pacStmt, env *pacEnv) (pacCompletion, any, error) {
+	for _, s := range stmts {
+		if d, ok := s.(*pacFuncDecl); ok {
+			env.vars[d.name] = &pacClosure{fn: d.fn, env: env}
+		}
+	}
+	for _, s := range stmts {
+		completion, v, err := in.exec(s, env)
+		if err != nil || completion != pacNormal {
+			return completion, v, err
+		}
+	}
+	return pacNormal, nil, nil
+}
+
+func (in *pacInterp) exec(s pacStmt, env *pacEnv) (pacCompletion, any, error) {
+	in.steps++
+	if in.steps > pacMaxSteps {
+		return 0, nil, errors.New("httptunnel: pac: script takes too long")
+	}
+	in.nesting++
+	defer func() { in.nesting-- }()
+	if in.nesting > pacMaxNesting {
+		return 0, nil, errPACNesting
+	}
+	switch s := s.(type) {
+	case *pacBlock:
+		return in.execList(s.stmts, newPACEnv(env))
+	case *pacFuncDecl:
+		// Hoisted by execList
+	case *pacVarDecl:
+		for i, name := range s.names {
+			var v any = pacUndefined{}
+			if s.inits[i] != nil {
+				var err error
+				if v, err = in.eval(s.inits[i], env); err != nil {
+					return 0, nil, err
+				}
+			}
+			env.vars[name] = v
+		}
+	case *pacIf:
+		cond, err := in.eval(s.cond, env)
+		if err != nil {
+			return 0, nil, err
+		}
+		if pacTruthy(cond) {
+			return in.exec(s.then, env)
+		} else if s.els != nil {
+			return in.exec(s.els, env)
+		}
+	case *pacReturn:
+		if s.x == nil {
+			return pacReturned, pacUndefined{}, nil
+		}
+		v, err := in.eval(s.x, env)
+		return pacReturned, v, err
+	case *pacFor:
+		env = newPACEnv(env)
+		if s.init != nil {
+			if _, _, err := in.exec(s.init, env); err != nil {
+				return 0, nil, err
+			}
+		}
+		for {
+			if s.cond != nil {
+				cond, err := in.eval(s.cond, env)
+				if err != nil {
+					return 0, nil, err
+				}
+				if !pacTruthy(cond) {
+					break
+				}
+			}
+			completion, v, err := in.exec(s.body, env)
+			if err != nil || completion == pacReturned {
+				return completion, v, err
+			}
+			if completion == pacBroke {
+				break
+			}
+			if s.post != nil {
+				if _, err := in.eval(s.post, env); err != nil {
+					return 0, nil, err
+				}
+			}
+			in.steps++
+			if in.steps > pacMaxSteps {
+				return 0, nil, errors.New("httptunnel: pac: script takes too long")
+			}
+		}
+	case *pacExprStmt:
+		_, err := in.eval(s.x, env)
+		return pacNormal, nil, err
+	case *pacBreak:
+		return pacBroke, nil, nil
+	case *pacContinue:
+		return pacContinued, nil, nil
+	}
+	return pacNormal, nil, nil
+}
+
+// eval evaluates x in env. So that a script cannot exhaust the memory, the
+// strings longer than pacMaxString are rejected, and the values built by the
+// expressions that allocate are charged against pacMaxAlloc.
+func (in *pacInterp) eval(x pacExpr, env *pacEnv) (any, error) {
+	in.nesting++
+	defer func() { in.nesting-- }()
+	if in.nesting > pacMaxNesting {
+		return nil, errPACNesting
+	}
+	v, err := in.evalExpr(x, env)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := v.(string); ok && len(s) > pacMaxString {
+		return nil, errPACStringTooLong
+	}
+	switch x := x.(type) {
+	case *pacBinary, *pacArrayLit:
+		in.allocated += pacValueSize(v)
+	case *pacAssign:
+		if x.op != "=" {
+			in.allocated += pacValueSize(v)
+		}
+	case *pacCall:
+		// The arguments may be pushed to an array
+		in.allocated += pacValueSize(v) + pacElemSize*len(x.args)
+	}
+	if in.allocated > pacMaxAlloc {
+		return nil, errPACMemory
+	}
+	return v, nil
+}
+
+// pacValueSize approximates the memory held by v, not counting the elements
+// of the arrays.
+func pacValueSize(v any) int {
+	switch v := v.(type) {
+	case string:
+		return len(v)
+	case *pacArray:
+		return pacElemSize * len(v.elems)
+	}
+	return 0
+}
+
+func (in *pacInterp) evalExpr(x pacExpr, env *pacEnv) (any, error) {
+	switch x := x.(type) {
+	case *pacLiteral:
+		return x.v, nil
+	case *pacIdentExpr:
+		v, ok := env.lookup(x.name)
+		if !ok {
+			return nil, fmt.Errorf("httptunnel: pac: %s is not defined", x.name)
+		}
+		return v, nil
+	case *pacArrayLit:
+		a := &pacArray{}
+		for _, elem := range x.elems {
+			v, err := in.eval(elem, env)
+			if err != nil {
+				return nil, err
+			}
+			a.elems = append(a.elems, v)
+		}
+		return a, nil
+	case *pacFuncLit:
+		return &pacClosure{fn: x, env: env}, nil
+	case *pacUnary:
+		if x.op == "typeof" {
+			if id, ok := x.x.(*pacIdentExpr); ok {
+				if _, ok := env.lookup(id.name); !ok {
+					return "undefined", nil
+				}
+			}
+		}
+		v, err := in.eval(x.x, env)
+		if err != nil {
+			return nil, err
+		}
+		switch x.op {
+		case "!":
+			return !pacTruthy(v), nil
+		case "-":
+			return -pacNumber(v), nil
+		case "+":
+			return pacNumber(v), nil
+		default:
+			return pacTypeof(v), nil
+		}
+	case *pacBinary:
+		return in.evalBinary(x, env)
+	case *pacConditional:
+		cond, err := in.eval(x.cond, env)
+		if err != nil {
+			return nil, err
+		}
+		if pacTruthy(cond) {
+			return in.eval(x.a, env)
+		}
+		return in.eval(x.b, env)
+	case *pacAssign:
+		v, err := in.eval(x.value, env)
+		if err != nil {
+			return nil, err
+		}
+		if x.op != "=" {
+			old, err := in.eval(x.target, env)
+			if err != nil {
+				return nil, err
+			}
+			if x.op == "+=" {
+				v = pacAdd(old, v)
+			} else {
+				v = pacNumber(old) - pacNumber(v)
+			}
+		}
+		return v, in.assign(x.target, v, env)
+	case *pacUpdate:
+		old, err := in.eval(x.target, env)
+		if err != nil {
+			return nil, err
+		}
+		n := pacNumber(old)
+		v := n + 1
+		if x.op == "--" {
+			v = n - 1
+		}
+		if err := in.assign(x.target, v, env); err != nil {
+			return nil, err
+		}
+		if x.prefix {
+			return v, nil
+		}
+		return n, nil
+	case *pacMember:
+		v, err := in.eval(x.x, env)
+		if err != nil {
+			return nil, err
+		}
+		return pacProperty(v, x.name)
+	case *pacIndex:
+		v, err := in.eval(x.x, env)
+		if err != nil {
+			return nil, err
+		}
+		index, err := in.eval(x.index, env)
+		if err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case *pacArray:
+			if i, ok := pacArrayIndex(index); ok && i < len(v.elems) {
+				return v.elems[i], nil
+			}
+			return pacUndefined{}, nil
+		case string:
+			if i, ok := pacArrayIndex(index); ok && i < len(v) {
+				return v[i : i+1], nil
+			}
+			return pacUndefined{}, nil
+		}
+		return pacProperty(v, pacString(index))
+	case *pacCall:
+		return in.evalCall(x, env)
+	}
+	return nil, fmt.Errorf("httptunnel: pac: unsupported expression %T", x)
+}
+
+func (in *pacInterp) evalBinary(x *pacBinary, env *pacEnv) (any, error) {
+	a, err := in.eval(x.x, env)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case "&&":
+		if !pacTruthy(a) {
+			return a, nil
+		}
+		return in.eval(x.y, env)
+	case "||":
+		if pacTruthy(a) {
+			return a, nil
+		}
+		return in.eval(x.y, env)
+	}
+	b, err := in.eval(x.y, env)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case ",":
+		return b, nil
+	case "+":
+		return pacAdd(a, b), nil
+	case "-":
+		return pacNumber(a) - pacNumber(b), nil
+	case "*":
+		return pacNumber(a) * pacNumber(b), nil
+	case "/":
+		return pacNumber(a) / pacNumber(b), nil
+	case "%":
+		return math.Mod(pacNumber(a), pacNumber(b)), nil
+	case "===":
+		return pacStrictEquals(a, b), nil
+	case "!==":
+		return !pacStrictEquals(a, b), nil
+	case "==":
+		return pacLooseEquals(a, b), nil
+	case "!=":
+		return !pacLooseEquals(a, b), nil
+	}
+	// Relational operators
+	as, aok := a.(string)
+	bs, bok := b.(string)
+	if aok && bok {
+		switch x.op {
+		case "<":
+			return as < bs, nil
+		case ">":
+			return as > bs, nil
+		case "<=":
+			return as <= bs, nil
+		default:
+			return as >= bs, nil
+		}
+	}
+	an, bn := pacNumber(a), pacNumber(b)
+	switch x.op {
+	case "<":
+		return an < bn, nil
+	case ">":
+		return an > bn, nil
+	case "<=":
+		return an <= bn, nil
+	default:
+		return an >= bn, nil
+	}
+}
+
+func (in *pacInterp) evalCall(x *pacCall, env *pacEnv) (any, error) {
+	args := make([]any, len(x.args))
+	evalArgs := func() error {
+		for i, arg := range x.args {
+			v, err := in.eval(arg, env)
+			if err != nil {
+				return err
+			}
+			args[i] = v
+		}
+		return nil
+	}
+	if m, ok := x.fn.(*pacMember); ok {
+		recv, err := in.eval(m.x, env)
+		if err != nil {
+			return nil, err
+		}
+		if err := evalArgs(); err != nil {
+			return nil, err
+		}
+		return pacMethod(recv, m.name, args)
+	}
+	fn, err := in.eval(x.fn, env)
+	if err != nil {
+		return nil, err
+	}
+	if err := evalArgs(); err != nil {
+		return nil, err
+	}
+	return in.callValue(fn, args)
+}
+
+func (in *pacInterp) assign(target pacExpr, v any, env *pacEnv) error {
+	switch t := target.(type) {
+	case *pacIdentExpr:
+		env.set(t.name, v)
+		return nil
+	case *pacIndex:
+		recv, err := in.eval(t.x, env)
+		if err != nil {
+			return err
+		}
+		index, err := in.eval(t.index, env)
+		if err != nil {
+			return err
+		}
+		a, ok := recv.(*pacArray)
+		i, valid := pacArrayIndex(index)
+		if !ok || !valid || i > 1<<20 {
+			return errors.New("httptunnel: pac: unsupported assignment")
+		}
+		for len(a.elems) <= i {
+			a.elems = append(a.elems, pacUndefined{})
+		}
+		a.elems[i] = v
+		return nil
+	}
+	return errors.New("httptunnel: pac: unsupported assignment")
+}
+
+func pacArrayIndex(v any) (int, bool) {
+	f := pacNumber(v)
+	if f < 0 || f != math.Trunc(f) || f > math.MaxInt32 {
+		return 0, false
+	}
+	return int(f), true
+}
+
+func pacProperty(v any, name string) (any, error) {
+	switch v := v.(type) {
+	case string:
+		if name == "length" {
+			return float64(len(v)), nil
+		}
+	case *pacArray:
+		if name == "length" {
+			return float64(len(v.elems)), nil
+		}
+	case pacUndefined, pacNull:
+		return nil, fmt.Errorf("httptunnel: pac: cannot read property %q of %s", name, pacString(v))
+	}
+	return pacUndefined{}, nil
+}
+
+func pacMethod(recv any, name string, args []any) (any, error) {
+	arg := func(i int) any {
+		if i < len(args) {
+			return args[i]
+		}
+		return pacUndefined{}
+	}
+	switch recv := recv.(type) {
+	case string:
+		switch name {
+		case "toLowerCase":
+			return strings.ToLower(recv), nil
+		case "toUpperCase":
+			return strings.ToUpper(recv), nil
+		case "trim":
+			return strings.TrimSpace(recv), nil
+		case "indexOf":
+			return float64(strings.Index(recv, pacString(arg(0)))), nil
+		case "lastIndexOf":
+			return float64(strings.LastIndex(recv, pacString(arg(0)))), nil
+		case "startsWith":
+			return strings.HasPrefix(recv, pacString(arg(0))), nil
+		case "endsWith":
+			return strings.HasSuffix(recv, pacString(arg(0))), nil
+		case "includes":
+			return strings.Contains(recv, pacString(arg(0))), nil
+		case "charAt":
+			i := pacClamp(arg(0), len(recv), 0)
+			if i >= len(recv) {
+				return "", nil
+			}
+			return recv[i : i+1], nil
+		case "substring":
+			start, end := pacClamp(arg(0), len(recv), 0), pacClamp(arg(1), len(recv), len(recv))
+			if start > end {
+				start, end = end, start
+			}
+			return recv[start:end], nil
+		case "substr":
+			start := pacRelative(arg(0), len(recv), 0)
+			length := pacClamp(arg(1), len(recv)-start, len(recv)-start)
+			return recv[start : start+length], nil
+		case "slice":
+			start, end := pacRelative(arg(0), len(recv), 0), pacRelative(arg(1), len(recv), len(recv))
+			if start > end {
+				return "", nil
+			}
+			return recv[start:end], nil
+		case "split":
+			if _, ok := arg(0).(pacUndefined); ok {
+				return &pacArray{elems: []any{recv}}, nil
+			}
+			a := &pacArray{}
+			for _, s := range strings.Split(recv, pacString(arg(0))) {
+				a.elems = append(a.elems, s)
+			}
+			return a, nil
+		case "toString":
+			return recv, nil
+		}
+	case *pacArray:
+		switch name {
+		case "indexOf":
+			for i, v := range recv.elems {
+				if pacStrictEquals(v, arg(0)) {
+					return float64(i), nil
+				}
+			}
+			return float64(-1), nil
+		case "join":
+			sep := ","
+			if _, ok := arg(0).(pacUndefined); !ok {
+				sep = pacString(arg(0))
+			}
+			var b strings.Builder
+			recv.appendString(&b, sep, nil)
+			return b.String(), nil
+		case "push":
+			recv.elems = append(recv.elems, args...)
+			return float64(len(recv.elems)), nil
+		}
+	}
+	return nil, fmt.Errorf("httptunnel: pac: unsupported method %s of %s", name, pacTypeof(recv))
+}
+
+// pacClamp converts an optional index argument to an int within [0, n].
+func pacClamp(v any, n, def int) int {
+	if _, ok := v.(pacUndefined); ok {
+		return def
+	}
+	f := pacNumber(v)
+	switch {
+	case math.IsNaN(f) || f < 0:
+		return 0
+	case f > float64(n):
+		return n
+	}
+	return int(f)
+}
+
+// pacRelative converts an optional index argument that may be relative to
+// the end to an int within [0, n].
+func pacRelative(v any, n, def int) int {
+	if _, ok := v.(pacUndefined); ok {
+		return def
+	}
+	f := pacNumber(v)
+	if f < 0 {
+		f += float64(n)
+	}
+	return pacClamp(f, n, def)
+}
+
+func pacTruthy(v any) bool {
+	switch v := v.(type) {
+	case pacUndefined, pacNull:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+func pacNumber(v any) float64 {
+	switch v := v.(type) {
+	case pacNull:
+		return 0
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case float64:
+		return v
+	case string:
+		s := strings.TrimSpace(v)
+		if s == "" {
+			return 0
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return math.NaN()
+}
+
+func pacString(v any) string {
+	switch v := v.(type) {
+	case pacUndefined:
+		return "undefined"
+	case pacNull:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return "NaN"
+		case math.IsInf(v, 1):
+			return "Infinity"
+		case math.IsInf(v, -1):
+			return "-Infinity"
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	case *pacArray:
+		var b strings.Builder
+		v.appendString(&b, ",", nil)
+		return b.String()
+	}
+	return "function"
+}
+
+// appendString appends the elements of a separated by sep to b, the
+// undefined elements and the arrays containing themselves being empty, as in
+// JavaScript. It stops once b is longer than pacMaxString, for eval to
+// reject the result.
+func (a *pacArray) appendString(b *strings.Builder, sep string, seen []*pacArray) {
+	if len(seen) >= pacMaxDepth || slices.Contains(seen, a) {
+		return
+	}
+	seen = append(seen, a)
+	for i, e := range a.elems {
+		if b.Len() > pacMaxString {
+			return
+		}
+		if i > 0 {
+			b.WriteString(sep)
+		}
+		switch e := e.(type) {
+		case pacUndefined:
+		case *pacArray:
+			e.appendString(b, ",", seen)
+		default:
+			b.WriteString(pacString(e))
+		}
+	}
+}
+
+func pacTypeof(v any) string {
+	switch v.(type) {
+	case pacUndefined:
+		return "undefined"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *pacClosure, pacBuiltin:
+		return "function"
+	}
+	return "object"
+}
+
+func pacAdd(a, b any) any {
+	_, as := a.(string)
+	_, bs := b.(string)
+	_, aa := a.(*pacArray)
+	_, ba := b.(*pacArray)
+	if as || bs || aa || ba {
+		return pacString(a) + pacString(b)
+	}
+	return pacNumber(a) + pacNumber(b)
+}
+
+func pacStrictEquals(a, b any) bool {
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		return ok && a == b
+	case *pacClosure:
+		b, ok := b.(*pacClosure)
+		return ok && a == b
+	case pacBuiltin:
+		return false
+	}
+	return a == b
+}
+
+func pacLooseEquals(a, b any) bool {
+	isNullish := func(v any) bool {
+		switch v.(type) {
+		case pacUndefined, pacNull:
+			return true
+		}
+		return false
+	}
+	switch {
+	case isNullish(a) || isNullish(b):
+		return isNullish(a) && isNullish(b)
+	case pacTypeof(a) == pacTypeof(b):
+		return pacStrictEquals(a, b)
+	}
+	_, aa := a.(*pacArray)
+	_, ba := b.(*pacArray)
+	if aa || ba {
+		return pacString(a) == pacString(b)
+	}
+	return pacNumber(a) == pacNumber(b)
+}
@@ -0,0 +1,120 @@
+package httptunnel
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strings"
+)
+
+// A Pin is the SHA-256 hash of the SubjectPublicKeyInfo of a certificate, as
+// used by HTTP public key pinning (RFC 7469).
+type Pin [sha256.Size]byte
+
+// PublicKeyPin returns the pin of the public key of cert.
+func PublicKeyPin(cert *x509.Certificate) Pin {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// ParsePin parses a pin in the base64 encoding of its hash, optionally
+// prefixed with "sha256/", as printed by:
+//
+//	openssl x509 -pubkey -noout -in cert.pem | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func ParsePin(s string) (Pin, error) {
+	var pin Pin
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, "sha256/"))
+	if err != nil || len(b) != len(pin) {
+		return pin, errors.New("httptunnel: invalid pin " + s)
+	}
+	copy(pin[:], b)
+	return pin, nil
+}
+
+func (p Pin) String() string {
+	return "sha256/" + base64.StdEncoding.EncodeToString(p[:])
+}
+
+// HostPins are the pins of the certificates of a host. A certificate chain
+// is accepted when one of its certificates matches one of the pins, backup
+// pins or certificates.
+type HostPins struct {
+	// Pins are the pins of the public keys in use.
+	Pins []Pin
+
+	// BackupPins are the pins of the public keys the host is expected to
+	// roll over to. A match is accepted and logged as a warning.
+	BackupPins []Pin
+
+	// Certificates are pinned certificates, matched exactly.
+	Certificates []*x509.Certificate
+
+	// SkipChainVerification, if true, checks the pins instead of verifying
+	// the certificate chain and host name, for example for hosts with
+	// self-signed certificates. Only the leaf certificate can then match,
+	// since the others are not authenticated by the handshake.
+	SkipChainVerification bool
+}
+
+// A PinSet maps host names, in lower case, to the pins of their
+// certificates. The pins of a host are checked after the TLS handshakes with
+// it, and hosts without pins are not checked.
+//
+// Pins are not checked for the connections returned by
+// Dialer.NetDialTLSContext.
+type PinSet map[string]HostPins
+
+// configure skips the chain verification in cfg if the pins of its server
+// replace it.
+func (s PinSet) configure(cfg *tls.Config) {
+	if s[strings.ToLower(cfg.ServerName)].SkipChainVerification {
+		cfg.InsecureSkipVerify = true
+	}
+}
+
+// verify checks the certificates of a handshake with host against its pins.
+// It reports whether they matched a backup pin.
+func (s PinSet) verify(host string, state tls.ConnectionState) (backup bool, err error) {
+	pins, ok := s[strings.ToLower(host)]
+	if !ok || len(state.PeerCertificates) == 0 {
+		return false, nil
+	}
+
+	certs := []*x509.Certificate{state.PeerCertificates[0]}
+	for _, chain := range state.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+	for _, cert := range certs {
+		if slices.ContainsFunc(pins.Certificates, cert.Equal) ||
+			slices.Contains(pins.Pins, PublicKeyPin(cert)) {
+			return false, nil
+		}
+	}
+	for _, cert := range certs {
+		if slices.Contains(pins.BackupPins, PublicKeyPin(cert)) {
+			return true, nil
+		}
+	}
+
+	pinErr := &PinError{Host: host}
+	for _, cert := range state.PeerCertificates {
+		pinErr.Pins = append(pinErr.Pins, PublicKeyPin(cert))
+	}
+	return false, pinErr
+}
+
+// A PinError is returned when the certificates of a host match none of its
+// pins, for example because a middlebox intercepts the connection. It is
+// wrapped in a DialError of phase PhaseTLS.
+type PinError struct {
+	// Host is the host name the certificates were checked for.
+	Host string
+	// Pins are the pins of the certificates presented by the host.
+	Pins []Pin
+}
+
+func (e *PinError) Error() string {
+	return "certificate of " + e.Host + " matches no pin"
+}
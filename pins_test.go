@@ -0,0 +1,78 @@
+package httptunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"testing"
+)
+
+func TestPins(t *testing.T) {
+	s := newTLSServer(t)
+	defer s.Close()
+	leaf, err := x509.ParseCertificate(s.Server.TLS.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin := PublicKeyPin(leaf)
+	var otherPin Pin
+	otherPin[0] = 1
+
+	for _, tt := range []struct {
+		name     string
+		pins     HostPins
+		verify   bool
+		mismatch bool
+	}{
+		{"pin", HostPins{Pins: []Pin{otherPin, pin}}, true, false},
+		{"backup pin", HostPins{Pins: []Pin{otherPin}, BackupPins: []Pin{pin}}, true, false},
+		{"certificate", HostPins{Certificates: []*x509.Certificate{leaf}}, true, false},
+		{"mismatch", HostPins{Pins: []Pin{otherPin}}, true, true},
+		{"skip chain verification", HostPins{Pins: []Pin{pin}, SkipChainVerification: true}, false, false},
+		{"skip chain verification mismatch", HostPins{Pins: []Pin{otherPin}, SkipChainVerification: true}, false, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testDialer
+			d.TLSClientConfig = &tls.Config{}
+			if tt.verify {
+				d.TLSClientConfig.RootCAs = rootCAs(t, s.Server)
+			}
+			d.Pins = PinSet{"127.0.0.1": tt.pins}
+			conn, _, resp, err := d.Dial(s.URL, testDialOptions)
+			if tt.mismatch {
+				var pinErr *PinError
+				if !errors.As(err, &pinErr) || err.(*DialError).Phase != PhaseTLS {
+					t.Fatalf("expected a PinError, got: %v", err)
+				}
+				if len(pinErr.Pins) != 1 || pinErr.Pins[0] != pin {
+					t.Errorf("expected the pins %v, got: %v", []Pin{pin}, pinErr.Pins)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer conn.Close()
+			sendRecv(conn, resp, t)
+		})
+	}
+}
+
+func TestParsePin(t *testing.T) {
+	const s = "sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+	pin, err := ParsePin(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pin.String() != s {
+		t.Errorf("expected %v, got: %v", s, pin)
+	}
+	if _, err := ParsePin(s[7:]); err != nil {
+		t.Error(err)
+	}
+	for _, s := range []string{"sha256/", "sha256/AAAA", "md5/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="} {
+		if _, err := ParsePin(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
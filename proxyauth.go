@@ -0,0 +1,373 @@
+package httptunnel
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A ProxyCredentialsFunc returns the username and password to answer an
+// authentication challenge of the proxy. The realm is the protection space
+// announced by the proxy, possibly empty. If the returned username is empty,
+// the challenge is not answered.
+type ProxyCredentialsFunc func(proxyURL *url.URL, realm string) (username, password string, err error)
+
+// authChallenge is a challenge of a Proxy-Authenticate or WWW-Authenticate
+// header.
+type authChallenge struct {
+	scheme string // lower case
+	params map[string]string
+}
+
+// parseChallenges parses the challenges of the values of a
+// Proxy-Authenticate header as defined in RFC 9110, section 11.6.1.
+// Malformed challenges are skipped.
+func parseChallenges(values []string) []authChallenge {
+	var challenges []authChallenge
+	for _, v := range values {
+		var current *authChallenge
+		for {
+			v = strings.TrimLeft(v, " \t,")
+			if v == "" {
+				break
+			}
+			token := v[:tokenEnd(v)]
+			if token == "" {
+				// Skip to the next element
+				i := strings.IndexByte(v, ',')
+				if i < 0 {
+					break
+				}
+				v = v[i:]
+				continue
+			}
+			rest := strings.TrimLeft(v[len(token):], " \t")
+			if current != nil && strings.HasPrefix(rest, "=") {
+				// An auth-param of the current challenge
+				value, after, ok := parseParamValue(strings.TrimLeft(rest[1:], " \t"))
+				if !ok {
+					break
+				}
+				current.params[strings.ToLower(token)] = value
+				v = after
+				continue
+			}
+			challenges = append(challenges, authChallenge{
+				scheme: strings.ToLower(token),
+				params: make(map[string]string),
+			})
+			current = &challenges[len(challenges)-1]
+			v = rest
+			if tokenEnd(v) > 0 && !strings.HasPrefix(strings.TrimLeft(v[tokenEnd(v):], " \t"), "=") {
+				// A token68, as in Basic challenges of old proxies
+				end := strings.IndexByte(v, ',')
+				if end < 0 {
+					end = len(v)
+				}
+				v = v[end:]
+			}
+		}
+	}
+	return challenges
+}
+
+// tokenEnd returns the length of the token at the start of s.
+func tokenEnd(s string) int {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return i
+		}
+	}
+	return len(s)
+}
+
+// parseParamValue parses a token or a quoted string at the start of s.
+func parseParamValue(s string) (value, rest string, ok bool) {
+	if !strings.HasPrefix(s, `"`) {
+		n := tokenEnd(s)
+		return s[:n], s[n:], n > 0
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), s[i+1:], true
+		case '\\':
+			i++
+			if i < len(s) {
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", false
+}
+
+// authorize returns the Proxy-Authorization header answering the strongest
+// supported challenge, or "" if no challenge is supported or no credentials
+// are available.
+func (hpd *httpProxyDialer) authorize(addr string, values []string) (string, error) {
+	var basic, digest *authChallenge
+	challenges := parseChallenges(values)
+	for i := range challenges {
+		c := &challenges[i]
+		switch c.scheme {
+		case "basic":
+			if basic == nil {
+				basic = c
+			}
+		case "digest":
+			if !digestSupported(c) {
+				continue
+			}
+			if digest == nil || digestStrength(c) > digestStrength(digest) {
+				digest = c
+			}
+		}
+	}
+	challenge := digest
+	if challenge == nil {
+		challenge = basic
+	}
+	if challenge == nil {
+		return "", nil
+	}
+
+	realm := challenge.params["realm"]
+	username, password, err := hpd.proxyCredentials(realm)
+	if err != nil || username == "" {
+		return "", err
+	}
+	hpd.logger.Info("proxy authentication required",
+		"proxy", hpd.proxyURL.Redacted(),
+		"scheme", challenge.scheme,
+		"realm", realm,
+	)
+	if challenge == basic {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+	}
+	return digestAuthorization(challenge, username, password, http.MethodConnect, addr)
+}
+
+// proxyCredentials returns the credentials from the credentials function,
+// or else from the proxy URL.
+func (hpd *httpProxyDialer) proxyCredentials(realm string) (string, string, error) {
+	if hpd.credentials != nil {
+		return hpd.credentials(hpd.proxyURL, realm)
+	}
+	if user := hpd.proxyURL.User; user != nil {
+		password, _ := user.Password()
+		return user.Username(), password, nil
+	}
+	return "", "", nil
+}
+
+var digestHashes = map[string]func() hash.Hash{
+	"":             md5.New,
+	"MD5":          md5.New,
+	"MD5-SESS":     md5.New,
+	"SHA-256":      sha256.New,
+	"SHA-256-SESS": sha256.New,
+}
+
+// digestSupported reports whether the Digest challenge c can be answered.
+func digestSupported(c *authChallenge) bool {
+	if _, ok := digestHashes[strings.ToUpper(c.params["algorithm"])]; !ok || c.params["nonce"] == "" {
+		return false
+	}
+	return digestQOP(c) != "" || c.params["qop"] == ""
+}
+
+// digestQOP returns "auth" if it is offered by the Digest challenge c.
+func digestQOP(c *authChallenge) string {
+	for _, option := range strings.Split(c.params["qop"], ",") {
+		if strings.TrimSpace(option) == "auth" {
+			return "auth"
+		}
+	}
+	return ""
+}
+
+func digestStrength(c *authChallenge) int {
+	if strings.HasPrefix(strings.ToUpper(c.params["algorithm"]), "SHA-256") {
+		return 1
+	}
+	return 0
+}
+
+// digestAuthorization answers a Digest challenge as defined in RFC 7616.
+func digestAuthorization(c *authChallenge, username, password, method, uri string) (string, error) {
+	algorithm := strings.ToUpper(c.params["algorithm"])
+	newHash := digestHashes[algorithm]
+	h := func(s string) string {
+		hh := newHash()
+		hh.Write([]byte(s))
+		return hex.EncodeToString(hh.Sum(nil))
+	}
+
+	realm, nonce := c.params["realm"], c.params["nonce"]
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(b)
+	const nc = "00000001"
+
+	ha1 := h(username + ":" + realm + ":" + password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	qop := digestQOP(c)
+	if v := c.params["qop"]; v != "" && qop == "" {
+		return "", errors.New("httptunnel: unsupported digest qop " + v)
+	}
+	var response string
+	if qop != "" {
+		response = h(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + nonce + ":" + ha2)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Digest ")
+	writeParam := func(k, v string, quoted bool) {
+		if sb.Len() > len("Digest ") {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		if quoted {
+			sb.WriteString(quoteParam(v))
+		} else {
+			sb.WriteString(v)
+		}
+	}
+	writeParam("username", username, true)
+	writeParam("realm", realm, true)
+	writeParam("nonce", nonce, true)
+	writeParam("uri", uri, true)
+	if algorithm != "" {
+		writeParam("algorithm", c.params["algorithm"], false)
+	}
+	writeParam("response", response, true)
+	if opaque, ok := c.params["opaque"]; ok {
+		writeParam("opaque", opaque, true)
+	}
+	if qop != "" {
+		writeParam("qop", qop, false)
+		writeParam("nc", nc, false)
+		writeParam("cnonce", cnonce, true)
+	}
+	return sb.String(), nil
+}
+
+func quoteParam(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// NetrcProxyCredentials returns a ProxyCredentialsFunc looking up the host of
+// the proxy in a netrc file. If path is empty, the file named by the NETRC
+// environment variable, or else .netrc in the home directory, is used. The
+// file is read on each call, so that it can be updated while the program
+// runs. A missing file provides no credentials.
+func NetrcProxyCredentials(path string) ProxyCredentialsFunc {
+	return func(proxyURL *url.URL, realm string) (string, string, error) {
+		p := path
+		if p == "" {
+			p = os.Getenv("NETRC")
+		}
+		if p == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", "", err
+			}
+			p = filepath.Join(home, ".netrc")
+		}
+		b, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) {
+			return "", "", nil
+		}
+		if err != nil {
+			return "", "", err
+		}
+		username, password := lookupNetrc(string(b), proxyURL.Hostname())
+		return username, password, nil
+	}
+}
+
+type netrcEntry struct {
+	login, password string
+}
+
+// lookupNetrc returns the login and password of the machine named host in
+// the netrc data, or of the default entry.
+func lookupNetrc(data, host string) (login, password string) {
+	var found, fallback, current *netrcEntry
+	inMacro := false
+	var pending string // keyword waiting for its value
+	for _, line := range strings.Split(data, "\n") {
+		if inMacro {
+			// Macro definitions end with an empty line
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			switch pending {
+			case "machine":
+				current = nil
+				if found == nil && field == host {
+					found = &netrcEntry{}
+					current = found
+				}
+			case "login":
+				if current != nil {
+					current.login = field
+				}
+			case "password":
+				if current != nil {
+					current.password = field
+				}
+			}
+			if pending != "" {
+				pending = ""
+				continue
+			}
+			switch field {
+			case "default":
+				current = nil
+				if fallback == nil {
+					fallback = &netrcEntry{}
+					current = fallback
+				}
+			case "macdef":
+				current = nil
+				inMacro = true
+			case "machine", "login", "password", "account":
+				pending = field
+			}
+			if inMacro {
+				break
+			}
+		}
+	}
+	switch {
+	case found != nil:
+		return found.login, found.password
+	case fallback != nil:
+		return fallback.login, fallback.password
+	}
+	return "", ""
+}
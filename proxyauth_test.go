@@ -0,0 +1,238 @@
+package httptunnel
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newAuthProxy returns a server that is both a proxy requiring the
+// authorization checked by authorized and the target of the tunnels.
+func newAuthProxy(t *testing.T, challenge string, authorized func(r *http.Request) bool) (*mockServer, *int) {
+	s := newServer(t)
+	connects := 0
+	connect := false
+	origHandler := s.Server.Config.Handler
+	s.Server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			connects++
+			if !authorized(r) {
+				w.Header().Set("Proxy-Authenticate", challenge)
+				http.Error(w, "authentication required", http.StatusProxyAuthRequired)
+				return
+			}
+			connect = true
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if !connect {
+			http.Error(w, "connect not received", http.StatusMethodNotAllowed)
+			return
+		}
+		origHandler.ServeHTTP(w, r)
+	})
+	return s, &connects
+}
+
+func TestProxyDigestAuth(t *testing.T) {
+	const realm, nonce = "proxy@example.com", "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+	s, connects := newAuthProxy(t,
+		`Basic realm="basic", Digest realm="`+realm+`", qop="auth, auth-int", algorithm=SHA-256, nonce="`+nonce+`", opaque="xyz"`,
+		func(r *http.Request) bool {
+			challenges := parseChallenges([]string{r.Header.Get("Proxy-Authorization")})
+			if len(challenges) != 1 || challenges[0].scheme != "digest" {
+				return false
+			}
+			p := challenges[0].params
+			h := func(s string) string {
+				sum := sha256.Sum256([]byte(s))
+				return hex.EncodeToString(sum[:])
+			}
+			ha1 := h("alice:" + realm + ":secret")
+			ha2 := h("CONNECT:" + p["uri"])
+			expected := h(ha1 + ":" + nonce + ":" + p["nc"] + ":" + p["cnonce"] + ":auth:" + ha2)
+			return p["username"] == "alice" && p["uri"] == r.Host &&
+				p["opaque"] == "xyz" && p["qop"] == "auth" && p["response"] == expected
+		},
+	)
+	defer s.Close()
+
+	surl, _ := url.Parse(s.Server.URL)
+	d := testDialer
+	d.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: surl.Host})
+	var realms []string
+	d.ProxyCredentials = func(proxyURL *url.URL, realm string) (string, string, error) {
+		realms = append(realms, realm)
+		return "alice", "secret", nil
+	}
+	conn, _, resp, err := d.Dial("http://tunnel.example"+testRequestURI, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	sendRecv(conn, resp, t)
+	if *connects != 2 {
+		t.Errorf("expected 2 CONNECT requests, got: %v", *connects)
+	}
+	if !reflect.DeepEqual(realms, []string{realm}) {
+		t.Errorf("expected credentials for realm %q, got: %v", realm, realms)
+	}
+}
+
+func TestProxyBasicAuthNetrc(t *testing.T) {
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:hunter2"))
+	s, connects := newAuthProxy(t, `Basic realm="proxy"`, func(r *http.Request) bool {
+		return r.Header.Get("Proxy-Authorization") == expected
+	})
+	defer s.Close()
+
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	err := os.WriteFile(netrc, []byte("machine other.example login eve password x\nmachine 127.0.0.1\n\tlogin bob\n\tpassword hunter2\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	surl, _ := url.Parse(s.Server.URL)
+	d := testDialer
+	d.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: surl.Host})
+	d.ProxyCredentials = NetrcProxyCredentials(netrc)
+	conn, _, resp, err := d.Dial("http://tunnel.example"+testRequestURI, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	sendRecv(conn, resp, t)
+	if *connects != 2 {
+		t.Errorf("expected 2 CONNECT requests, got: %v", *connects)
+	}
+}
+
+func TestProxyAuthUnsupported(t *testing.T) {
+	const digest = `Digest realm="proxy", qop="auth-int", nonce="abc"`
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:hunter2"))
+	for _, tc := range []struct {
+		name, challenge string
+		credentials     ProxyCredentialsFunc
+		ok              bool
+	}{
+		{
+			name:      "basic fallback",
+			challenge: `Basic realm="proxy", ` + digest,
+			ok:        true,
+		},
+		{
+			name:      "digest auth-int",
+			challenge: digest,
+		},
+		{
+			name:        "missing netrc",
+			challenge:   `Basic realm="proxy"`,
+			credentials: NetrcProxyCredentials(filepath.Join(t.TempDir(), "missing")),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := newAuthProxy(t, tc.challenge, func(r *http.Request) bool {
+				return r.Header.Get("Proxy-Authorization") == basic
+			})
+			defer s.Close()
+
+			surl, _ := url.Parse(s.Server.URL)
+			d := testDialer
+			d.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: surl.Host})
+			d.ProxyCredentials = tc.credentials
+			if d.ProxyCredentials == nil {
+				d.ProxyCredentials = func(*url.URL, string) (string, string, error) {
+					return "bob", "hunter2", nil
+				}
+			}
+			conn, _, resp, err := d.Dial("http://tunnel.example"+testRequestURI, testDialOptions)
+			if tc.ok {
+				if err != nil {
+					t.Fatalf("Dial: %v", err)
+				}
+				defer conn.Close()
+				sendRecv(conn, resp, t)
+				return
+			}
+			var proxyErr *ProxyError
+			if !errors.As(err, &proxyErr) || proxyErr.StatusCode != http.StatusProxyAuthRequired {
+				t.Fatalf("expected a 407 ProxyError, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestProxyAuthRejected(t *testing.T) {
+	s, connects := newAuthProxy(t, `Basic realm="proxy"`, func(r *http.Request) bool { return false })
+	defer s.Close()
+
+	surl, _ := url.Parse(s.Server.URL)
+	d := testDialer
+	d.Proxy = http.ProxyURL(&url.URL{Scheme: "http", User: url.UserPassword("bob", "wrong"), Host: surl.Host})
+	_, _, _, err := d.Dial("http://tunnel.example"+testRequestURI, testDialOptions)
+	if proxyErr, ok := err.(*DialError).Err.(*ProxyError); !ok || proxyErr.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("expected a 407 ProxyError, got: %v", err)
+	}
+	// The credentials of the URL were sent up front and are not retried
+	if *connects != 1 {
+		t.Errorf("expected 1 CONNECT request, got: %v", *connects)
+	}
+}
+
+func TestParseChallenges(t *testing.T) {
+	for _, tt := range []struct {
+		values   []string
+		expected []authChallenge
+	}{
+		{
+			[]string{`Basic realm="a \"b\""`},
+			[]authChallenge{{"basic", map[string]string{"realm": `a "b"`}}},
+		},
+		{
+			[]string{`Newauth realm="apps", type=1, title="Login to \"apps\"", Basic realm="simple"`},
+			[]authChallenge{
+				{"newauth", map[string]string{"realm": "apps", "type": "1", "title": `Login to "apps"`}},
+				{"basic", map[string]string{"realm": "simple"}},
+			},
+		},
+		{
+			[]string{`Negotiate abc123==`, `Digest nonce=n, algorithm=MD5`},
+			[]authChallenge{
+				{"negotiate", map[string]string{}},
+				{"digest", map[string]string{"nonce": "n", "algorithm": "MD5"}},
+			},
+		},
+	} {
+		if challenges := parseChallenges(tt.values); !reflect.DeepEqual(challenges, tt.expected) {
+			t.Errorf("parseChallenges(%q) = %v, want %v", tt.values, challenges, tt.expected)
+		}
+	}
+}
+
+func TestLookupNetrc(t *testing.T) {
+	const data = `machine a.example login alice password pa
+macdef init
+	machine b.example login mallory password evil
+
+machine b.example
+	login bob
+	password pb
+default login anonymous password guest
+`
+	for host, expected := range map[string][2]string{
+		"a.example": {"alice", "pa"},
+		"b.example": {"bob", "pb"},
+		"c.example": {"anonymous", "guest"},
+	} {
+		login, password := lookupNetrc(data, host)
+		if login != expected[0] || password != expected[1] {
+			t.Errorf("%v: expected %v, got: %v, %v", host, expected, login, password)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package httptunnel
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// A ProxyRule routes the requests it matches through a chain of proxies.
+//
+// A request matches the rule when its host matches one of Networks or
+// Domains, if any are given, and its port is one of Ports, if any are given.
+// A rule with no condition matches every request.
+type ProxyRule struct {
+	// Networks match the hosts that are IP addresses within one of the
+	// prefixes, for example 10.0.0.0/8. Host names are not resolved.
+	Networks []netip.Prefix
+
+	// Domains match the hosts that are equal to or subdomains of one of the
+	// domains, for example "internal" matches "internal" and
+	// "db.internal". A domain starting with a dot, such as ".internal",
+	// only matches subdomains, and "*" matches every host.
+	Domains []string
+
+	// Ports match the requests for one of the ports. The port of a URL
+	// without one is the default port of its scheme.
+	Ports []int
+
+	// Proxies are the proxies to go through, as returned by
+	// Dialer.ProxyChain. If empty, the server is dialed directly.
+	Proxies []*url.URL
+}
+
+func (rule *ProxyRule) match(u *url.URL) bool {
+	hostPort, hostNoPort := hostPortNoPort(u)
+	host := strings.ToLower(strings.TrimSuffix(strings.Trim(hostNoPort, "[]"), "."))
+
+	if len(rule.Networks) > 0 || len(rule.Domains) > 0 {
+		matched := false
+		if addr, err := netip.ParseAddr(host); err == nil {
+			addr = addr.Unmap()
+			for _, prefix := range rule.Networks {
+				if prefix.Contains(addr) {
+					matched = true
+					break
+				}
+			}
+		}
+		for _, domain := range rule.Domains {
+			if matched {
+				break
+			}
+			domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+			switch {
+			case domain == "*":
+				matched = true
+			case strings.HasPrefix(domain, "."):
+				matched = strings.HasSuffix(host, domain)
+			default:
+				matched = host == domain || strings.HasSuffix(host, "."+domain)
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(rule.Ports) > 0 {
+		port, err := strconv.Atoi(hostPort[strings.LastIndex(hostPort, ":")+1:])
+		if err != nil {
+			return false
+		}
+		for _, p := range rule.Ports {
+			if p == port {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// ProxyRules is a routing table of proxies. The first rule matching a
+// request determines its proxies; requests that match no rule are dialed
+// directly.
+//
+// For example, to dial 10.0.0.0/8 directly, the hosts of the internal domain
+// through proxyA, and everything else through proxyB:
+//
+//	dialer.ProxyChain = httptunnel.ProxyRules{
+//		{Networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+//		{Domains: []string{"internal"}, Proxies: []*url.URL{proxyA}},
+//		{Proxies: []*url.URL{proxyB}},
+//	}.ProxyChain
+type ProxyRules []ProxyRule
+
+// ProxyChain returns the proxies of the first rule matching req. It can be
+// used as Dialer.ProxyChain.
+func (rules ProxyRules) ProxyChain(req *http.Request) ([]*url.URL, error) {
+	for i := range rules {
+		if rules[i].match(req.URL) {
+			return rules[i].Proxies, nil
+		}
+	}
+	return nil, nil
+}
+
+// Proxy returns the proxy of the first rule matching req. It can be used as
+// Dialer.Proxy when the rules have at most one proxy each; it fails for a
+// rule with a chain of proxies.
+func (rules ProxyRules) Proxy(req *http.Request) (*url.URL, error) {
+	proxies, err := rules.ProxyChain(req)
+	switch {
+	case err != nil || len(proxies) == 0:
+		return nil, err
+	case len(proxies) > 1:
+		return nil, errors.New("httptunnel: proxy rule has a chain of proxies, use Dialer.ProxyChain")
+	}
+	return proxies[0], nil
+}
@@ -0,0 +1,137 @@
+package httptunnel
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// newConnectProxy returns an http proxy forwarding CONNECT requests and
+// recording their targets.
+func newConnectProxy(t *testing.T) (*httptest.Server, func() []string) {
+	var (
+		mu      sync.Mutex
+		targets []string
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		mu.Lock()
+		targets = append(targets, r.Host)
+		mu.Unlock()
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		c, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			upstream.Close()
+			t.Error(err)
+			return
+		}
+		_, _ = io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() {
+			_, _ = io.Copy(upstream, brw)
+			upstream.Close()
+		}()
+		_, _ = io.Copy(c, upstream)
+		c.Close()
+	}))
+	return s, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), targets...)
+	}
+}
+
+func TestProxyChainDial(t *testing.T) {
+	// The tunneled request is served by the last proxy itself
+	s := newServer(t)
+	defer s.Close()
+	origHandler := s.Server.Config.Handler
+	s.Server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		origHandler.ServeHTTP(w, r)
+	})
+	first, targets := newConnectProxy(t)
+	defer first.Close()
+
+	firstURL, _ := url.Parse(first.URL)
+	lastURL, _ := url.Parse(s.Server.URL)
+	lastURL = &url.URL{Scheme: "http", Host: lastURL.Host}
+
+	d := testDialer
+	d.Proxy = func(*http.Request) (*url.URL, error) {
+		t.Error("Proxy should not be called when ProxyChain is set")
+		return nil, nil
+	}
+	d.ProxyChain = ProxyRules{
+		{Domains: []string{"internal"}, Proxies: []*url.URL{firstURL, lastURL}},
+	}.ProxyChain
+	conn, _, resp, err := d.Dial("http://tunnel.internal"+testRequestURI, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	sendRecv(conn, resp, t)
+	if got := targets(); len(got) != 1 || got[0] != lastURL.Host {
+		t.Errorf("expected the first proxy to connect to %v, got: %v", lastURL.Host, got)
+	}
+}
+
+func TestProxyRules(t *testing.T) {
+	proxyA, _ := url.Parse("http://proxy-a:3128")
+	proxyB, _ := url.Parse("socks5://proxy-b:1080")
+	jump, _ := url.Parse("socks5://jump:1080")
+	rules := ProxyRules{
+		{Networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}},
+		{Domains: []string{"internal"}, Proxies: []*url.URL{proxyA}},
+		{Domains: []string{".corp.example"}, Ports: []int{22}, Proxies: []*url.URL{jump, proxyA}},
+		{Proxies: []*url.URL{proxyB}},
+	}
+	for _, tt := range []struct {
+		url      string
+		expected []*url.URL
+	}{
+		{"http://10.1.2.3/", nil},
+		{"http://[fd00::1]:8080/", nil},
+		{"http://11.1.2.3/", []*url.URL{proxyB}},
+		{"https://internal/", []*url.URL{proxyA}},
+		{"https://DB.Internal./", []*url.URL{proxyA}},
+		{"http://notinternal/", []*url.URL{proxyB}},
+		{"http://git.corp.example:22/", []*url.URL{jump, proxyA}},
+		{"http://git.corp.example/", []*url.URL{proxyB}},
+		{"http://corp.example:22/", []*url.URL{proxyB}},
+	} {
+		u, _ := url.Parse(tt.url)
+		proxies, err := rules.ProxyChain(&http.Request{URL: u})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(proxies) != len(tt.expected) {
+			t.Errorf("%v: expected %v, got: %v", tt.url, tt.expected, proxies)
+			continue
+		}
+		for i := range proxies {
+			if proxies[i] != tt.expected[i] {
+				t.Errorf("%v: expected %v, got: %v", tt.url, tt.expected, proxies)
+			}
+		}
+	}
+
+	u, _ := url.Parse("http://git.corp.example:22/")
+	if _, err := rules.Proxy(&http.Request{URL: u}); err == nil {
+		t.Error("expected Proxy to fail for a chain of proxies")
+	}
+}
@@ -0,0 +1,163 @@
+package httptunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+const defaultMaxRedirects = 10
+
+// ErrRedirectDowngrade is returned when a server redirects a tunnel from
+// https to http.
+var ErrRedirectDowngrade = errors.New("httptunnel: refusing to follow redirect from https to http")
+
+// A RedirectPolicy controls how DialContext follows the 301, 302, 307 and
+// 308 responses to the upgrade request.
+//
+// Each redirect is dialed like the original URL, using the Dialer's cookie
+// jar, proxy and TLS configuration. The Authorization and Cookie headers set
+// by ConnectionOptions.PrepareRequest are dropped when the redirect leaves the
+// original host, and redirects from https to http are refused with
+// ErrRedirectDowngrade. ConnectionOptions.OverrideGetUrl is only applied to
+// the original URL.
+type RedirectPolicy struct {
+	// MaxRedirects is the maximum number of redirects followed. If zero, 10
+	// redirects are followed.
+	MaxRedirects int
+
+	// CheckRedirect, if not nil, is called before following a redirect, as
+	// with http.Client. The arguments req and via are the upcoming request
+	// and the requests made already, oldest first. If CheckRedirect returns
+	// an error, DialContext returns it with the redirect response, unless it
+	// is http.ErrUseLastResponse, in which case the redirect response is
+	// returned as is.
+	CheckRedirect func(req *http.Request, via []*http.Request) error
+}
+
+func (p *RedirectPolicy) maxRedirects() int {
+	if p.MaxRedirects <= 0 {
+		return defaultMaxRedirects
+	}
+	return p.MaxRedirects
+}
+
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectOptions returns the options used to dial a redirect from a request
+// to origin.
+func (d *Dialer) redirectOptions(options *ConnectionOptions, origin *url.URL) *ConnectionOptions {
+	opts := *options
+	opts.OverrideGetUrl = nil
+	opts.PrepareRequest = func(r *http.Request) error {
+		if options.PrepareRequest != nil {
+			if err := options.PrepareRequest(r); err != nil {
+				return err
+			}
+		}
+		if r.URL.Host != origin.Host {
+			stripCredentials(r.Header)
+			if d.Jar != nil {
+				for _, cookie := range d.Jar.Cookies(r.URL) {
+					r.AddCookie(cookie)
+				}
+			}
+		}
+		return nil
+	}
+	return &opts
+}
+
+// stripCredentials removes the headers that must not be sent to another
+// host.
+func stripCredentials(h http.Header) {
+	for _, k := range []string{"Authorization", "Www-Authenticate", "Cookie", "Cookie2"} {
+		h.Del(k)
+	}
+}
+
+// dialRedirects calls dial and follows the redirects allowed by the Dialer's
+// RedirectPolicy. It returns the URL that was dialed last.
+func (d *Dialer) dialRedirects(
+	ctx context.Context,
+	urlStr string,
+	options *ConnectionOptions,
+	inst instruments,
+) (net.Conn, *bufio.Reader, *http.Response, string, error) {
+	netConn, br, resp, err := d.dial(ctx, urlStr, options, inst)
+	policy := d.Redirect
+	if policy == nil || err != nil {
+		return netConn, br, resp, urlStr, err
+	}
+
+	var (
+		via         []*http.Request
+		hopOptions  *ConnectionOptions
+		maxRedirect = policy.maxRedirects()
+	)
+	for isRedirect(resp.StatusCode) {
+		location := resp.Header.Get("Location")
+		if location == "" {
+			break
+		}
+		prev := resp.Request
+		next, err := prev.URL.Parse(location)
+		if err != nil {
+			_ = netConn.Close()
+			return nil, nil, resp, "", fmt.Errorf("httptunnel: failed to parse Location header %q: %w", location, err)
+		}
+		via = append(via, prev)
+		if hopOptions == nil {
+			hopOptions = d.redirectOptions(options, prev.URL)
+		}
+
+		switch {
+		case len(via) > maxRedirect:
+			err = fmt.Errorf("httptunnel: stopped after %d redirects", maxRedirect)
+		case prev.URL.Scheme == "https" && next.Scheme == "http":
+			err = ErrRedirectDowngrade
+		case next.Scheme != "http" && next.Scheme != "https":
+			err = fmt.Errorf("httptunnel: unsupported redirect scheme %q", next.Scheme)
+		case policy.CheckRedirect != nil:
+			req := (&http.Request{
+				Method:     http.MethodGet,
+				URL:        next,
+				Proto:      "HTTP/1.1",
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     prev.Header.Clone(),
+				Host:       next.Host,
+			}).WithContext(ctx)
+			if next.Host != via[0].URL.Host {
+				stripCredentials(req.Header)
+			}
+			err = policy.CheckRedirect(req, via)
+		}
+		if errors.Is(err, http.ErrUseLastResponse) {
+			return netConn, br, resp, prev.URL.String(), nil
+		}
+		_ = netConn.Close()
+		if err != nil {
+			return nil, nil, resp, "", err
+		}
+
+		inst.logger.Info("following redirect", "status", resp.Status, "location", next.Redacted())
+		urlStr = next.String()
+		netConn, br, resp, err = d.dial(ctx, urlStr, hopOptions, inst)
+		if err != nil {
+			return netConn, br, resp, urlStr, err
+		}
+	}
+	return netConn, br, resp, urlStr, nil
+}
@@ -0,0 +1,124 @@
+package httptunnel
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func newRedirectServer(location string, requests *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.SetCookie(w, &http.Cookie{Name: "gateway", Value: "a"})
+		http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+	}))
+}
+
+func TestRedirect(t *testing.T) {
+	var authorization, cookies string
+	s := newServer(t)
+	defer s.Close()
+	upgrade := s.Server.Config.Handler
+	s.Server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		for _, c := range r.Cookies() {
+			cookies += c.String() + ";"
+		}
+		upgrade.ServeHTTP(w, r)
+	})
+	var requests atomic.Int32
+	gateway := newRedirectServer(s.URL, &requests)
+	defer gateway.Close()
+
+	jar, _ := cookiejar.New(nil)
+	d := testDialer
+	d.Jar = jar
+	d.Redirect = &RedirectPolicy{}
+	options := &ConnectionOptions{
+		PrepareRequest: func(r *http.Request) error {
+			r.Header.Set("Authorization", "Bearer secret")
+			r.AddCookie(&http.Cookie{Name: "manual", Value: "1"})
+			return testDialOptions.PrepareRequest(r)
+		},
+	}
+	conn, _, resp, err := d.Dial(gateway.URL+testRequestURI, options)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	sendRecv(conn, resp, t)
+
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected 1 request to the gateway, got: %v", n)
+	}
+	if endpoint := conn.(*Conn).Endpoint(); endpoint != s.URL {
+		t.Errorf("expected endpoint %v, got: %v", s.URL, endpoint)
+	}
+	if authorization != "" {
+		t.Errorf("expected credentials to be dropped, got: %q", authorization)
+	}
+	if cookies != "gateway=a;" {
+		t.Errorf("expected only the cookies of the jar, got: %q", cookies)
+	}
+}
+
+func TestRedirectNotFollowed(t *testing.T) {
+	var requests atomic.Int32
+	gateway := newRedirectServer("http://tunnel.example/", &requests)
+	defer gateway.Close()
+
+	for _, policy := range []*RedirectPolicy{
+		nil,
+		{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }},
+	} {
+		d := testDialer
+		d.Redirect = policy
+		conn, _, resp, err := d.Dial(gateway.URL, nil)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		conn.Close()
+		if resp.StatusCode != http.StatusTemporaryRedirect {
+			t.Errorf("expected the redirect response, got: %v", resp.Status)
+		}
+	}
+}
+
+func TestRedirectLimit(t *testing.T) {
+	var requests atomic.Int32
+	gateway := newRedirectServer(testPath, &requests)
+	defer gateway.Close()
+
+	d := testDialer
+	d.Redirect = &RedirectPolicy{MaxRedirects: 2}
+	_, _, resp, err := d.Dial(gateway.URL, nil)
+	if err == nil || err.Error() != "httptunnel: stopped after 2 redirects" {
+		t.Fatalf("expected the redirect limit to be reached, got: %v", err)
+	}
+	if resp == nil || resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Errorf("expected the last redirect response, got: %v", resp)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("expected 3 requests, got: %v", n)
+	}
+}
+
+func TestRedirectDowngrade(t *testing.T) {
+	var requests atomic.Int32
+	gateway := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Redirect(w, r, "http://tunnel.example/", http.StatusPermanentRedirect)
+	}))
+	defer gateway.Close()
+
+	d := testDialer
+	d.TLSClientConfig = &tls.Config{RootCAs: rootCAs(t, gateway)}
+	d.Redirect = &RedirectPolicy{}
+	if _, _, _, err := d.Dial(gateway.URL, nil); !errors.Is(err, ErrRedirectDowngrade) {
+		t.Fatalf("expected %v, got: %v", ErrRedirectDowngrade, err)
+	}
+}
@@ -0,0 +1,731 @@
+package httptunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	resumeHeader = "Tunnel-Resume"
+
+	defaultResumeBufferSize     = 1 << 20
+	defaultResumeTimeout        = time.Minute
+	defaultResumeInitialBackoff = 250 * time.Millisecond
+	defaultResumeMaxBackoff     = 10 * time.Second
+
+	// resumeCloseTimeout bounds how long Close waits for buffered data to be
+	// sent.
+	resumeCloseTimeout = 5 * time.Second
+	resumeMaxFrame     = 32 << 10
+	frameHeaderLen     = 13
+	// resumeAckDelay bounds how long received data may go unacknowledged.
+	resumeAckDelay = 50 * time.Millisecond
+)
+
+const (
+	frameData byte = iota + 1
+	frameAck
+	frameClose
+)
+
+var (
+	// ErrSessionResumed is returned by Hijacker.Upgrade when the request
+	// resumed an existing tunnel. The connection was handed over to the
+	// tunnel returned by the call that created the session, so the handler
+	// has nothing left to do.
+	ErrSessionResumed = errors.New("httptunnel: request resumed an existing tunnel")
+	// ErrSessionNotFound is returned when a tunnel cannot be resumed because
+	// the server does not know its session.
+	ErrSessionNotFound = errors.New("httptunnel: tunnel session not found")
+	// ErrSessionExpired is returned by a resumable tunnel that was not resumed
+	// before ResumeConfig.Timeout elapsed.
+	ErrSessionExpired = errors.New("httptunnel: tunnel was not resumed in time")
+
+	errResumeProtocol = errors.New("httptunnel: resumable tunnel protocol error")
+	errSuperseded     = errors.New("httptunnel: tunnel connection superseded by a resumed connection")
+)
+
+// ResumeConfig configures resumable tunnels. A resumable tunnel survives the
+// loss of its underlying connection: the client redials the server, which
+// identifies the tunnel by the session token it assigned in the 101 response,
+// and both ends retransmit the bytes the other has not received.
+//
+// Resumable tunnels frame the data sent over the underlying connection, so
+// both ends must enable them. A client falls back to a plain tunnel if the
+// server does not assign a session.
+type ResumeConfig struct {
+	// BufferSize is the maximum number of bytes kept for retransmission
+	// until the peer acknowledges them. Writes block while it is full.
+	// The ends exchange their buffer sizes, so they need not match. If
+	// zero, 1 MiB is used.
+	BufferSize int
+	// Timeout is how long a broken tunnel may take to be resumed before it
+	// fails. If zero, one minute is used.
+	Timeout time.Duration
+	// InitialBackoff and MaxBackoff bound the delay between the client's
+	// attempts to resume a tunnel. The delay doubles after each attempt. If
+	// zero, 250ms and 10s are used.
+	InitialBackoff, MaxBackoff time.Duration
+}
+
+func (rc *ResumeConfig) bufferSize() int {
+	if rc.BufferSize > 0 {
+		return rc.BufferSize
+	}
+	return defaultResumeBufferSize
+}
+
+func (rc *ResumeConfig) timeout() time.Duration {
+	if rc.Timeout > 0 {
+		return rc.Timeout
+	}
+	return defaultResumeTimeout
+}
+
+func (rc *ResumeConfig) backoff() (initial, max time.Duration) {
+	initial, max = rc.InitialBackoff, rc.MaxBackoff
+	if initial <= 0 {
+		initial = defaultResumeInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultResumeMaxBackoff
+	}
+	return initial, max
+}
+
+// A SessionStore holds the sessions of the resumable tunnels accepted by a
+// Hijacker. Sessions are removed when their tunnel is closed or fails.
+//
+// It is safe to share a SessionStore between Hijackers.
+type SessionStore struct {
+	ResumeConfig
+
+	mu       sync.Mutex
+	sessions map[string]*resumableConn
+}
+
+// create creates the session of a tunnel whose client buffers peerWindow
+// bytes for retransmission, or an unknown number if zero.
+func (s *SessionStore) create(peerWindow int) *resumableConn {
+	var b [32]byte
+	_, _ = rand.Read(b[:])
+	token := base64.RawURLEncoding.EncodeToString(b[:])
+	rc := newResumableConn(token, &s.ResumeConfig, nil)
+	rc.peerWindow = peerWindow
+	rc.onDone = func() { s.remove(token) }
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*resumableConn)
+	}
+	s.sessions[token] = rc
+	return rc
+}
+
+func (s *SessionStore) get(token string) *resumableConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[token]
+}
+
+func (s *SessionStore) remove(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+}
+
+// Len returns the number of sessions in the store.
+func (s *SessionStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// resumeParams are the parameters of the Tunnel-Resume header. The client
+// sends "new" to request a session, and the server responds with the token.
+// To resume, the client sends the token and the number of bytes it has
+// received, and the server responds in kind. When a session is created, both
+// ends also send the size of their retransmission buffer as the window.
+type resumeParams struct {
+	token       string
+	received    uint64
+	hasReceived bool
+	window      int
+}
+
+func (p resumeParams) String() string {
+	s := "new"
+	if p.token != "" {
+		s = "token=" + p.token
+	}
+	if p.hasReceived {
+		s += ", received=" + strconv.FormatUint(p.received, 10)
+	}
+	if p.window > 0 {
+		s += ", window=" + strconv.Itoa(p.window)
+	}
+	return s
+}
+
+func parseResumeHeader(v string) (p resumeParams, ok bool) {
+	isNew := false
+	for i, field := range strings.Split(v, ",") {
+		field = strings.TrimSpace(field)
+		if i == 0 && field == "new" {
+			isNew = true
+			continue
+		}
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return p, false
+		}
+		switch key {
+		case "token":
+			p.token = value
+		case "received":
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return p, false
+			}
+			p.received, p.hasReceived = n, true
+		case "window":
+			n, err := strconv.ParseUint(value, 10, 31)
+			if err != nil || n == 0 {
+				return p, false
+			}
+			p.window = int(n)
+		}
+	}
+	if isNew {
+		return p, p.token == "" && !p.hasReceived
+	}
+	return p, p.token != ""
+}
+
+// resumableConn is the net.Conn of a resumable tunnel. Writes are buffered
+// until acknowledged and sent by a writer goroutine; a reader goroutine per
+// underlying connection fills the receive buffer. Sequence numbers are byte
+// offsets in each direction of the stream.
+type resumableConn struct {
+	token      string
+	bufferSize int
+	// peerWindow is the buffer size of the peer, or zero if unknown.
+	peerWindow int
+	timeout    time.Duration
+	cfg        *ResumeConfig
+	// redial connects to the server to resume the tunnel. It is nil on the
+	// server side.
+	redial func(ctx context.Context, received uint64) (net.Conn, uint64, error)
+	onDone func()
+
+	mu       sync.Mutex
+	changed  chan struct{}
+	conn     net.Conn // nil while broken
+	gen      uint64   // incremented whenever conn changes
+	lastConn net.Conn
+
+	sendBuf                     []byte // bytes from acked to sent
+	acked, written, sent        uint64
+	recvBuf                     []byte
+	received, ackSent           uint64
+	ackPending, ackScheduled    bool
+	closing, closeSent          bool
+	peerClosed                  bool
+	err                         error
+	writerDone                  chan struct{}
+	readDeadline, writeDeadline time.Time
+}
+
+func newResumableConn(
+	token string,
+	cfg *ResumeConfig,
+	redial func(context.Context, uint64) (net.Conn, uint64, error),
+) *resumableConn {
+	return &resumableConn{
+		token:      token,
+		bufferSize: cfg.bufferSize(),
+		timeout:    cfg.timeout(),
+		cfg:        cfg,
+		redial:     redial,
+		changed:    make(chan struct{}),
+		writerDone: make(chan struct{}),
+	}
+}
+
+// start begins the tunnel over conn.
+func (c *resumableConn) start(conn net.Conn) {
+	c.mu.Lock()
+	c.conn, c.lastConn = conn, conn
+	c.gen++
+	gen := c.gen
+	c.mu.Unlock()
+	go c.readLoop(conn, gen)
+	go c.writeLoop()
+}
+
+// notify wakes up everything waiting for a change of state. c.mu must be
+// held.
+func (c *resumableConn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait releases c.mu until the state changes or the deadline passes. It
+// returns false if the deadline passed.
+func (c *resumableConn) wait(deadline time.Time) bool {
+	ch := c.changed
+	if deadline.IsZero() {
+		c.mu.Unlock()
+		<-ch
+		c.mu.Lock()
+		return true
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	c.mu.Unlock()
+	defer c.mu.Lock()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (c *resumableConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if len(c.recvBuf) > 0 {
+			n := copy(p, c.recvBuf)
+			c.recvBuf = c.recvBuf[n:]
+			c.notify()
+			return n, nil
+		}
+		switch {
+		case c.peerClosed:
+			return 0, io.EOF
+		case c.closing:
+			return 0, net.ErrClosed
+		case c.err != nil:
+			return 0, c.err
+		}
+		if !c.wait(c.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (c *resumableConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	total := 0
+	for len(p) > 0 {
+		switch {
+		case c.closing:
+			return total, net.ErrClosed
+		case c.err != nil:
+			return total, c.err
+		}
+		room := c.bufferSize - int(c.sent-c.acked)
+		if room <= 0 {
+			if !c.wait(c.writeDeadline) {
+				return total, os.ErrDeadlineExceeded
+			}
+			continue
+		}
+		n := min(room, len(p))
+		c.sendBuf = append(c.sendBuf, p[:n]...)
+		c.sent += uint64(n)
+		total += n
+		p = p[n:]
+		c.notify()
+	}
+	return total, nil
+}
+
+// Close sends the buffered data and closes the tunnel. The peer reads io.EOF
+// once it has received everything.
+func (c *resumableConn) Close() error {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closing = true
+	c.notify()
+	failed := c.err != nil
+	c.mu.Unlock()
+
+	if !failed {
+		timer := time.NewTimer(resumeCloseTimeout)
+		select {
+		case <-c.writerDone:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	c.mu.Lock()
+	c.shutdown(net.ErrClosed)
+	c.mu.Unlock()
+	return nil
+}
+
+// netConn returns the connection of the latest attempt.
+func (c *resumableConn) netConn() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastConn
+}
+
+func (c *resumableConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastConn.LocalAddr()
+}
+
+func (c *resumableConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastConn.RemoteAddr()
+}
+
+func (c *resumableConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.notify()
+	return nil
+}
+
+func (c *resumableConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.notify()
+	return nil
+}
+
+func (c *resumableConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+func appendFrame(b []byte, typ byte, offset uint64, payload []byte) []byte {
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint64(b, offset)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(payload)))
+	return append(b, payload...)
+}
+
+func (c *resumableConn) writeLoop() {
+	defer close(c.writerDone)
+	buf := make([]byte, 0, frameHeaderLen+resumeMaxFrame)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.err == nil {
+		conn, gen := c.conn, c.gen
+		var frame []byte
+		var value uint64
+		switch {
+		case conn == nil:
+		case c.written < c.sent:
+			start := c.written - c.acked
+			n := min(c.sent-c.written, resumeMaxFrame)
+			frame = appendFrame(buf[:0], frameData, c.written, c.sendBuf[start:start+n])
+			value = c.written + n
+		case c.ackPending:
+			frame = appendFrame(buf[:0], frameAck, c.received, nil)
+			value = c.received
+		case c.closing && !c.closeSent:
+			frame = appendFrame(buf[:0], frameClose, c.sent, nil)
+		}
+		if frame == nil {
+			c.wait(time.Time{})
+			continue
+		}
+
+		c.mu.Unlock()
+		_, err := conn.Write(frame)
+		c.mu.Lock()
+
+		if err != nil {
+			c.broken(gen, err)
+			continue
+		}
+		if gen != c.gen {
+			// The connection was replaced while writing. The new connection
+			// starts from the offset the peer reported.
+			continue
+		}
+		switch frame[0] {
+		case frameData:
+			c.written = value
+		case frameAck:
+			c.ackPending, c.ackSent = false, value
+		case frameClose:
+			c.closeSent = true
+			c.shutdown(net.ErrClosed)
+		}
+	}
+}
+
+func (c *resumableConn) readLoop(conn net.Conn, gen uint64) {
+	r := bufio.NewReaderSize(conn, frameHeaderLen+resumeMaxFrame)
+	hdr := make([]byte, frameHeaderLen)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			c.mu.Lock()
+			c.broken(gen, err)
+			c.mu.Unlock()
+			return
+		}
+		typ := hdr[0]
+		offset := binary.BigEndian.Uint64(hdr[1:9])
+		length := binary.BigEndian.Uint32(hdr[9:])
+		if length > resumeMaxFrame {
+			c.fail(gen, errResumeProtocol)
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			c.mu.Lock()
+			c.broken(gen, err)
+			c.mu.Unlock()
+			return
+		}
+		if !c.handleFrame(gen, typ, offset, payload) {
+			return
+		}
+	}
+}
+
+// handleFrame applies a frame read from the connection of generation gen.
+// It returns false once the connection should no longer be read.
+func (c *resumableConn) handleFrame(gen uint64, typ byte, offset uint64, payload []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch typ {
+	case frameData:
+		for len(c.recvBuf) >= c.bufferSize && gen == c.gen && c.err == nil {
+			c.wait(time.Time{})
+		}
+		if gen != c.gen || c.err != nil {
+			return false
+		}
+		if offset > c.received {
+			c.shutdown(errResumeProtocol)
+			return false
+		}
+		// Skip anything that was received before the tunnel was resumed
+		if skip := c.received - offset; skip < uint64(len(payload)) {
+			c.recvBuf = append(c.recvBuf, payload[skip:]...)
+			c.received = offset + uint64(len(payload))
+		}
+		if c.received-c.ackSent >= c.ackThreshold() {
+			c.ackPending = true
+		} else if !c.ackScheduled {
+			c.ackScheduled = true
+			time.AfterFunc(resumeAckDelay, c.delayedAck)
+		}
+	case frameAck:
+		if gen != c.gen {
+			return false
+		}
+		if offset < c.acked || offset > c.sent {
+			c.shutdown(errResumeProtocol)
+			return false
+		}
+		c.sendBuf = c.sendBuf[offset-c.acked:]
+		c.acked = offset
+	case frameClose:
+		if gen != c.gen {
+			return false
+		}
+		c.peerClosed = true
+		c.notify()
+		return false
+	default:
+		c.shutdown(errResumeProtocol)
+		return false
+	}
+	c.notify()
+	return true
+}
+
+// ackThreshold returns the number of unacknowledged bytes that are acked
+// right away. Acking at half the peer's window lets it keep sending while the
+// ack is in flight; the smaller data is acked after resumeAckDelay. c.mu must
+// be held.
+func (c *resumableConn) ackThreshold() uint64 {
+	window := c.bufferSize / 2
+	if c.peerWindow > 0 {
+		window = c.peerWindow
+	}
+	return uint64(max(window/2, 1))
+}
+
+// delayedAck acks the data received since the last ack, if any.
+func (c *resumableConn) delayedAck() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ackScheduled = false
+	if c.err == nil && !c.ackPending && c.received > c.ackSent {
+		c.ackPending = true
+		c.notify()
+	}
+}
+
+// broken handles the failure of the connection of generation gen. c.mu must
+// be held.
+func (c *resumableConn) broken(gen uint64, err error) {
+	if gen != c.gen || c.err != nil {
+		return
+	}
+	if c.closing || c.peerClosed {
+		c.shutdown(err)
+		return
+	}
+	_ = c.conn.Close()
+	c.conn = nil
+	c.gen++
+	c.notify()
+	if c.redial != nil {
+		go c.reconnect()
+		return
+	}
+	brokenGen := c.gen
+	time.AfterFunc(c.timeout, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.gen == brokenGen {
+			c.shutdown(ErrSessionExpired)
+		}
+	})
+}
+
+// abort ends the tunnel with err.
+func (c *resumableConn) abort(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shutdown(err)
+}
+
+func (c *resumableConn) fail(gen uint64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen == c.gen {
+		c.shutdown(err)
+	}
+}
+
+// shutdown ends the tunnel with err. c.mu must be held.
+func (c *resumableConn) shutdown(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+	c.gen++
+	c.notify()
+	if c.onDone != nil {
+		c.onDone()
+	}
+}
+
+// detach stops using the current connection, if any, in preparation for a
+// resumed connection, and returns the number of bytes received so far.
+func (c *resumableConn) detach() (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.conn != nil {
+		c.broken(c.gen, errSuperseded)
+	}
+	return c.received, nil
+}
+
+// attach resumes the tunnel over conn, the peer having received peerReceived
+// bytes.
+func (c *resumableConn) attach(conn net.Conn, peerReceived uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		_ = conn.Close()
+		return c.err
+	}
+	if c.conn != nil {
+		_ = conn.Close()
+		return errResumeProtocol
+	}
+	if peerReceived < c.acked || peerReceived > c.sent {
+		_ = conn.Close()
+		c.shutdown(errResumeProtocol)
+		return errResumeProtocol
+	}
+	c.sendBuf = c.sendBuf[peerReceived-c.acked:]
+	c.acked, c.written = peerReceived, peerReceived
+	// The peer was told how much has been received in the handshake.
+	c.ackSent, c.ackPending = c.received, false
+	c.conn, c.lastConn = conn, conn
+	c.gen++
+	go c.readLoop(conn, c.gen)
+	c.notify()
+	return nil
+}
+
+// reconnect redials the server until the tunnel is resumed or the timeout
+// elapses.
+func (c *resumableConn) reconnect() {
+	backoff, maxBackoff := c.cfg.backoff()
+	deadline := time.Now().Add(c.timeout)
+	for {
+		c.mu.Lock()
+		received, err := c.received, c.err
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		conn, peerReceived, err := c.redial(ctx, received)
+		cancel()
+		if err == nil {
+			_ = c.attach(conn, peerReceived)
+			return
+		}
+		if errors.Is(err, ErrSessionNotFound) || time.Now().Add(backoff).After(deadline) {
+			c.mu.Lock()
+			c.shutdown(fmt.Errorf("httptunnel: resuming tunnel: %w", err))
+			c.mu.Unlock()
+			return
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
@@ -0,0 +1,383 @@
+package httptunnel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// forwarder relays TCP connections to addr and can break all of them at once.
+type forwarder struct {
+	l     net.Listener
+	addr  string
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newForwarder(t *testing.T, addr string) *forwarder {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &forwarder{l: l, addr: addr}
+	go f.serve()
+	return f
+}
+
+func (f *forwarder) serve() {
+	for {
+		c, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", f.addr)
+		if err != nil {
+			c.Close()
+			continue
+		}
+		f.mu.Lock()
+		f.conns = append(f.conns, c, upstream)
+		f.mu.Unlock()
+		go func() { _, _ = io.Copy(upstream, c); upstream.Close() }()
+		go func() { _, _ = io.Copy(c, upstream); c.Close() }()
+	}
+}
+
+func (f *forwarder) breakAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+}
+
+func (f *forwarder) Close() {
+	f.l.Close()
+	f.breakAll()
+}
+
+func newResumeServer(t *testing.T, sessions *SessionStore) *mockServer {
+	s := newServer(t)
+	hijacker := Hijacker{Sessions: sessions}
+	s.Server.Config.Handler = http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			s.wg.Add(1)
+			defer s.wg.Done()
+			conn, _, err := hijacker.Upgrade(w, r, nil)
+			if err == ErrSessionResumed || err == ErrSessionNotFound {
+				return
+			}
+			if err != nil {
+				t.Errorf("Upgrade: %v", err)
+				return
+			}
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		},
+	)
+	return s
+}
+
+func echo(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("expected %q, got: %q", msg, buf)
+	}
+}
+
+func TestResume(t *testing.T) {
+	sessions := &SessionStore{}
+	s := newResumeServer(t, sessions)
+	defer s.Close()
+
+	u, _ := url.Parse(s.URL)
+	f := newForwarder(t, u.Host)
+	defer f.Close()
+	u.Host = f.l.Addr().String()
+
+	d := testDialer
+	d.Resume = &ResumeConfig{InitialBackoff: 10 * time.Millisecond}
+	conn, _, resp, err := d.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if resp.Header.Get(resumeHeader) == "" {
+		t.Fatal("expected a session to be assigned")
+	}
+	if n := sessions.Len(); n != 1 {
+		t.Fatalf("expected 1 session, got: %v", n)
+	}
+
+	echo(t, conn, "before")
+	first := conn.(*Conn).NetConn()
+	if _, ok := first.(*net.TCPConn); !ok {
+		t.Fatalf("expected NetConn to return the TCP connection, got: %T", first)
+	}
+	f.breakAll()
+	echo(t, conn, "after the first break")
+	if netConn := conn.(*Conn).NetConn(); netConn == first {
+		t.Error("expected NetConn to return the connection of the resumed tunnel")
+	}
+	f.breakAll()
+	if _, err := conn.Write([]byte("written while broken")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, len("written while broken"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(buf) != "written while broken" {
+		t.Fatalf("expected %q, got: %q", "written while broken", buf)
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	s.Close()
+	if n := sessions.Len(); n != 0 {
+		t.Errorf("expected the session to be removed, got: %v", n)
+	}
+}
+
+func TestResumeSpans(t *testing.T) {
+	s := newResumeServer(t, &SessionStore{})
+	u, _ := url.Parse(s.URL)
+	f := newForwarder(t, u.Host)
+	defer f.Close()
+	u.Host = f.l.Addr().String()
+
+	spans := &spanCollector{}
+	d := testDialer
+	d.Resume = &ResumeConfig{InitialBackoff: 10 * time.Millisecond}
+	d.SpanExporter = spans
+	conn, _, _, err := d.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	echo(t, conn, "before")
+	f.breakAll()
+	echo(t, conn, "after")
+	conn.Close()
+	s.Close()
+
+	spans.mu.Lock()
+	defer spans.mu.Unlock()
+	if len(spans.spans) != 2 {
+		t.Fatalf("expected a dial and a resume span, got: %v", spans.spans)
+	}
+	dial, resume := spans.spans[0], spans.spans[1]
+	if dial.Name != "httptunnel.dial" || resume.Name != "httptunnel.resume" {
+		t.Fatalf("expected a dial and a resume span, got: %v, %v", dial.Name, resume.Name)
+	}
+	if resume.Parent != dial.SpanContext.SpanID || resume.SpanContext.TraceID != dial.SpanContext.TraceID {
+		t.Errorf("expected the resume span to be a child of %v, got: %v", dial.SpanContext, resume)
+	}
+	if code := resume.Attributes["http.status_code"]; code != "101" {
+		t.Errorf("expected status code attribute 101, got: %v", code)
+	}
+}
+
+func TestResumeLargeTransfer(t *testing.T) {
+	s := newResumeServer(t, &SessionStore{ResumeConfig: ResumeConfig{BufferSize: 64 << 10}})
+	u, _ := url.Parse(s.URL)
+	f := newForwarder(t, u.Host)
+	defer f.Close()
+	// The server waits for the client to close the tunnel, so it has to be
+	// closed before the forwarder.
+	defer s.Close()
+	u.Host = f.l.Addr().String()
+
+	d := testDialer
+	d.Resume = &ResumeConfig{BufferSize: 64 << 10, InitialBackoff: 10 * time.Millisecond}
+	conn, _, _, err := d.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	go func() {
+		for i := 0; i < len(data); i += 4096 {
+			if _, err := conn.Write(data[i : i+4096]); err != nil {
+				t.Errorf("Write: %v", err)
+				return
+			}
+			if i == len(data)/2 {
+				f.breakAll()
+			}
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	for i := range data {
+		if received[i] != data[i] {
+			t.Fatalf("stream corrupted at offset %v", i)
+		}
+	}
+}
+
+func TestResumeMismatchedBuffers(t *testing.T) {
+	s := newResumeServer(t, &SessionStore{})
+	defer s.Close()
+
+	d := testDialer
+	d.Resume = &ResumeConfig{BufferSize: 64 << 10}
+	conn, _, _, err := d.Dial(s.URL, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	// The client's buffer is smaller than the server's ack threshold would
+	// be with its own buffer size
+	data := bytes.Repeat([]byte("0123456789abcdef"), 32<<10)
+	go func() {
+		if _, err := conn.Write(data); err != nil {
+			t.Errorf("Write: %v", err)
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Error("stream corrupted")
+	}
+
+	// Data below the threshold is acked once the link is idle
+	echo(t, conn, "hello")
+	session := conn.(*Conn).Conn.(*resumableConn)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		session.mu.Lock()
+		acked, sent := session.acked, session.sent
+		session.mu.Unlock()
+		if acked == sent {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v bytes to be acked, got: %v", sent, acked)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResumeUnknownSession(t *testing.T) {
+	sessions := &SessionStore{}
+	s := newResumeServer(t, sessions)
+	defer s.Close()
+
+	u, _ := url.Parse(s.URL)
+	f := newForwarder(t, u.Host)
+	defer f.Close()
+	u.Host = f.l.Addr().String()
+
+	d := testDialer
+	d.Resume = &ResumeConfig{InitialBackoff: 10 * time.Millisecond}
+	conn, _, _, err := d.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	// Forget the session on the server side
+	sessions.mu.Lock()
+	for _, session := range sessions.sessions {
+		defer session.abort(errors.New("test"))
+	}
+	sessions.sessions = nil
+	sessions.mu.Unlock()
+	f.breakAll()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected %v, got: %v", ErrSessionNotFound, err)
+	}
+
+	// The rejection carries no upgrade headers
+	req, _ := http.NewRequest(http.MethodGet, s.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tunnel")
+	req.Header.Set(resumeHeader, resumeParams{token: "unknown", hasReceived: true}.String())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status 404, got: %v", resp.Status)
+	}
+	if v := resp.Header.Get("Connection"); strings.EqualFold(v, "upgrade") || resp.Header.Get("Upgrade") != "" {
+		t.Errorf("expected no upgrade headers, got: %v", resp.Header)
+	}
+}
+
+func TestResumeFallback(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	d := testDialer
+	d.Resume = &ResumeConfig{}
+	conn, _, resp, err := d.Dial(s.URL, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*Conn).Conn.(*resumableConn); ok {
+		t.Fatal("expected a plain tunnel when the server does not assign a session")
+	}
+	sendRecv(conn, resp, t)
+}
+
+var parseResumeHeaderTests = []struct {
+	v        string
+	ok       bool
+	expected resumeParams
+}{
+	{"new", true, resumeParams{}},
+	{"new, window=65536", true, resumeParams{window: 65536}},
+	{"new, window=0", false, resumeParams{}},
+	{"new, token=abc", false, resumeParams{}},
+	{"token=abc", true, resumeParams{token: "abc"}},
+	{"token=abc, received=42", true, resumeParams{token: "abc", received: 42, hasReceived: true}},
+	{"token=abc, window=1048576", true, resumeParams{token: "abc", window: 1 << 20}},
+	{"token=abc, received=-1", false, resumeParams{}},
+	{"received=42", false, resumeParams{}},
+	{"garbage", false, resumeParams{}},
+}
+
+func TestParseResumeHeader(t *testing.T) {
+	for _, tt := range parseResumeHeaderTests {
+		p, ok := parseResumeHeader(tt.v)
+		if ok != tt.ok || ok && p != tt.expected {
+			t.Errorf("parseResumeHeader(%q) = %+v, %v, want %+v, %v", tt.v, p, ok, tt.expected, tt.ok)
+		}
+		if ok && tt.v != "garbage" {
+			if round, _ := parseResumeHeader(p.String()); round != p {
+				t.Errorf("expected %+v to round trip, got: %+v", p, round)
+			}
+		}
+	}
+}
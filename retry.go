@@ -0,0 +1,223 @@
+package httptunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = 100 * time.Millisecond
+	defaultRetryMaxBackoff     = 5 * time.Second
+	defaultRetryJitter         = 0.2
+)
+
+// A RetryPolicy controls how DialContext retries a failed handshake.
+//
+// Connection failures, timeouts, proxy failures and 502, 503 and 504
+// responses are retried. Other responses, such as 401 and 403, and TLS
+// certificate verification failures are returned immediately. When a
+// retryable response carries a Retry-After header, the next attempt is
+// delayed accordingly, and the response is returned if the delay exceeds
+// MaxBackoff.
+//
+// All the attempts, including the backoff between them, are bounded by the
+// Dialer's HandshakeTimeout. When no attempt succeeds, the result of the last
+// attempt is returned. If the context is done while waiting for the next
+// attempt, the error wraps both the context's error and the error of the last
+// attempt, and the response of the last attempt, if any, is returned with its
+// connection closed.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first
+	// one. If zero, 3 attempts are made.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry. It doubles after
+	// each retry up to MaxBackoff. If zero, 100ms and 5s are used.
+	InitialBackoff, MaxBackoff time.Duration
+
+	// Jitter is the fraction of the backoff that is randomized, between 0
+	// and 1. If zero, 0.2 is used. Use a negative value to disable jitter.
+	Jitter float64
+
+	// AttemptTimeout, if not zero, limits the duration of each attempt.
+	AttemptTimeout time.Duration
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return defaultRetryMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) maxBackoff() time.Duration {
+	if p.MaxBackoff <= 0 {
+		return defaultRetryMaxBackoff
+	}
+	return p.MaxBackoff
+}
+
+// backoff returns the delay before the given retry, starting at 1.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	backoff, maxBackoff := p.InitialBackoff, p.maxBackoff()
+	if backoff <= 0 {
+		backoff = defaultRetryInitialBackoff
+	}
+	for i := 1; i < retry && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxBackoff)
+
+	jitter := p.Jitter
+	if jitter == 0 {
+		jitter = defaultRetryJitter
+	}
+	if jitter > 0 {
+		backoff -= time.Duration(rand.Float64() * min(jitter, 1) * float64(backoff))
+	}
+	return backoff
+}
+
+// retryable reports whether a handshake that failed with err, or that
+// received resp, is worth another attempt.
+func retryable(resp *http.Response, err error) bool {
+	if err == nil {
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		hostnameErr  x509.HostnameError
+		authorityErr x509.UnknownAuthorityError
+		invalidErr   x509.CertificateInvalidError
+		proxyErr     *ProxyError
+		netErr       net.Error
+	)
+	switch {
+	case errors.As(err, &verifyErr), errors.As(err, &hostnameErr),
+		errors.As(err, &authorityErr), errors.As(err, &invalidErr):
+		return false
+	case errors.As(err, &proxyErr):
+		switch proxyErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusProxyAuthRequired:
+			return false
+		}
+		return true
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		// The connection was closed before a response was received
+		return true
+	case errors.Is(err, context.DeadlineExceeded):
+		return true
+	case errors.As(err, &netErr):
+		return netErr.Timeout()
+	}
+	return false
+}
+
+// retryAfter returns the delay requested by the Retry-After header of resp.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// dialWithRetry calls dialEndpoints until it succeeds or the Dialer's
+// RetryPolicy gives up. It returns the URL that was dialed.
+func (d *Dialer) dialWithRetry(
+	ctx context.Context,
+	urlStr string,
+	options *ConnectionOptions,
+	inst instruments,
+) (net.Conn, *bufio.Reader, *http.Response, string, error) {
+	policy := d.Retry
+	if policy == nil {
+		return d.dialEndpoints(ctx, urlStr, options, inst)
+	}
+
+	if d.HandshakeTimeout != 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, d.HandshakeTimeout)
+		defer cancel()
+	}
+
+	maxAttempts := policy.maxAttempts()
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if policy.AttemptTimeout != 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, policy.AttemptTimeout)
+		}
+		netConn, br, resp, dialed, err := d.dialEndpoints(attemptCtx, urlStr, options, inst)
+		cancel()
+		if attempt >= maxAttempts || ctx.Err() != nil || !retryable(resp, err) {
+			return netConn, br, resp, dialed, err
+		}
+
+		backoff := policy.backoff(attempt)
+		if delay, ok := retryAfter(resp); ok {
+			// The server asks for a longer wait than the policy allows
+			if delay > policy.maxBackoff() {
+				return netConn, br, resp, dialed, err
+			}
+			backoff = delay
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			return netConn, br, resp, dialed, err
+		}
+		if netConn != nil {
+			_ = netConn.Close()
+		}
+		status := ""
+		if resp != nil {
+			status = resp.Status
+		}
+		inst.logger.Info("retrying tunnel handshake",
+			"attempt", attempt,
+			"backoff", backoff,
+			"status", status,
+			"error", err,
+		)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			if err == nil {
+				_ = resp.Body.Close()
+				err = &unexpectedStatusError{resp.StatusCode, resp.Status}
+			}
+			return nil, nil, resp, dialed, fmt.Errorf("%w (last attempt: %w)", ctx.Err(), err)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package httptunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newFlakyServer returns a server responding with status to the first
+// failures requests and upgrading the following ones.
+func newFlakyServer(t *testing.T, status, failures int, requests *atomic.Int32) *mockServer {
+	var s mockServer
+	upgrade := testHandler{T: t, s: &s, hijacker: testHijacker}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := requests.Add(1); int(n) <= failures {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		upgrade.ServeHTTP(w, r)
+	}))
+	s.Server.URL += testRequestURI
+	s.URL = s.Server.URL
+	return &s
+}
+
+func TestRetry(t *testing.T) {
+	var requests atomic.Int32
+	s := newFlakyServer(t, http.StatusServiceUnavailable, 2, &requests)
+	defer s.Close()
+
+	d := testDialer
+	d.Retry = &RetryPolicy{InitialBackoff: time.Millisecond}
+	conn, _, resp, err := d.Dial(s.URL, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	sendRecv(conn, resp, t)
+	if n := requests.Load(); n != 3 {
+		t.Errorf("expected 3 attempts, got: %v", n)
+	}
+}
+
+func TestRetryTerminalStatus(t *testing.T) {
+	var requests atomic.Int32
+	s := newFlakyServer(t, http.StatusForbidden, 10, &requests)
+	defer s.Close()
+
+	d := testDialer
+	d.Retry = &RetryPolicy{InitialBackoff: time.Millisecond}
+	conn, _, resp, err := d.Dial(s.URL, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status %v, got: %v", http.StatusForbidden, resp.StatusCode)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected 1 attempt, got: %v", n)
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	var requests atomic.Int32
+	s := newFlakyServer(t, http.StatusBadGateway, 10, &requests)
+	defer s.Close()
+
+	d := testDialer
+	d.Retry = &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+	conn, _, resp, err := d.Dial(s.URL, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected status %v, got: %v", http.StatusBadGateway, resp.StatusCode)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("expected 2 attempts, got: %v", n)
+	}
+}
+
+func TestRetryConnectionRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	var dials atomic.Int32
+	d := testDialer
+	d.Retry = &RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Millisecond}
+	d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	_, _, _, err = d.Dial("http://"+addr+testRequestURI, testDialOptions)
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected connection refused, got: %v", err)
+	}
+	if n := dials.Load(); n != 4 {
+		t.Errorf("expected 4 attempts, got: %v", n)
+	}
+}
+
+func TestRetryTLSVerification(t *testing.T) {
+	s := newTLSServer(t)
+	defer s.Close()
+
+	var dials atomic.Int32
+	d := testDialer
+	d.Retry = &RetryPolicy{InitialBackoff: time.Millisecond}
+	d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	if _, _, _, err := d.Dial(s.URL, testDialOptions); err == nil {
+		t.Fatal("expected a certificate verification error")
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("expected 1 attempt, got: %v", n)
+	}
+}
+
+func TestRetryHandshakeTimeout(t *testing.T) {
+	var requests atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	d := testDialer
+	d.HandshakeTimeout = 5 * time.Second
+	d.Retry = &RetryPolicy{MaxBackoff: time.Minute}
+	start := time.Now()
+	conn, _, resp, err := d.Dial(s.URL, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Close()
+	if time.Since(start) > time.Second {
+		t.Errorf("expected the dial to give up when Retry-After exceeds the handshake timeout")
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || requests.Load() != 1 {
+		t.Errorf("expected a single 503 response, got: %v after %v attempts", resp.Status, requests.Load())
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := "http://" + l.Addr().String() + testRequestURI
+	l.Close()
+
+	for _, tt := range []struct {
+		name, url string
+		status    int
+		expected  error
+	}{
+		{"status", s.URL, http.StatusServiceUnavailable, nil},
+		{"refused", refused, 0, syscall.ECONNREFUSED},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testDialer
+			d.HandshakeTimeout = 0
+			d.Retry = &RetryPolicy{InitialBackoff: time.Minute, MaxBackoff: time.Minute}
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			_, _, resp, err := d.DialContext(ctx, tt.url, testDialOptions)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected %v, got: %v", context.Canceled, err)
+			}
+			// The error of the last attempt is kept
+			var statusErr *unexpectedStatusError
+			switch {
+			case tt.expected != nil && !errors.Is(err, tt.expected):
+				t.Errorf("expected %v, got: %v", tt.expected, err)
+			case tt.status != 0 && (!errors.As(err, &statusErr) || resp == nil || resp.StatusCode != tt.status):
+				t.Errorf("expected the %v response, got: %v, %v", tt.status, resp, err)
+			}
+		})
+	}
+}
+
+func TestRetryAfterMaxBackoff(t *testing.T) {
+	var requests atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	d := testDialer
+	d.Retry = &RetryPolicy{}
+	start := time.Now()
+	conn, _, resp, err := d.Dial(s.URL, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Close()
+	if time.Since(start) > time.Second {
+		t.Errorf("expected the dial to give up when Retry-After exceeds MaxBackoff")
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || requests.Load() != 1 {
+		t.Errorf("expected a single 503 response, got: %v after %v attempts", resp.Status, requests.Load())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, tt := range []struct {
+		v        string
+		ok       bool
+		expected time.Duration
+	}{
+		{"", false, 0},
+		{"3", true, 3 * time.Second},
+		{"-1", false, 0},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), true, 0},
+		{"soon", false, 0},
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.v != "" {
+			resp.Header.Set("Retry-After", tt.v)
+		}
+		delay, ok := retryAfter(resp)
+		if ok != tt.ok || delay != tt.expected {
+			t.Errorf("retryAfter(%q) = %v, %v, want %v, %v", tt.v, delay, ok, tt.expected, tt.ok)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := &RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Jitter: -1}
+	for retry, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if backoff := p.backoff(retry + 1); backoff != expected {
+			t.Errorf("backoff(%v) = %v, want %v", retry+1, backoff, expected)
+		}
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if backoff := p.backoff(1); backoff < time.Second/2 || backoff > time.Second {
+			t.Fatalf("expected the jittered backoff to be within [0.5s, 1s], got: %v", backoff)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		resp     *http.Response
+		err      error
+		expected bool
+	}{
+		{"503", &http.Response{StatusCode: http.StatusServiceUnavailable}, nil, true},
+		{"504", &http.Response{StatusCode: http.StatusGatewayTimeout}, nil, true},
+		{"401", &http.Response{StatusCode: http.StatusUnauthorized}, nil, false},
+		{"101", &http.Response{StatusCode: http.StatusSwitchingProtocols}, nil, false},
+		{"proxy 502", nil, &ProxyError{StatusCode: http.StatusBadGateway}, true},
+		{"proxy 407", nil, &ProxyError{StatusCode: http.StatusProxyAuthRequired}, false},
+		{"refused", nil, &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{"deadline", nil, context.DeadlineExceeded, true},
+		{"other", nil, errors.New("bad request"), false},
+	} {
+		if actual := retryable(tt.resp, tt.err); actual != tt.expected {
+			t.Errorf("%v: expected %v, got: %v", tt.name, tt.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package httptunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrCertificateRevoked is wrapped by the errors of the requests rejected
+// because their client certificate is revoked.
+var ErrCertificateRevoked = errors.New("httptunnel: client certificate revoked")
+
+// crlReasons names the CRL reason codes of RFC 5280.
+var crlReasons = map[int]string{
+	0:  "unspecified",
+	1:  "key compromise",
+	2:  "CA compromise",
+	3:  "affiliation changed",
+	4:  "superseded",
+	5:  "cessation of operation",
+	6:  "certificate hold",
+	8:  "remove from CRL",
+	9:  "privilege withdrawn",
+	10: "AA compromise",
+}
+
+// A RevocationChecker rejects the client certificates revoked by certificate
+// revocation lists (CRL) or denied by serial number. Set it as
+// Hijacker.Revocation to check the certificates of the mutual TLS
+// connections of the tunnels.
+//
+// The CRLs are loaded from local files, trusted as the rest of the server
+// configuration is. Their signatures are not verified against the issuer,
+// so a CRL must only be loaded from a trusted source, and its entries apply
+// to the certificates of the same issuer name.
+//
+// The revoked clients are rejected with 403 Forbidden by Hijacker.Upgrade.
+// Hijacker.Hijack only returns an error wrapping ErrCertificateRevoked,
+// without hijacking the connection, and the caller must respond to the
+// request or close the connection itself.
+//
+// It is safe to call RevocationChecker's methods concurrently.
+type RevocationChecker struct {
+	// Logger, if not nil, receives the reloads and their failures.
+	Logger *slog.Logger
+
+	crlPath string
+
+	mu      sync.RWMutex
+	revoked map[string]int // issuer and serial to reason code
+	denied  map[string]bool
+}
+
+// NewRevocationChecker loads the CRLs of crlPath, which is either a file or
+// a directory of files, in PEM or DER format. If crlPath is empty, only the
+// serial numbers passed to Deny are rejected.
+func NewRevocationChecker(crlPath string) (*RevocationChecker, error) {
+	c := &RevocationChecker{crlPath: crlPath, denied: make(map[string]bool)}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *RevocationChecker) logger() *slog.Logger {
+	if c.Logger == nil {
+		return discardLogger
+	}
+	return c.Logger
+}
+
+func revocationKey(rawIssuer []byte, serial *big.Int) string {
+	return string(rawIssuer) + serial.String()
+}
+
+// Reload loads the CRLs again. If one of them cannot be loaded, the
+// previous CRLs are kept.
+func (c *RevocationChecker) Reload() error {
+	if c.crlPath == "" {
+		return nil
+	}
+	files := []string{c.crlPath}
+	info, err := os.Stat(c.crlPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := os.ReadDir(c.crlPath)
+		if err != nil {
+			return err
+		}
+		files = files[:0]
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				files = append(files, filepath.Join(c.crlPath, entry.Name()))
+			}
+		}
+	}
+
+	revoked := make(map[string]int)
+	now := time.Now()
+	for _, file := range files {
+		crls, err := readCRLs(file)
+		if err != nil {
+			return fmt.Errorf("httptunnel: %s: %w", file, err)
+		}
+		for _, crl := range crls {
+			if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+				c.logger().Warn("crl is out of date", "file", file, "issuer", crl.Issuer.String(), "next_update", crl.NextUpdate)
+			}
+			for _, entry := range crl.RevokedCertificateEntries {
+				revoked[revocationKey(crl.RawIssuer, entry.SerialNumber)] = entry.ReasonCode
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.revoked = revoked
+	c.mu.Unlock()
+	c.logger().Info("crls loaded", "path", c.crlPath, "revoked", len(revoked))
+	return nil
+}
+
+// readCRLs parses the CRLs of a PEM or DER file.
+func readCRLs(file string) ([]*x509.RevocationList, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var crls []*x509.RevocationList
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) > 0 {
+		return crls, nil
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+	return []*x509.RevocationList{crl}, nil
+}
+
+// Watch reloads the CRLs every interval until ctx is done. The failed
+// reloads are logged and the previous CRLs are kept.
+func (c *RevocationChecker) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Reload(); err != nil {
+				c.logger().Warn("crl reload failed, keeping the previous crls", "error", err)
+			}
+		}
+	}
+}
+
+// Deny rejects the certificates with the given serial number, whatever
+// their issuer.
+func (c *RevocationChecker) Deny(serial *big.Int) {
+	c.mu.Lock()
+	c.denied[serial.String()] = true
+	c.mu.Unlock()
+}
+
+// Check returns an error wrapping ErrCertificateRevoked if a certificate of
+// the client of state is revoked. The certificates of the verified chain
+// are checked, or the leaf certificate if the chain was not verified.
+func (c *RevocationChecker) Check(state *tls.ConnectionState) error {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	certs := state.PeerCertificates[:1]
+	if len(state.VerifiedChains) > 0 {
+		certs = state.VerifiedChains[0]
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, cert := range certs {
+		if c.denied[cert.SerialNumber.String()] {
+			return fmt.Errorf("%w: %s (serial %x): denied", ErrCertificateRevoked, cert.Subject, cert.SerialNumber)
+		}
+		if reason, ok := c.revoked[revocationKey(cert.RawIssuer, cert.SerialNumber)]; ok {
+			name, ok := crlReasons[reason]
+			if !ok {
+				name = fmt.Sprintf("reason %d", reason)
+			}
+			return fmt.Errorf("%w: %s (serial %x): %s", ErrCertificateRevoked, cert.Subject, cert.SerialNumber, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package httptunnel
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCRL writes a CRL of ca revoking certs for key compromise to path.
+func writeCRL(t *testing.T, ca *DevCA, path string, certs ...tls.Certificate) {
+	t.Helper()
+	template := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, cert := range certs {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   cert.Leaf.SerialNumber,
+			RevocationTime: time.Now(),
+			ReasonCode:     1,
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.Certificate, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}))
+}
+
+func TestRevocation(t *testing.T) {
+	ca, err := NewDevCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := make(map[string]tls.Certificate)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if certs[name], err = ca.ClientCertificate(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := t.TempDir()
+	writeCRL(t, ca, filepath.Join(dir, "ca.crl"), certs["bob"])
+	checker, err := NewRevocationChecker(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker.Deny(certs["carol"].Leaf.SerialNumber)
+
+	s := newDevCAServer(t, ca)
+	defer s.Close()
+	hijacker := Hijacker{Revocation: checker}
+	s.Server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.wg.Add(1)
+		defer s.wg.Done()
+		conn, _, err := hijacker.Upgrade(w, r, nil)
+		if errors.Is(err, ErrCertificateRevoked) {
+			return
+		}
+		if err != nil {
+			t.Errorf("Upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	})
+
+	dial := func(name string) int {
+		t.Helper()
+		d := testDialer
+		d.TLSClientConfig = ca.ClientTLSConfig(certs[name])
+		conn, _, resp, err := d.Dial(s.URL, nil)
+		if err != nil {
+			t.Fatalf("%v: Dial: %v", name, err)
+		}
+		defer conn.Close()
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			echo(t, conn, "hello")
+		}
+		return resp.StatusCode
+	}
+	for name, expected := range map[string]int{
+		"alice": http.StatusSwitchingProtocols,
+		"bob":   http.StatusForbidden,
+		"carol": http.StatusForbidden,
+	} {
+		if status := dial(name); status != expected {
+			t.Errorf("%v: expected status %v, got: %v", name, expected, status)
+		}
+	}
+
+	// Reloading picks up the new revocations
+	writeCRL(t, ca, filepath.Join(dir, "ca.crl"), certs["alice"], certs["bob"])
+	if err := checker.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if status := dial("alice"); status != http.StatusForbidden {
+		t.Errorf("expected alice to be rejected after reload, got: %v", status)
+	}
+
+	// A broken CRL is not used
+	if err := os.WriteFile(filepath.Join(dir, "broken.crl"), []byte("not a crl"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checker.Reload(); err == nil {
+		t.Error("expected an error for a broken CRL")
+	}
+	err = checker.Check(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{certs["alice"].Leaf}})
+	if !errors.Is(err, ErrCertificateRevoked) {
+		t.Errorf("expected the previous CRLs to be kept, got: %v", err)
+	}
+}
@@ -2,9 +2,13 @@ package httptunnel
 
 import (
 	"bufio"
+	"context"
+	"crypto/ecdh"
 	"errors"
+	"log/slog"
 	"net"
 	"net/http"
+	"time"
 )
 
 var ErrBadOrigin = errors.New("httptunnel: request origin not allowed by HijackOptions.checkOrigin")
@@ -18,37 +22,265 @@ type Hijacker struct {
 	// Default behavior is to ignore origin if the header is unset, otherwise
 	// check that host matches between header and url
 	OverrideCheckOrigin func(*http.Request) error
+	// Metrics, if not nil, records handshakes and traffic of the tunnels
+	// accepted by this Hijacker.
+	Metrics *Metrics
+	// Observer, if not nil, is notified of the lifecycle events of the
+	// tunnels accepted by this Hijacker.
+	Observer Observer
+	// Logger, if not nil, receives structured records about rejected
+	// requests and the tunnels accepted by this Hijacker.
+	Logger *slog.Logger
+	// SpanExporter, if not nil, receives a span for each request handled by
+	// Hijack. The span is a child of the span context propagated by the
+	// client in the traceparent header, if any.
+	SpanExporter SpanExporter
+	// Audit, if not nil, receives a record when each tunnel accepted by this
+	// Hijacker is opened and closed.
+	Audit *AuditLog
+	// Sessions, if not nil, enables resumable tunnels for requests handled
+	// by Upgrade. See ResumeConfig.
+	Sessions *SessionStore
+	// Revocation, if not nil, rejects the requests whose TLS client
+	// certificate is revoked. Only Upgrade responds to them with 403
+	// Forbidden; see RevocationChecker.
+	Revocation *RevocationChecker
+	// Noise, if not nil, requires the tunnels handled by Upgrade to be
+	// encrypted end to end with the Dialer. See NoiseConfig.
+	Noise *NoiseConfig
+	// Compression, if not nil, compresses the tunnels handled by Upgrade
+	// whose Dialer requests it. See CompressionConfig.
+	Compression *CompressionConfig
 }
 
-func (h Hijacker) handleRequest(r *http.Request) error {
+func (h Hijacker) handleRequest(r *http.Request, logger *slog.Logger) error {
 	if h.OverrideCheckOrigin == nil {
 		if !checkSameOrigin(r) {
+			logger.Warn("origin rejected", "origin", r.Header.Get("Origin"), "host", r.Host)
 			return ErrBadOrigin
 		}
 	} else if err := h.OverrideCheckOrigin(r); err != nil {
+		logger.Warn("origin rejected", "origin", r.Header.Get("Origin"), "host", r.Host, "error", err)
 		return err
 	}
+	if h.Revocation != nil {
+		if err := h.Revocation.Check(r.TLS); err != nil {
+			logger.Warn("client certificate rejected", "remote_addr", r.RemoteAddr, "error", err)
+			return err
+		}
+	}
 	if h.OverrideHandleRequest == nil {
 		return nil
 	}
-	return h.OverrideHandleRequest(r)
+	if err := h.OverrideHandleRequest(r); err != nil {
+		logger.Warn("request rejected", "error", err)
+		return err
+	}
+	return nil
 }
 
 // Hijack the underlying TCP connection
+//
+// The span context propagated by the client, or the span recorded for
+// SpanExporter, is available from the context of the request passed to
+// OverrideCheckOrigin and OverrideHandleRequest, and from Conn.SpanContext.
+//
+// The returned net.Conn is a *Conn. Data buffered by the http server before
+// the hijack is returned by the first reads from the connection.
+//
+// The response written by the application is left as is, so a rejected
+// request, for example by Revocation, is only reported by the returned
+// error. Use Upgrade to respond to the rejected requests with an error
+// status.
 func (h Hijacker) Hijack(
 	w http.ResponseWriter,
 	r *http.Request,
 ) (net.Conn, *bufio.ReadWriter, error) {
-	err := h.handleRequest(r)
+	return h.hijack(w, r, nil)
+}
+
+// Upgrade responds to the request with 101 Switching Protocols and hijacks
+// the underlying TCP connection. Unlike Hijack, which leaves the response to
+// the application, Upgrade writes the response itself so that the Hijacker
+// can negotiate tunnel features with the Dialer. The response includes
+// responseHeader, "Connection: Upgrade" and, unless responseHeader sets it,
+// the Upgrade header of the request.
+//
+// If the request is rejected, Upgrade responds with 403 Forbidden and returns
+// the error. When the request resumes a tunnel held in Sessions, the
+// connection is handed over to that tunnel and ErrSessionResumed is returned.
+func (h Hijacker) Upgrade(
+	w http.ResponseWriter,
+	r *http.Request,
+	responseHeader http.Header,
+) (net.Conn, *bufio.ReadWriter, error) {
+	if responseHeader == nil {
+		responseHeader = make(http.Header)
+	}
+	return h.hijack(w, r, responseHeader)
+}
+
+// hijack implements Hijack and, when responseHeader is not nil, Upgrade.
+func (h Hijacker) hijack(
+	w http.ResponseWriter,
+	r *http.Request,
+	responseHeader http.Header,
+) (net.Conn, *bufio.ReadWriter, error) {
+	upgrade := responseHeader != nil
+	parent, _ := extractSpanContext(r.Header)
+	inst := h.instruments().withSpan(startSpan("httptunnel.accept", SideServer, parent, h.SpanExporter))
+	inst.span.setAttribute("url", r.RequestURI)
+	inst.span.setAttribute("remote_addr", r.RemoteAddr)
+	if sc := inst.span.spanContext(); sc.IsValid() {
+		r = r.WithContext(ContextWithSpanContext(r.Context(), sc))
+	}
+	info := HandshakeInfo{
+		Side:       SideServer,
+		ID:         inst.id,
+		URL:        r.RequestURI,
+		RemoteAddr: r.RemoteAddr,
+		Start:      time.Now(),
+	}
+	inst.handshakeStart(info)
+	err := h.handleRequest(r, inst.logger)
 	if err != nil {
+		if upgrade {
+			status := http.StatusForbidden
+			var se *statusError
+			if errors.As(err, &se) {
+				status = se.status
+			}
+			http.Error(w, http.StatusText(status), status)
+		}
+		inst.handshakeDone(info, nil, outcomeRejected, err)
 		return nil, nil, err
 	}
+
+	var session *resumableConn
+	var resume resumeParams
+	var compress bool
+	if upgrade {
+		// The requests are rejected before the upgrade headers are set
+		if h.Noise != nil && r.Header.Get(encryptionHeader) != noiseProtocol {
+			inst.logger.Warn("request rejected", "error", ErrEncryptionRequired)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			inst.handshakeDone(info, nil, outcomeRejected, ErrEncryptionRequired)
+			return nil, nil, ErrEncryptionRequired
+		}
+		header := w.Header()
+		session, resume, err = h.negotiateResume(header, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			inst.handshakeDone(info, nil, outcomeRejected, err)
+			return nil, nil, err
+		}
+		for k, v := range responseHeader {
+			header[k] = v
+		}
+		header.Set("Connection", "Upgrade")
+		if header.Get("Upgrade") == "" {
+			header.Set("Upgrade", r.Header.Get("Upgrade"))
+		}
+		if h.Noise != nil {
+			header.Set(encryptionHeader, noiseProtocol)
+		}
+		if h.Compression != nil && acceptsDeflate(r.Header.Get(compressionHeader)) {
+			header.Set(compressionHeader, compressionDeflate)
+			compress = true
+		}
+		w.WriteHeader(http.StatusSwitchingProtocols)
+	}
+
 	netConn, brw, err := http.NewResponseController(w).Hijack()
 	if err != nil {
 		if netConn != nil {
 			_ = netConn.Close()
 		}
+		if session != nil && resume.token == "" {
+			session.abort(err)
+		}
+		inst.handshakeDone(info, nil, outcomeError, err)
 		return nil, nil, err
 	}
-	return netConn, brw, nil
+	var stream net.Conn = &bufferedConn{Conn: netConn, r: brw.Reader}
+	if session != nil {
+		if resume.token != "" {
+			err := session.attach(stream, resume.received)
+			inst.handshakeResumed(info, err)
+			if err != nil {
+				return nil, nil, err
+			}
+			return nil, nil, ErrSessionResumed
+		}
+		session.start(stream)
+		stream = session
+	}
+	var noisePeer *ecdh.PublicKey
+	if upgrade && h.Noise != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), noiseHandshakeTimeout)
+		encrypted, err := h.Noise.respond(ctx, stream)
+		cancel()
+		if err != nil {
+			_ = stream.Close()
+			inst.logger.Warn("noise handshake failed", "remote_addr", r.RemoteAddr, "error", err)
+			inst.handshakeDone(info, nil, outcomeRejected, err)
+			return nil, nil, err
+		}
+		stream, noisePeer = encrypted, encrypted.peer
+	}
+	if compress {
+		compressed, err := newCompressedConn(stream, h.Compression)
+		if err != nil {
+			_ = stream.Close()
+			inst.handshakeDone(info, nil, outcomeError, err)
+			return nil, nil, err
+		}
+		stream = compressed
+	}
+	if h.Audit != nil {
+		inst.audit = &tunnelAudit{log: h.Audit, record: h.Audit.newRecord(w, r, inst.id)}
+	}
+	conn := newConn(stream, inst)
+	conn.tlsState = r.TLS
+	conn.noisePeer = noisePeer
+	inst.handshakeDone(info, conn, outcomeSuccess, nil)
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+// negotiateResume creates or looks up the session of a resumable tunnel
+// requested by r and sets the response header accordingly. It returns a nil
+// session if resumption is disabled or was not requested. The header is left
+// unchanged if the session cannot be resumed.
+func (h Hijacker) negotiateResume(header http.Header, r *http.Request) (*resumableConn, resumeParams, error) {
+	var params resumeParams
+	v := r.Header.Get(resumeHeader)
+	if h.Sessions == nil || v == "" {
+		return nil, params, nil
+	}
+	params, ok := parseResumeHeader(v)
+	if !ok {
+		return nil, params, nil
+	}
+	if params.token == "" {
+		session := h.Sessions.create(params.window)
+		header.Set(resumeHeader, resumeParams{
+			token:  session.token,
+			window: h.Sessions.bufferSize(),
+		}.String())
+		return session, params, nil
+	}
+	session := h.Sessions.get(params.token)
+	if session == nil || !params.hasReceived {
+		return nil, params, ErrSessionNotFound
+	}
+	received, err := session.detach()
+	if err != nil {
+		return nil, params, ErrSessionNotFound
+	}
+	header.Set(resumeHeader, resumeParams{
+		token:       session.token,
+		received:    received,
+		hasReceived: true,
+	}.String())
+	return session, params, nil
 }
@@ -0,0 +1,464 @@
+package httptunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SOCKS5 protocol values, from RFC 1928 and RFC 1929.
+const (
+	socksVersion = 5
+
+	socksAuthNone         = 0
+	socksAuthPassword     = 2
+	socksAuthUnacceptable = 0xff
+	socksPasswordVersion  = 1
+
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+
+	socksAddrIPv4   = 1
+	socksAddrDomain = 3
+	socksAddrIPv6   = 4
+
+	socksSucceeded           = 0
+	socksGeneralFailure      = 1
+	socksNotAllowed          = 2
+	socksHostUnreachable     = 4
+	socksConnectionRefused   = 5
+	socksCommandNotSupported = 7
+	socksAddrNotSupported    = 8
+
+	// socksHandshakeTimeout bounds the SOCKS negotiation with the clients.
+	socksHandshakeTimeout = 10 * time.Second
+)
+
+// A SOCKSServer is a SOCKS5 proxy (RFC 1928) opening a tunnel for each
+// connection of its clients, for example browsers and command line tools
+// pointed at localhost:1080. The destination of each connection is sent to
+// the server with WithTarget, and the server connects to it with a
+// TargetHandler.
+//
+// The CONNECT command is supported, and the UDP ASSOCIATE command if UDP is
+// set. Each destination of the datagrams of a UDP association has its own
+// tunnel, closed once idle.
+type SOCKSServer struct {
+	// Dialer dials the tunnels. If nil, a zero Dialer is used.
+	Dialer *Dialer
+	// URL and Options are passed to Dialer.DialContext.
+	URL     string
+	Options *ConnectionOptions
+
+	// Authenticate, if not nil, requires the clients to authenticate with
+	// a username and password (RFC 1929), and reports whether they are
+	// valid. If nil, no authentication is required.
+	Authenticate func(username, password string) bool
+
+	// UDP enables the UDP ASSOCIATE command.
+	UDP bool
+	// UDPIdleTimeout is the time after which the tunnel of a destination of
+	// a UDP association without traffic is closed. If zero, it is 2 minutes.
+	UDPIdleTimeout time.Duration
+
+	// Logger, if not nil, receives the connections and their failures.
+	Logger *slog.Logger
+}
+
+// PasswordAuthenticator returns a SOCKSServer.Authenticate function
+// accepting username with password.
+func PasswordAuthenticator(username, password string) func(string, string) bool {
+	return func(u, p string) bool {
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(username))
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(password))
+		return userOK&passOK == 1
+	}
+}
+
+func (s *SOCKSServer) logger() *slog.Logger {
+	if s.Logger == nil {
+		return discardLogger
+	}
+	return s.Logger
+}
+
+// ListenAndServe listens on the TCP address addr and calls Serve.
+func (s *SOCKSServer) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts the connections of l until ctx is done or l fails. It closes
+// l and the connections when it returns.
+func (s *SOCKSServer) Serve(ctx context.Context, l net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { _ = l.Close() })
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		_ = l.Close()
+		wg.Wait()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+			defer stop()
+			defer conn.Close()
+			s.serveConn(ctx, conn)
+		}()
+	}
+}
+
+// socksRequestError is a failed SOCKS request, answered with reply.
+type socksRequestError struct {
+	reply byte
+	err   error
+}
+
+func (e *socksRequestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *socksRequestError) Unwrap() error {
+	return e.err
+}
+
+func (s *SOCKSServer) serveConn(ctx context.Context, conn net.Conn) {
+	logger := s.logger().With("client", conn.RemoteAddr().String())
+	_ = conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	br := bufio.NewReader(conn)
+	cmd, dst, err := s.handshake(br, conn)
+	if err != nil {
+		var reqErr *socksRequestError
+		if errors.As(err, &reqErr) {
+			_ = writeSOCKSReply(conn, reqErr.reply, nil)
+		}
+		logger.Warn("socks request rejected", "error", err)
+		return
+	}
+
+	switch cmd {
+	case socksCmdConnect:
+		logger = logger.With("destination", dst)
+		tunnel, err := dialTunnel(ctx, s.Dialer, s.URL, WithTarget(s.Options, "tcp", dst))
+		if err != nil {
+			logger.Warn("socks connect failed", "error", err)
+			_ = writeSOCKSReply(conn, socksTunnelReply(err), nil)
+			return
+		}
+		if err := writeSOCKSReply(conn, socksSucceeded, nil); err != nil {
+			_ = tunnel.Close()
+			return
+		}
+		_ = conn.SetDeadline(time.Time{})
+		logger.Debug("socks connected", "tunnel_id", tunnel.ID())
+		// The client may have sent data along with its request
+		var client net.Conn = conn
+		if br.Buffered() > 0 {
+			client = &bufferedConn{Conn: conn, r: br}
+		}
+		pipeConns(client, tunnel)
+	case socksCmdUDPAssociate:
+		s.associate(ctx, conn, logger)
+	}
+}
+
+// handshake negotiates the authentication method and reads the request of
+// the client.
+func (s *SOCKSServer) handshake(br *bufio.Reader, w io.Writer) (byte, string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return 0, "", err
+	}
+	if header[0] != socksVersion {
+		return 0, "", fmt.Errorf("httptunnel: unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return 0, "", err
+	}
+	method := byte(socksAuthNone)
+	if s.Authenticate != nil {
+		method = socksAuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		_, _ = w.Write([]byte{socksVersion, socksAuthUnacceptable})
+		return 0, "", errors.New("httptunnel: no acceptable socks authentication method")
+	}
+	if _, err := w.Write([]byte{socksVersion, method}); err != nil {
+		return 0, "", err
+	}
+	if method == socksAuthPassword {
+		if err := s.authenticate(br, w); err != nil {
+			return 0, "", err
+		}
+	}
+
+	var req [3]byte
+	if _, err := io.ReadFull(br, req[:]); err != nil {
+		return 0, "", err
+	}
+	if req[0] != socksVersion {
+		return 0, "", fmt.Errorf("httptunnel: unsupported socks version %d", req[0])
+	}
+	dst, err := readSOCKSAddr(br)
+	if err != nil {
+		return 0, "", err
+	}
+	switch cmd := req[1]; {
+	case cmd == socksCmdConnect, cmd == socksCmdUDPAssociate && s.UDP:
+		return cmd, dst, nil
+	default:
+		return 0, "", &socksRequestError{socksCommandNotSupported, fmt.Errorf("httptunnel: unsupported socks command %d", cmd)}
+	}
+}
+
+// authenticate runs the username and password authentication of RFC 1929.
+func (s *SOCKSServer) authenticate(br *bufio.Reader, w io.Writer) error {
+	readString := func() (string, error) {
+		size, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, size)
+		_, err = io.ReadFull(br, b)
+		return string(b), err
+	}
+	version, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != socksPasswordVersion {
+		return fmt.Errorf("httptunnel: unsupported socks authentication version %d", version)
+	}
+	username, err := readString()
+	if err != nil {
+		return err
+	}
+	password, err := readString()
+	if err != nil {
+		return err
+	}
+	if !s.Authenticate(username, password) {
+		_, _ = w.Write([]byte{socksPasswordVersion, 1})
+		return fmt.Errorf("httptunnel: socks authentication failed for %q", username)
+	}
+	_, err = w.Write([]byte{socksPasswordVersion, 0})
+	return err
+}
+
+// socksTunnelReply returns the SOCKS reply of a failed tunnel dial.
+func socksTunnelReply(err error) byte {
+	var statusErr *unexpectedStatusError
+	if !errors.As(err, &statusErr) {
+		return socksGeneralFailure
+	}
+	switch statusErr.code {
+	case http.StatusForbidden:
+		return socksNotAllowed
+	case http.StatusBadGateway:
+		return socksConnectionRefused
+	case http.StatusGatewayTimeout:
+		return socksHostUnreachable
+	default:
+		return socksGeneralFailure
+	}
+}
+
+// readSOCKSAddr reads an address type, address and port and returns them as
+// host:port.
+func readSOCKSAddr(r io.Reader) (string, error) {
+	var typ [1]byte
+	if _, err := io.ReadFull(r, typ[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch typ[0] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make([]byte, 4)
+		if typ[0] == socksAddrIPv6 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.String()
+	case socksAddrDomain:
+		var size [1]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", &socksRequestError{socksAddrNotSupported, fmt.Errorf("httptunnel: unsupported socks address type %d", typ[0])}
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// appendSOCKSAddr appends the address type, address and port of addr, a
+// host:port, to b.
+func appendSOCKSAddr(b []byte, addr string) []byte {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, portStr = "0.0.0.0", "0"
+	}
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is4() || ip.Is4In6() {
+			b = append(b, socksAddrIPv4)
+			b = append(b, ip.Unmap().AsSlice()...)
+		} else {
+			b = append(b, socksAddrIPv6)
+			b = append(b, ip.AsSlice()...)
+		}
+	} else {
+		b = append(b, socksAddrDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// writeSOCKSReply writes a reply with the bound address bound, if not nil.
+func writeSOCKSReply(w io.Writer, reply byte, bound net.Addr) error {
+	addr := "0.0.0.0:0"
+	if bound != nil {
+		addr = bound.String()
+	}
+	_, err := w.Write(appendSOCKSAddr([]byte{socksVersion, reply, 0}, addr))
+	return err
+}
+
+// associate relays the datagrams of a UDP association until the control
+// connection conn is closed.
+func (s *SOCKSServer) associate(ctx context.Context, conn net.Conn, logger *slog.Logger) {
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	var ip net.IP
+	if local != nil {
+		ip = local.IP
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		logger.Warn("socks udp associate failed", "error", err)
+		_ = writeSOCKSReply(conn, socksGeneralFailure, nil)
+		return
+	}
+	defer pc.Close()
+	if err := writeSOCKSReply(conn, socksSucceeded, pc.LocalAddr()); err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	logger.Debug("socks udp associated", "relay", pc.LocalAddr().String())
+
+	// The association ends with the control connection
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		cancel()
+	}()
+	stop := context.AfterFunc(ctx, func() { _ = pc.Close() })
+	defer stop()
+
+	idleTimeout := s.UDPIdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultUDPIdleTimeout
+	}
+	flows := newUDPFlows(idleTimeout, logger)
+	defer func() {
+		cancel()
+		flows.closeAll()
+	}()
+
+	// Only the datagrams of the client are relayed
+	clientAddr, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+	var mu sync.Mutex
+	var client net.Addr // the address the client sends the datagrams from
+	buf := make([]byte, MaxMessageSize)
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if srcAddr, _ := netip.ParseAddrPort(src.String()); srcAddr.Addr().Unmap() != clientAddr.Addr().Unmap() {
+			continue
+		}
+		mu.Lock()
+		client = src
+		mu.Unlock()
+		dst, payload, err := parseSOCKSDatagram(buf[:n])
+		if err != nil {
+			logger.Debug("socks datagram dropped", "error", err)
+			continue
+		}
+		header := appendSOCKSAddr([]byte{0, 0, 0}, dst)
+		flows.send(ctx, dst, payload,
+			func(ctx context.Context) (*Conn, error) {
+				return dialTunnel(ctx, s.Dialer, s.URL, WithTarget(s.Options, "udp", dst))
+			},
+			func(msg []byte) error {
+				mu.Lock()
+				to := client
+				mu.Unlock()
+				_, err := pc.WriteTo(append(header[:len(header):len(header)], msg...), to)
+				return err
+			},
+		)
+	}
+}
+
+// parseSOCKSDatagram returns the destination and payload of a datagram of a
+// UDP association. Fragments are not supported.
+func parseSOCKSDatagram(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("httptunnel: short socks datagram")
+	}
+	if b[2] != 0 {
+		return "", nil, errors.New("httptunnel: fragmented socks datagram")
+	}
+	r := bytes.NewReader(b[3:])
+	dst, err := readSOCKSAddr(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return dst, b[len(b)-r.Len():], nil
+}
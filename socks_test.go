@@ -0,0 +1,321 @@
+package httptunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func allowAllTargets(string, netip.AddrPort) error { return nil }
+
+// newTCPEchoServer returns the address of a TCP server echoing the data of
+// its connections.
+func newTCPEchoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// newSOCKSServer serves s, tunneling to a TargetHandler with handler's
+// policy, and returns its address.
+func newSOCKSServer(t *testing.T, s *SOCKSServer, handler *TargetHandler) string {
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	s.URL = ts.URL + testRequestURI
+	if s.Dialer == nil {
+		d := testDialer
+		s.Dialer = &d
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ctx, l) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-served; !errors.Is(err, context.Canceled) {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+	return l.Addr().String()
+}
+
+func TestSOCKSConnect(t *testing.T) {
+	target := newTCPEchoServer(t)
+	addr := newSOCKSServer(t, &SOCKSServer{
+		Authenticate: PasswordAuthenticator("alice", "secret"),
+	}, &TargetHandler{Allow: allowAllTargets})
+
+	socks, err := proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "alice", Password: "secret"}, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := socks.Dial("tcp", target)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	echo(t, conn, "hello through socks")
+
+	socks, _ = proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "alice", Password: "wrong"}, proxy.Direct)
+	if _, err := socks.Dial("tcp", target); err == nil {
+		t.Error("expected the authentication to fail")
+	}
+	socks, _ = proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	if _, err := socks.Dial("tcp", target); err == nil {
+		t.Error("expected the authentication to be required")
+	}
+}
+
+// newTCPReplyServer returns the address of a TCP server replying to the
+// data of its connections once they are closed for writing.
+func newTCPReplyServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request, err := io.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write(append([]byte("reply to "), request...))
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestSOCKSHalfClose(t *testing.T) {
+	target := newTCPReplyServer(t)
+	for _, tc := range []struct {
+		name        string
+		compression *CompressionConfig
+	}{
+		{name: "plain"},
+		{name: "compressed", compression: &CompressionConfig{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := testDialer
+			d.Compression = tc.compression
+			addr := newSOCKSServer(t, &SOCKSServer{Dialer: &d}, &TargetHandler{
+				Hijacker: Hijacker{Compression: tc.compression},
+				Allow:    allowAllTargets,
+			})
+
+			socks, _ := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+			conn, err := socks.Dial("tcp", target)
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte("request")); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			// The reply is only sent once the target reads EOF
+			reply, err := io.ReadAll(conn)
+			if err != nil || string(reply) != "reply to request" {
+				t.Errorf("expected the reply, got: %q, %v", reply, err)
+			}
+		})
+	}
+}
+
+func TestTargetClosedResumable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("bye"))
+		conn.Close()
+	}()
+	ts := httptest.NewServer(&TargetHandler{
+		Hijacker: Hijacker{Sessions: &SessionStore{}},
+		Allow:    allowAllTargets,
+	})
+	defer ts.Close()
+
+	// A resumable tunnel cannot be half-closed, so the target closing
+	// closes the tunnel
+	d := testDialer
+	d.Resume = &ResumeConfig{}
+	conn, _, _, err := d.Dial(ts.URL+testRequestURI, WithTarget(nil, "tcp", l.Addr().String()))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*Conn).Conn.(*resumableConn); !ok {
+		t.Fatal("expected a resumable tunnel")
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	received, err := io.ReadAll(conn)
+	if err != nil || string(received) != "bye" {
+		t.Errorf("expected the tunnel to end after bye, got: %q, %v", received, err)
+	}
+}
+
+func TestSOCKSConnectErrors(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := closed.Addr().String()
+	closed.Close()
+
+	allowed := newSOCKSServer(t, &SOCKSServer{}, &TargetHandler{Allow: allowAllTargets})
+	// The default policy denies loopback addresses
+	denied := newSOCKSServer(t, &SOCKSServer{}, &TargetHandler{})
+	for _, tc := range []struct {
+		name, socks, target, expected string
+	}{
+		{name: "denied", socks: denied, target: newTCPEchoServer(t), expected: "not allowed by ruleset"},
+		{name: "refused", socks: allowed, target: refused, expected: "connection refused"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			socks, _ := proxy.SOCKS5("tcp", tc.socks, nil, proxy.Direct)
+			_, err := socks.Dial("tcp", tc.target)
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("expected %q, got: %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestSOCKSUDPAssociate(t *testing.T) {
+	target := newUDPEchoServer(t)
+	addr := newSOCKSServer(t, &SOCKSServer{UDP: true}, &TargetHandler{Allow: allowAllTargets})
+
+	control, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+	request := []byte{socksVersion, 1, socksAuthNone, socksVersion, socksCmdUDPAssociate, 0}
+	request = appendSOCKSAddr(request, "0.0.0.0:0")
+	if _, err := control.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2+4+6)
+	if _, err := io.ReadFull(control, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != socksSucceeded {
+		t.Fatalf("expected the association to succeed, got reply %v", reply[3])
+	}
+	relay, err := readSOCKSAddr(bytes.NewReader(reply[5:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("udp", relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	header := appendSOCKSAddr([]byte{0, 0, 0}, target)
+	for _, msg := range []string{"query", "query again"} {
+		if _, err := client.Write(append(header, msg...)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		dst, payload, err := parseSOCKSDatagram(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dst != target || string(payload) != msg {
+			t.Errorf("expected %q from %v, got: %q from %v", msg, target, payload, dst)
+		}
+	}
+}
+
+func TestRequestedTarget(t *testing.T) {
+	for _, tc := range []struct {
+		network, addr string
+		ok            bool
+	}{
+		{"tcp", "example.com:443", true},
+		{"udp", "[2001:db8::1]:53", true},
+		{"tcp", "example.com", false},
+		{"unix", "example.com:443", false},
+		{"tcp", "example.com:70000", false},
+	} {
+		r, _ := http.NewRequest(http.MethodGet, "http://tunnel.example", nil)
+		if err := WithTarget(nil, tc.network, tc.addr).PrepareRequest(r); err != nil {
+			t.Fatal(err)
+		}
+		network, addr, err := RequestedTarget(r)
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("%v %v: expected ok %v, got: %v", tc.network, tc.addr, tc.ok, err)
+			continue
+		}
+		if tc.ok && (network != tc.network || addr != tc.addr) {
+			t.Errorf("expected %v %v, got: %v %v", tc.network, tc.addr, network, addr)
+		}
+	}
+}
+
+func TestSOCKSAddr(t *testing.T) {
+	for _, addr := range []string{"192.0.2.1:80", "[2001:db8::1]:443", "example.com:53"} {
+		b := appendSOCKSAddr(nil, addr)
+		decoded, err := readSOCKSAddr(bytes.NewReader(b))
+		if err != nil || decoded != addr {
+			t.Errorf("expected %v, got: %v, %v", addr, decoded, err)
+		}
+	}
+	if port := binary.BigEndian.Uint16(appendSOCKSAddr(nil, "192.0.2.1:8080")[5:]); port != 8080 {
+		t.Errorf("expected port 8080, got: %v", port)
+	}
+}
@@ -0,0 +1,250 @@
+package httptunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	targetHeader = "Tunnel-Target"
+
+	// defaultTargetDialTimeout is the default timeout of the dials of a
+	// TargetHandler.
+	defaultTargetDialTimeout = 10 * time.Second
+)
+
+// ErrTargetDenied is wrapped by the errors of the targets denied by the
+// policy of a TargetHandler.
+var ErrTargetDenied = errors.New("httptunnel: target not allowed")
+
+// WithTarget returns a copy of options requesting the server to connect the
+// tunnel to addr, a host and port, over network, "tcp" or "udp". The server
+// serves the request with a TargetHandler. The tunnels to a UDP target carry
+// datagrams with Conn.WriteMessage and Conn.ReadMessage.
+func WithTarget(options *ConnectionOptions, network, addr string) *ConnectionOptions {
+	var opts ConnectionOptions
+	if options != nil {
+		opts = *options
+	}
+	target := (&url.URL{Scheme: network, Host: addr}).String()
+	opts.PrepareRequest = func(r *http.Request) error {
+		if options != nil && options.PrepareRequest != nil {
+			if err := options.PrepareRequest(r); err != nil {
+				return err
+			}
+		}
+		r.Header.Set(targetHeader, target)
+		return nil
+	}
+	return &opts
+}
+
+// RequestedTarget returns the network and address of the target requested
+// by r with WithTarget.
+func RequestedTarget(r *http.Request) (network, addr string, err error) {
+	v := r.Header.Get(targetHeader)
+	if v == "" {
+		return "", "", errors.New("httptunnel: no target requested")
+	}
+	u, err := url.Parse(v)
+	if err != nil || u.Scheme != "tcp" && u.Scheme != "udp" || u.Port() == "" || u.Hostname() == "" {
+		return "", "", fmt.Errorf("httptunnel: invalid target %q", v)
+	}
+	if _, err := strconv.ParseUint(u.Port(), 10, 16); err != nil {
+		return "", "", fmt.Errorf("httptunnel: invalid target %q", v)
+	}
+	return u.Scheme, u.Host, nil
+}
+
+// A TargetHandler serves the tunnels to the targets requested by the
+// clients with WithTarget, for example through a SOCKSServer. It dials the
+// target of each request, subject to Allow, upgrades the request with
+// Hijacker, and forwards the tunnel to the target until either end closes.
+//
+// The request is rejected with 400 Bad Request if it has no valid target,
+// 403 Forbidden if the target is not allowed, 502 Bad Gateway if it cannot
+// be dialed, and 504 Gateway Timeout if the dial timed out.
+type TargetHandler struct {
+	// Hijacker upgrades the requests.
+	Hijacker Hijacker
+
+	// Allow, if not nil, returns an error to deny a target. It is called
+	// with each resolved address of the target, so that host names cannot
+	// bypass it. If nil, the loopback, link-local, multicast and unspecified
+	// addresses are denied, and every other address is allowed.
+	Allow func(network string, addr netip.AddrPort) error
+
+	// Resolver resolves the host names of the targets. If nil,
+	// net.DefaultResolver is used.
+	Resolver *net.Resolver
+
+	// DialTimeout is the timeout of the dials of the targets. If zero, it is
+	// 10 seconds.
+	DialTimeout time.Duration
+
+	// UDPIdleTimeout, if not zero, closes the tunnels to UDP targets that
+	// forwarded no datagram for that duration.
+	UDPIdleTimeout time.Duration
+}
+
+func defaultAllowTarget(network string, addr netip.AddrPort) error {
+	ip := addr.Addr()
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsLinkLocalMulticast() {
+		return fmt.Errorf("%w: %s", ErrTargetDenied, addr)
+	}
+	return nil
+}
+
+func (h *TargetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The target is dialed once the request passed the checks of the
+	// Hijacker, and the dial errors are reported with their own status
+	var network, addr string
+	var target net.Conn
+	hijacker := h.Hijacker
+	handleRequest := hijacker.OverrideHandleRequest
+	hijacker.OverrideHandleRequest = func(r *http.Request) error {
+		if handleRequest != nil {
+			if err := handleRequest(r); err != nil {
+				return err
+			}
+		}
+		var err error
+		if network, addr, err = RequestedTarget(r); err != nil {
+			return &statusError{http.StatusBadRequest, err}
+		}
+		if target, err = h.dial(r.Context(), network, addr); err != nil {
+			var netErr net.Error
+			switch {
+			case errors.Is(err, ErrTargetDenied):
+				return &statusError{http.StatusForbidden, err}
+			case errors.As(err, &netErr) && netErr.Timeout():
+				return &statusError{http.StatusGatewayTimeout, err}
+			default:
+				return &statusError{http.StatusBadGateway, err}
+			}
+		}
+		return nil
+	}
+	netConn, _, err := hijacker.Upgrade(w, r, nil)
+	if err != nil {
+		if target != nil {
+			_ = target.Close()
+		}
+		return
+	}
+	conn := netConn.(*Conn)
+	if network == "udp" {
+		defer conn.Close()
+		_ = forwardUDP(r.Context(), conn, target, h.UDPIdleTimeout)
+		return
+	}
+	pipeConns(conn, target)
+}
+
+// statusError is an error rejecting a request with a status other than
+// 403 Forbidden.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// dial resolves and dials the target addr, skipping the addresses that are
+// not allowed.
+func (h *TargetHandler) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	timeout := h.DialTimeout
+	if timeout == 0 {
+		timeout = defaultTargetDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip}
+	} else {
+		resolver := h.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		if ips, err = resolver.LookupNetIP(ctx, "ip", host); err != nil {
+			return nil, err
+		}
+	}
+
+	allow := h.Allow
+	if allow == nil {
+		allow = defaultAllowTarget
+	}
+	var d net.Dialer
+	var firstErr error
+	for _, ip := range ips {
+		addrPort := netip.AddrPortFrom(ip.Unmap(), uint16(port))
+		err := allow(network, addrPort)
+		if err == nil {
+			var conn net.Conn
+			if conn, err = d.DialContext(ctx, network, addrPort.String()); err == nil {
+				return conn, nil
+			}
+		} else if !errors.Is(err, ErrTargetDenied) {
+			err = fmt.Errorf("%w: %s: %w", ErrTargetDenied, addrPort, err)
+		}
+		if firstErr == nil || errors.Is(firstErr, ErrTargetDenied) {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("httptunnel: no address for %s", host)
+	}
+	return nil, firstErr
+}
+
+// pipeConns copies the data of a to b and of b to a until both directions
+// are done. When a direction reaches EOF, the connection written to is closed
+// for writing, and the other direction keeps running until it is done too.
+// If that connection cannot be half-closed, or a direction fails, both
+// connections are closed.
+func pipeConns(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pipeOneWay(b, a)
+	}()
+	pipeOneWay(a, b)
+	<-done
+	_ = a.Close()
+	_ = b.Close()
+}
+
+func pipeOneWay(dst, src net.Conn) {
+	_, err := io.Copy(dst, src)
+	if err == nil && closeWrite(dst) == nil {
+		return
+	}
+	_ = dst.Close()
+	_ = src.Close()
+}
@@ -0,0 +1,85 @@
+package httptunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+)
+
+const defaultClientSessionCacheSize = 256
+
+// defaultClientSessionCache holds the TLS sessions of the Dialers whose TLS
+// configuration has no ClientSessionCache.
+var defaultClientSessionCache = tls.NewLRUClientSessionCache(defaultClientSessionCacheSize)
+
+// scopedSessionCache is a view of a ClientSessionCache restricted to the
+// sessions created with one TLS configuration, so that a session verified
+// with the root CAs or client certificate of a configuration is never
+// resumed with another.
+type scopedSessionCache struct {
+	cache tls.ClientSessionCache
+	scope string
+}
+
+func (c *scopedSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return c.cache.Get(c.scope + sessionKey)
+}
+
+func (c *scopedSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.cache.Put(c.scope+sessionKey, cs)
+}
+
+// maxSessionScopes bounds the number of TLS configurations held by
+// sessionScopes.
+const maxSessionScopes = 1024
+
+// sessionScopes assigns a scope to each TLS configuration of the default
+// session cache. The configurations are kept alive by the map, so that the
+// address of a configuration is never reused by another while its sessions
+// can be resumed. The scopes are never reused either, so the sessions of the
+// configurations dropped when the map is full are no longer resumed.
+var sessionScopes struct {
+	sync.Mutex
+	ids  map[*tls.Config]uint64
+	next uint64
+}
+
+func sessionScope(base *tls.Config) uint64 {
+	if base == nil {
+		return 0
+	}
+	sessionScopes.Lock()
+	defer sessionScopes.Unlock()
+	if id, ok := sessionScopes.ids[base]; ok {
+		return id
+	}
+	if sessionScopes.ids == nil || len(sessionScopes.ids) >= maxSessionScopes {
+		sessionScopes.ids = make(map[*tls.Config]uint64)
+	}
+	sessionScopes.next++
+	sessionScopes.ids[base] = sessionScopes.next
+	return sessionScopes.next
+}
+
+// sessionCache returns the session cache of the connections made with base,
+// for the given use of it.
+func sessionCache(base *tls.Config, use string) tls.ClientSessionCache {
+	if base != nil && base.ClientSessionCache != nil {
+		return base.ClientSessionCache
+	}
+	return &scopedSessionCache{
+		cache: defaultClientSessionCache,
+		scope: fmt.Sprintf("%s %d ", use, sessionScope(base)),
+	}
+}
+
+type sessionCacheKey struct{}
+
+// ClientSessionCacheFromContext returns the TLS session cache of the Dialer
+// calling NetDialTLSContext with ctx. Using it in the TLS configuration of
+// the connections lets them resume the sessions of the previous dials.
+func ClientSessionCacheFromContext(ctx context.Context) (tls.ClientSessionCache, bool) {
+	cache, ok := ctx.Value(sessionCacheKey{}).(tls.ClientSessionCache)
+	return cache, ok
+}
@@ -0,0 +1,111 @@
+package httptunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptrace"
+	"runtime"
+	"testing"
+)
+
+func TestTLSSessionResumption(t *testing.T) {
+	s := newTLSServer(t)
+	defer s.Close()
+
+	dial := func(d *Dialer) (resumed bool) {
+		t.Helper()
+		traced := false
+		ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+			TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+				traced = true
+				resumed = state.DidResume
+			},
+		})
+		conn, _, resp, err := d.DialContext(ctx, s.URL, testDialOptions)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer conn.Close()
+		// The session ticket is received with the first read
+		sendRecv(conn, resp, t)
+		state, ok := conn.(*Conn).TLSConnectionState()
+		if !ok || state.Version == 0 || state.CipherSuite == 0 {
+			t.Fatalf("expected a TLS connection state, got: %v, %v", state, ok)
+		}
+		if !traced || state.DidResume != resumed {
+			t.Errorf("expected the trace to report the resumption of the connection state")
+		}
+		return state.DidResume
+	}
+
+	d := testDialer
+	d.TLSClientConfig = &tls.Config{RootCAs: rootCAs(t, s.Server)}
+	if dial(&d) {
+		t.Error("expected the first session not to be resumed")
+	}
+	if !dial(&d) {
+		t.Error("expected the second session to be resumed")
+	}
+
+	// Sessions are not shared with other TLS configurations
+	other := testDialer
+	other.TLSClientConfig = &tls.Config{RootCAs: d.TLSClientConfig.RootCAs}
+	if dial(&other) {
+		t.Error("expected the session of another configuration not to be resumed")
+	}
+}
+
+func TestTLSSessionResumptionNetDialTLSContext(t *testing.T) {
+	s := newTLSServer(t)
+	defer s.Close()
+
+	cfg := &tls.Config{RootCAs: rootCAs(t, s.Server), ServerName: "example.com"}
+	d := testDialer
+	d.NetDialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		cache, ok := ClientSessionCacheFromContext(ctx)
+		if !ok {
+			t.Error("expected a session cache in the context")
+		}
+		netConn, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg := cfg.Clone()
+		cfg.ClientSessionCache = cache
+		return tls.Client(netConn, cfg), nil
+	}
+
+	for i, expected := range []bool{false, true} {
+		conn, _, resp, err := d.Dial(s.URL, testDialOptions)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		sendRecv(conn, resp, t)
+		state, ok := conn.(*Conn).TLSConnectionState()
+		conn.Close()
+		if !ok || state.DidResume != expected {
+			t.Errorf("dial %d: expected resumed %v, got: %v, %v", i, expected, state.DidResume, ok)
+		}
+	}
+}
+
+func TestSessionScope(t *testing.T) {
+	cfg := &tls.Config{}
+	if sessionScope(cfg) != sessionScope(cfg) {
+		t.Error("expected the scope of a configuration to be stable")
+	}
+	// The scopes are never reused, even once the configurations are
+	// garbage collected and their addresses reused
+	seen := map[uint64]bool{sessionScope(nil): true}
+	for i := range 3 * maxSessionScopes {
+		id := sessionScope(&tls.Config{})
+		if seen[id] {
+			t.Fatalf("scope %v reused", id)
+		}
+		seen[id] = true
+		if i%100 == 0 {
+			runtime.GC()
+		}
+	}
+}
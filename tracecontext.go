@@ -0,0 +1,213 @@
+package httptunnel
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TraceID identifies a trace as defined by W3C Trace Context.
+type TraceID [16]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// FlagsSampled is the trace flag that marks a trace as sampled.
+const FlagsSampled byte = 0x01
+
+// SpanContext is the part of a span that is propagated across the tunnel
+// handshake in the traceparent and tracestate headers.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+}
+
+// IsValid reports whether sc has a non-zero trace and span ID.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// IsSampled reports whether the sampled flag is set.
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&FlagsSampled != 0
+}
+
+// Traceparent formats sc as the value of a traceparent header.
+func (sc SpanContext) Traceparent() string {
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a copy of ctx carrying sc. A Dialer
+// propagates the span context found in the context passed to DialContext.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context carried by ctx, if any.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+var errBadTraceparent = errors.New("httptunnel: malformed traceparent header")
+
+// ParseTraceparent parses the value of a traceparent header.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	// version "-" trace-id "-" parent-id "-" trace-flags
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return sc, errBadTraceparent
+	}
+	version, err := decodeLowerHex(s[:2])
+	if err != nil || version[0] == 0xff || version[0] == 0 && len(s) != 55 {
+		return sc, errBadTraceparent
+	}
+	if len(s) > 55 && s[55] != '-' {
+		return sc, errBadTraceparent
+	}
+	traceID, err := decodeLowerHex(s[3:35])
+	if err != nil {
+		return sc, errBadTraceparent
+	}
+	spanID, err := decodeLowerHex(s[36:52])
+	if err != nil {
+		return sc, errBadTraceparent
+	}
+	flags, err := decodeLowerHex(s[53:55])
+	if err != nil {
+		return sc, errBadTraceparent
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return SpanContext{}, errBadTraceparent
+	}
+	return sc, nil
+}
+
+func decodeLowerHex(s string) ([]byte, error) {
+	if strings.ToLower(s) != s {
+		return nil, errBadTraceparent
+	}
+	return hex.DecodeString(s)
+}
+
+func injectSpanContext(h http.Header, sc SpanContext) {
+	h.Set("Traceparent", sc.Traceparent())
+	if sc.TraceState != "" {
+		h.Set("Tracestate", sc.TraceState)
+	} else {
+		h.Del("Tracestate")
+	}
+}
+
+func extractSpanContext(h http.Header) (SpanContext, bool) {
+	values := h.Values("Traceparent")
+	if len(values) != 1 {
+		return SpanContext{}, false
+	}
+	sc, err := ParseTraceparent(values[0])
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sc.TraceState = strings.Join(h.Values("Tracestate"), ",")
+	return sc, true
+}
+
+// Span is a completed tunnel handshake, as passed to a SpanExporter. Dialers
+// record "httptunnel.dial" spans and Hijackers "httptunnel.accept" spans;
+// the accept span is a child of the dial span when the two are connected.
+// The attempts to resume a tunnel are "httptunnel.resume" spans, children of
+// the dial span of the tunnel.
+type Span struct {
+	Name        string
+	Kind        Side
+	SpanContext SpanContext
+	// Parent is the span ID of the parent span. It is zero for root spans.
+	Parent     SpanID
+	Start, End time.Time
+	Attributes map[string]string
+	// Err is the error the handshake failed with, if any.
+	Err error
+}
+
+// A SpanExporter receives the spans recorded by a Dialer or Hijacker. Only
+// sampled spans are exported. ExportSpan must not block.
+type SpanExporter interface {
+	ExportSpan(span Span)
+}
+
+// tunnelSpan tracks the span of a single handshake.
+type tunnelSpan struct {
+	exporter SpanExporter
+	span     Span
+}
+
+// startSpan starts a span that is a child of parent, or the root of a new
+// trace if parent is not valid. Without an exporter no span is recorded and
+// parent is propagated unchanged.
+func startSpan(name string, side Side, parent SpanContext, exporter SpanExporter) *tunnelSpan {
+	if exporter == nil {
+		if !parent.IsValid() {
+			return nil
+		}
+		return &tunnelSpan{span: Span{SpanContext: parent}}
+	}
+	sc := SpanContext{
+		TraceID:    parent.TraceID,
+		Flags:      parent.Flags,
+		TraceState: parent.TraceState,
+	}
+	if !parent.IsValid() {
+		_, _ = rand.Read(sc.TraceID[:])
+		sc.Flags = FlagsSampled
+	}
+	_, _ = rand.Read(sc.SpanID[:])
+	return &tunnelSpan{
+		exporter: exporter,
+		span: Span{
+			Name:        name,
+			Kind:        side,
+			SpanContext: sc,
+			Parent:      parent.SpanID,
+			Start:       time.Now(),
+			Attributes:  make(map[string]string),
+		},
+	}
+}
+
+func (s *tunnelSpan) spanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.span.SpanContext
+}
+
+func (s *tunnelSpan) setAttribute(key, value string) {
+	if s == nil || s.exporter == nil {
+		return
+	}
+	s.span.Attributes[key] = value
+}
+
+func (s *tunnelSpan) end(err error) {
+	if s == nil || s.exporter == nil || !s.span.SpanContext.IsSampled() {
+		return
+	}
+	s.span.End = time.Now()
+	s.span.Err = err
+	s.exporter.ExportSpan(s.span)
+}
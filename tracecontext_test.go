@@ -0,0 +1,118 @@
+package httptunnel
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+var parseTraceparentTests = []struct {
+	s     string
+	valid bool
+}{
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true},
+	{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true},
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+	{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+	{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+	{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for _, tt := range parseTraceparentTests {
+		sc, err := ParseTraceparent(tt.s)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseTraceparent(%q) error = %v, want valid %v", tt.s, err, tt.valid)
+			continue
+		}
+		if tt.valid && sc.Traceparent()[3:] != tt.s[3:55] {
+			t.Errorf("expected %v to round trip, got: %v", tt.s, sc.Traceparent())
+		}
+	}
+}
+
+type spanCollector struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+func (c *spanCollector) ExportSpan(span Span) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.spans = append(c.spans, span)
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	clientSpans := &spanCollector{}
+	serverSpans := &spanCollector{}
+	var handledSpan SpanContext
+	s := newServerHijacker(t, &Hijacker{
+		SpanExporter: serverSpans,
+		OverrideHandleRequest: func(r *http.Request) error {
+			handledSpan, _ = SpanContextFromContext(r.Context())
+			return nil
+		},
+	})
+
+	parent, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent.TraceState = "vendor=value"
+	ctx := ContextWithSpanContext(context.Background(), parent)
+
+	d := testDialer
+	d.SpanExporter = clientSpans
+	conn, _, resp, err := d.DialContext(ctx, s.URL, testDialOptions)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	sendRecv(conn, resp, t)
+	conn.Close()
+	s.Close()
+
+	if len(clientSpans.spans) != 1 || len(serverSpans.spans) != 1 {
+		t.Fatalf("expected one span on each side, got: %v, %v", clientSpans.spans, serverSpans.spans)
+	}
+	dial, accept := clientSpans.spans[0], serverSpans.spans[0]
+	if dial.Parent != parent.SpanID {
+		t.Errorf("expected dial span parent %v, got: %v", parent.SpanID, dial.Parent)
+	}
+	if accept.Parent != dial.SpanContext.SpanID {
+		t.Errorf("expected accept span parent %v, got: %v", dial.SpanContext.SpanID, accept.Parent)
+	}
+	for _, span := range []Span{dial, accept} {
+		if span.SpanContext.TraceID != parent.TraceID {
+			t.Errorf("%v: expected trace %v, got: %v", span.Name, parent.TraceID, span.SpanContext.TraceID)
+		}
+		if span.SpanContext.TraceState != parent.TraceState {
+			t.Errorf("%v: expected tracestate %q, got: %q", span.Name, parent.TraceState, span.SpanContext.TraceState)
+		}
+	}
+	if handledSpan != accept.SpanContext {
+		t.Errorf("expected request context to carry %v, got: %v", accept.SpanContext, handledSpan)
+	}
+	if sc := conn.(*Conn).SpanContext(); sc != dial.SpanContext {
+		t.Errorf("expected conn span context %v, got: %v", dial.SpanContext, sc)
+	}
+	if code := dial.Attributes["http.status_code"]; code != "101" {
+		t.Errorf("expected status code attribute 101, got: %v", code)
+	}
+}
+
+func TestTraceContextWithoutExporter(t *testing.T) {
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r, _ := http.NewRequest(http.MethodGet, "http://test.com/", nil)
+	injectSpanContext(r.Header, startSpan("", SideClient, parent, nil).spanContext())
+	sc, ok := extractSpanContext(r.Header)
+	if !ok || sc != parent {
+		t.Errorf("expected %v to be propagated as is, got: %v", parent, sc)
+	}
+	if span := startSpan("", SideClient, SpanContext{}, nil); span != nil {
+		t.Errorf("expected no span without exporter or parent, got: %v", span)
+	}
+}